@@ -0,0 +1,99 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultBatchSize is how many events a Batcher collects before publishing
+// them, unless told otherwise.
+const DefaultBatchSize = 100
+
+// Batcher collects events, such as buffered sensor readings, and publishes
+// them with PublishBatch once it has size of them, or interval after the
+// first was added, whichever comes first. Events from a batch that fails to
+// publish are dropped and the error returned, by the next call to Add or
+// Flush if the batch was published on the interval.
+type Batcher struct {
+	c        *Client
+	size     int
+	interval time.Duration
+
+	mu     sync.Mutex
+	events []Event
+	timer  *time.Timer
+	gen    int
+	err    error
+}
+
+// NewBatcher returns a Batcher publishing size events at a time, or
+// DefaultBatchSize if size isn't positive. An interval of zero publishes only
+// when the batch is full or flushed.
+func (c *Client) NewBatcher(size int, interval time.Duration) *Batcher {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	return &Batcher{c: c, size: size, interval: interval}
+}
+
+// Add adds an event to the batch, publishing the batch if it's full.
+func (b *Batcher) Add(e Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.events = append(b.events, e)
+	if len(b.events) >= b.size {
+		return errors.Join(b.takeErr(), b.flush())
+	}
+
+	if b.timer == nil && b.interval > 0 {
+		gen := b.gen
+		b.timer = time.AfterFunc(b.interval, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			// Unless the batch was published in the meantime
+			if b.gen == gen {
+				b.err = errors.Join(b.err, b.flush())
+			}
+		})
+	}
+
+	return b.takeErr()
+}
+
+// Flush publishes whatever has been added, which should be done before the
+// Batcher is thrown away.
+func (b *Batcher) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return errors.Join(b.takeErr(), b.flush())
+}
+
+// takeErr returns the error from publishing on the interval, if there was
+// one, once. It requires the batcher to be locked.
+func (b *Batcher) takeErr() error {
+	err := b.err
+	b.err = nil
+	return err
+}
+
+// flush requires the batcher to be locked.
+func (b *Batcher) flush() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.gen++
+
+	if len(b.events) == 0 {
+		return nil
+	}
+
+	events := b.events
+	b.events = nil
+	_, err := b.c.PublishBatch(events)
+	return err
+}
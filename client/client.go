@@ -1,22 +1,56 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Client represents a YakAPI client
 type Client struct {
 	BaseURL string
+
+	// Publisher identifies this client on the events it publishes
+	Publisher string
 }
 
 // Event represents a YakAPI event
 type Event struct {
-	StreamName string
-	Data       []byte
+	ID          string    `json:"id"`
+	StreamName  string    `json:"stream"`
+	Time        time.Time `json:"time"`
+	ContentType string    `json:"content_type"`
+	Publisher   string    `json:"publisher"`
+	Data        []byte    `json:"data"`
+
+	// Dropped is the number of events the server dropped for this
+	// subscription just before this one, because it wasn't keeping up.
+	Dropped uint64 `json:"dropped"`
+
+	// DeliveryTag is set on events from an acked subscription, which must
+	// be acked or nacked. Attempt counts deliveries of the event so far.
+	DeliveryTag string `json:"delivery_tag,omitempty"`
+	Attempt     int    `json:"attempt,omitempty"`
+
+	// CorrelationID and ReplyTo are set on requests, and a reply carries the
+	// CorrelationID of the request it answers.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	ReplyTo       string `json:"reply_to,omitempty"`
+
+	// Expires is when the event goes stale, after which the server discards
+	// it rather than deliver it. TTL is the seconds it had left when it was
+	// delivered.
+	Expires *time.Time `json:"expires,omitempty"`
+	TTL     float64    `json:"ttl,omitempty"`
 }
 
 // NewClient creates a new YakAPI client
@@ -24,6 +58,16 @@ func NewClient(baseURL string) *Client {
 	return &Client{BaseURL: baseURL}
 }
 
+// streamURL escapes each part of a stream's name, so characters such as the
+// '#' wildcard aren't taken for part of the URL.
+func (c *Client) streamURL(streamName string) string {
+	parts := strings.Split(streamName, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return fmt.Sprintf("%s/v1/stream/%s", c.BaseURL, strings.Join(parts, "/"))
+}
+
 // Subscribe subscribes to the specified streams and returns a channel of events
 func (c *Client) Subscribe(streamNames []string) (<-chan Event, error) {
 	eventChan := make(chan Event)
@@ -33,7 +77,7 @@ func (c *Client) Subscribe(streamNames []string) (<-chan Event, error) {
 		wg.Add(1)
 		go func(name string) {
 			defer wg.Done()
-			err := c.subscribeToStream(name, eventChan)
+			err := c.subscribeToStream(context.Background(), name, nil, eventChan)
 			if err != nil {
 				fmt.Printf("Error subscribing to stream %s: %v\n", name, err)
 			}
@@ -48,10 +92,64 @@ func (c *Client) Subscribe(streamNames []string) (<-chan Event, error) {
 	return eventChan, nil
 }
 
-func (c *Client) subscribeToStream(streamName string, eventChan chan<- Event) error {
-	url := fmt.Sprintf("%s/v1/stream/%s", c.BaseURL, streamName)
+// SubscribeAcked subscribes to a stream's queue for a group, which may be
+// empty for the default group. Each event is delivered to one member of the
+// group, and must be acked, or nacked to have it delivered again. Events that
+// aren't acked within the server's visibility timeout are delivered again,
+// until they've used up their attempts and are sent to the dead letter stream.
+func (c *Client) SubscribeAcked(streamName, group string) (<-chan Event, error) {
+	eventChan := make(chan Event)
+
+	query := url.Values{"ack": {"true"}}
+	if group != "" {
+		query.Set("group", group)
+	}
+
+	go func() {
+		defer close(eventChan)
+		err := c.subscribeToStream(context.Background(), streamName, query, eventChan)
+		if err != nil {
+			fmt.Printf("Error subscribing to stream %s: %v\n", streamName, err)
+		}
+	}()
+
+	return eventChan, nil
+}
 
-	resp, err := http.Get(url)
+// SubscribeSince subscribes to a stream, or pattern of streams, first
+// replaying the buffered events published after the event with ID since, if
+// it's set. Events are sent to eventChan until ctx is done, which returns nil,
+// or the subscription ends, which returns why. Passing the ID of the last
+// event received resumes a subscription where it left off.
+func (c *Client) SubscribeSince(ctx context.Context, streamName, since string, eventChan chan<- Event) error {
+	var query url.Values
+	if since != "" {
+		query = url.Values{"since": {since}}
+	}
+
+	err := c.subscribeToStream(ctx, streamName, query, eventChan)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err == nil {
+		return io.EOF
+	}
+	return err
+}
+
+func (c *Client) subscribeToStream(ctx context.Context, streamName string, query url.Values, eventChan chan<- Event) error {
+	url := c.streamURL(streamName)
+	if len(query) > 0 {
+		url += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Accept", framesContentType+", application/x-ndjson;q=0.9")
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("HTTP GET error: %v", err)
 	}
@@ -61,35 +159,64 @@ func (c *Client) subscribeToStream(streamName string, eventChan chan<- Event) er
 		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	buf := make([]byte, 16*1024)
+	// Servers that predate framing send JSON envelopes
+	var decode func(*Event) error
+	if resp.Header.Get("Content-Type") == framesContentType {
+		r := bufio.NewReader(resp.Body)
+		decode = func(e *Event) error { return readFrame(r, e) }
+	} else {
+		d := json.NewDecoder(resp.Body)
+		decode = func(e *Event) error { return d.Decode(e) }
+	}
+
 	for {
-		n, err := resp.Body.Read(buf)
-		if err != nil {
-			return fmt.Errorf("error reading chunk: %v", err)
+		var event Event
+		err := decode(&event)
+		if errors.Is(err, io.EOF) {
+			return nil
 		}
-		if n == len(buf) {
-			return fmt.Errorf("chunk too large")
+		if err != nil {
+			return fmt.Errorf("error decoding event: %v", err)
 		}
 
-		// HTTP chunk may end with a newline, so we need to trim it
-		s := n
-		if buf[s-1] == '\n' {
-			s--
+		if event.StreamName == "" {
+			event.StreamName = streamName
 		}
 
-		eventData := make([]byte, s)
-		copy(eventData, buf[:s])
-
-		eventChan <- Event{StreamName: streamName, Data: eventData}
+		select {
+		case eventChan <- event:
+		case <-ctx.Done():
+			return nil
+		}
 	}
 }
 
 func (c *Client) Publish(streamName string, b []byte, contentType string) error {
-	url := fmt.Sprintf("%s/v1/stream/%s", c.BaseURL, streamName)
+	return c.publish(streamName, b, contentType, nil)
+}
 
-	buf := bytes.NewBuffer(b)
+// PublishTTL publishes an event that's discarded rather than delivered once
+// ttl has passed, for values that are worse late than never.
+func (c *Client) PublishTTL(streamName string, b []byte, contentType string, ttl time.Duration) error {
+	return c.publish(streamName, b, contentType, http.Header{"X-Yakapi-Ttl": {ttl.String()}})
+}
+
+func (c *Client) publish(streamName string, b []byte, contentType string, header http.Header) error {
+	url := c.streamURL(streamName)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(b))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.Publisher != "" {
+		req.Header.Set("X-Yakapi-Publisher", c.Publisher)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
-	resp, err := http.Post(url, contentType, buf)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("HTTP POST error: %v", err)
 	}
@@ -110,3 +237,250 @@ func (c *Client) PublishJSON(streamName string, data interface{}) error {
 
 	return c.Publish(streamName, payload, "application/json")
 }
+
+// ErrNoReply is returned by Request when no reply arrives in time.
+var ErrNoReply = errors.New("no reply")
+
+// Request publishes a request to a stream and waits for its reply, for as
+// long as ctx allows, up to the server's limit of a minute. Whoever handles
+// requests on the stream answers with Reply.
+func (c *Client) Request(ctx context.Context, streamName string, b []byte, contentType string) (Event, error) {
+	var event Event
+
+	u := c.streamURL(streamName) + "/request"
+	if deadline, ok := ctx.Deadline(); ok {
+		u += "?timeout=" + url.QueryEscape(min(time.Until(deadline), time.Minute).String())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return event, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/x-ndjson")
+	if c.Publisher != "" {
+		req.Header.Set("X-Yakapi-Publisher", c.Publisher)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return event, ErrNoReply
+		}
+		return event, fmt.Errorf("HTTP POST error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGatewayTimeout {
+		return event, ErrNoReply
+	}
+	if resp.StatusCode != http.StatusOK {
+		return event, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&event)
+	if err != nil {
+		return event, fmt.Errorf("error decoding event: %v", err)
+	}
+	return event, nil
+}
+
+// Reply answers a request received from a stream, publishing the reply to
+// the stream the request asked for.
+func (c *Client) Reply(req Event, b []byte, contentType string) error {
+	if req.ReplyTo == "" {
+		return errors.New("event is not a request")
+	}
+
+	correlationID := req.CorrelationID
+	if correlationID == "" {
+		correlationID = req.ID
+	}
+
+	return c.publish(req.ReplyTo, b, contentType, http.Header{"X-Yakapi-Correlation-Id": {correlationID}})
+}
+
+// ErrUnknownTag is returned by Ack and Nack when the server no longer has the
+// delivery outstanding, usually because it timed out and was delivered again.
+var ErrUnknownTag = errors.New("unknown delivery tag")
+
+// Ack acknowledges an event from an acked subscription, so it isn't delivered
+// again.
+func (c *Client) Ack(e Event) error {
+	return c.settle(e, "ack")
+}
+
+// Nack hands back an event from an acked subscription, to be delivered again
+// straight away.
+func (c *Client) Nack(e Event) error {
+	return c.settle(e, "nack")
+}
+
+func (c *Client) settle(e Event, action string) error {
+	if e.DeliveryTag == "" {
+		return errors.New("event has no delivery tag")
+	}
+
+	body, err := json.Marshal(struct {
+		Tags []string `json:"tags"`
+	}{Tags: []string{e.DeliveryTag}})
+	if err != nil {
+		return fmt.Errorf("error marshaling request: %v", err)
+	}
+
+	resp, err := http.Post(c.streamURL(e.StreamName)+"/"+action, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("HTTP POST error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return ErrUnknownTag
+	default:
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+// ErrNoRetained is returned by Latest when a stream has no retained event.
+var ErrNoRetained = errors.New("no retained event")
+
+// Latest fetches the event a stream has retained.
+func (c *Client) Latest(streamName string) (Event, error) {
+	var event Event
+
+	req, err := http.NewRequest(http.MethodGet, c.streamURL(streamName)+"/latest", nil)
+	if err != nil {
+		return event, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return event, fmt.Errorf("HTTP GET error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return event, ErrNoRetained
+	}
+	if resp.StatusCode != http.StatusOK {
+		return event, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&event)
+	if err != nil {
+		return event, fmt.Errorf("error decoding event: %v", err)
+	}
+
+	if event.StreamName == "" {
+		event.StreamName = streamName
+	}
+	return event, nil
+}
+
+type batchItem struct {
+	Stream      string     `json:"stream"`
+	ContentType string     `json:"content_type,omitempty"`
+	Time        *time.Time `json:"time,omitempty"`
+	TTL         string     `json:"ttl,omitempty"`
+	Data        []byte     `json:"data"`
+}
+
+type batchResult struct {
+	Stream string `json:"stream"`
+	ID     string `json:"id"`
+	Error  string `json:"error"`
+}
+
+// BatchError is returned by PublishBatch when the server refuses some of a
+// batch's events, so none of them were published. Invalid has the problem
+// with each refused event by its index in the batch.
+type BatchError struct {
+	StatusCode int
+	Message    string
+	Invalid    map[int]string
+}
+
+func (e *BatchError) Error() string {
+	first := -1
+	for i := range e.Invalid {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	return fmt.Sprintf("event %d: %s: %s", first, e.Message, e.Invalid[first])
+}
+
+// PublishBatch publishes many events in one request, in order. Each event
+// names its stream in StreamName and may carry its own Time, such as when a
+// reading was taken, and a TTL in seconds from then. It returns the ID given
+// to each event. If the server refuses any of the events the error is a
+// *BatchError.
+func (c *Client) PublishBatch(events []Event) ([]string, error) {
+	items := make([]batchItem, len(events))
+	for i, e := range events {
+		items[i] = batchItem{Stream: e.StreamName, ContentType: e.ContentType, Data: e.Data}
+		if !e.Time.IsZero() {
+			t := e.Time
+			items[i].Time = &t
+		}
+		if e.TTL > 0 {
+			items[i].TTL = time.Duration(e.TTL * float64(time.Second)).String()
+		}
+	}
+
+	payload, err := json.Marshal(items)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling batch: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.BaseURL+"/v1/batch", bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Publisher != "" {
+		req.Header.Set("X-Yakapi-Publisher", c.Publisher)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP POST error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error   string        `json:"error"`
+		Results []batchResult `json:"results"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		berr := &BatchError{StatusCode: resp.StatusCode, Message: result.Error, Invalid: make(map[int]string)}
+		for i, r := range result.Results {
+			if r.Error != "" {
+				berr.Invalid[i] = r.Error
+			}
+		}
+
+		// Events are only refused, rather than left unpublished, when
+		// they're at fault
+		refused := resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity
+		if refused && len(berr.Invalid) > 0 {
+			return nil, berr
+		}
+		return nil, fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, result.Error)
+	}
+
+	ids := make([]string, len(result.Results))
+	for i, r := range result.Results {
+		ids[i] = r.ID
+	}
+	return ids, nil
+}
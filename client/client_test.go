@@ -1,14 +1,39 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
+func encodeFrame(t *testing.T, e Event) []byte {
+	data := e.Data
+	e.Data = nil
+
+	meta, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("Failed to marshal envelope: %v", err)
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(meta)))
+	b = append(b, meta...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
 func TestClient(t *testing.T) {
 	// Create a mock HTTP server with chunked encoding
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -17,6 +42,11 @@ func TestClient(t *testing.T) {
 			t.Fatal("Expected http.ResponseWriter to be an http.Flusher")
 		}
 
+		if !strings.HasPrefix(r.Header.Get("Accept"), framesContentType) {
+			t.Errorf("Expected Accept %s, got '%s'", framesContentType, r.Header.Get("Accept"))
+		}
+
+		w.Header().Set("Content-Type", framesContentType)
 		w.Header().Set("Transfer-Encoding", "chunked")
 		w.WriteHeader(http.StatusOK)
 
@@ -26,12 +56,18 @@ func TestClient(t *testing.T) {
 			{"message": "Event 2"},
 		}
 
-		for _, event := range events {
+		for i, event := range events {
 			eventJSON, err := json.Marshal(event)
 			if err != nil {
 				t.Fatalf("Failed to marshal event: %v", err)
 			}
-			fmt.Fprint(w, string(eventJSON))
+			w.Write(encodeFrame(t, Event{
+				ID:          fmt.Sprintf("event-%d", i),
+				Time:        time.Now(),
+				ContentType: "application/json",
+				Publisher:   "test",
+				Data:        eventJSON,
+			}))
 			flusher.Flush()
 			time.Sleep(100 * time.Millisecond)
 		}
@@ -79,6 +115,14 @@ collectLoop:
 			t.Errorf("Event %d: expected stream name 'test-stream', got '%s'", i, event.StreamName)
 		}
 
+		if event.ID != fmt.Sprintf("event-%d", i) {
+			t.Errorf("Event %d: expected id 'event-%d', got '%s'", i, i, event.ID)
+		}
+
+		if event.ContentType != "application/json" {
+			t.Errorf("Event %d: expected content type 'application/json', got '%s'", i, event.ContentType)
+		}
+
 		var data map[string]interface{}
 
 		err := json.Unmarshal(event.Data, &data)
@@ -92,3 +136,157 @@ collectLoop:
 		}
 	}
 }
+
+func TestReadFrame(t *testing.T) {
+	// Large binary payloads, with newlines, arriving a byte at a time
+	payload := bytes.Repeat([]byte{0, '\n', 0xff, '\r'}, 16<<10)
+
+	var stream []byte
+	stream = append(stream, encodeFrame(t, Event{ID: "one", Data: payload})...)
+	stream = append(stream, encodeFrame(t, Event{ID: "two", Data: []byte{}})...)
+
+	r := bufio.NewReader(iotest.OneByteReader(bytes.NewReader(stream)))
+
+	var e Event
+	if err := readFrame(r, &e); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	if e.ID != "one" || !bytes.Equal(e.Data, payload) {
+		t.Errorf("Frame one corrupted: id %q, %d bytes", e.ID, len(e.Data))
+	}
+
+	e = Event{}
+	if err := readFrame(r, &e); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	if e.ID != "two" || len(e.Data) != 0 {
+		t.Errorf("Frame two corrupted: id %q, %d bytes", e.ID, len(e.Data))
+	}
+
+	if err := readFrame(r, &e); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+
+	truncated := bufio.NewReader(bytes.NewReader(stream[:100]))
+	if err := readFrame(truncated, &e); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestConnCloseTimeout(t *testing.T) {
+	// A server that never answers the close handshake
+	hold := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		<-hold
+	}))
+	defer server.Close()
+	defer close(hold)
+
+	conn, err := NewClient(server.URL).Dial(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * closeTimeout):
+		t.Fatal("Close hung waiting for the server")
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	batches := make(chan []batchItem, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var items []batchItem
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			t.Errorf("Failed to decode batch: %v", err)
+		}
+		batches <- items
+
+		results := make([]batchResult, len(items))
+		for i, item := range items {
+			results[i] = batchResult{Stream: item.Stream, ID: fmt.Sprintf("id%d", i)}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"results": results})
+	}))
+	defer server.Close()
+
+	next := func() []batchItem {
+		t.Helper()
+		select {
+		case items := <-batches:
+			return items
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for a batch")
+			return nil
+		}
+	}
+
+	b := NewClient(server.URL).NewBatcher(2, 50*time.Millisecond)
+	add := func(data string) {
+		t.Helper()
+		if err := b.Add(Event{StreamName: "gps", ContentType: "text/plain", Data: []byte(data)}); err != nil {
+			t.Fatalf("Failed to add: %v", err)
+		}
+	}
+
+	// Full batches are published straight away
+	add("1")
+	add("2")
+	if items := next(); len(items) != 2 || string(items[1].Data) != "2" {
+		t.Errorf("Expected events 1 and 2, got %v", items)
+	}
+
+	// The rest once the interval is up
+	add("3")
+	if items := next(); len(items) != 1 || string(items[0].Data) != "3" {
+		t.Errorf("Expected event 3, got %v", items)
+	}
+
+	// Or when flushed
+	add("4")
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if items := next(); len(items) != 1 || string(items[0].Data) != "4" {
+		t.Errorf("Expected event 4, got %v", items)
+	}
+
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Failed to flush nothing: %v", err)
+	}
+	select {
+	case items := <-batches:
+		t.Errorf("Expected no more batches, got %v", items)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStreamURL(t *testing.T) {
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL)
+	for _, name := range []string{"telemetry", "eyes:#", "notes/a b?#%", "eyes/*"} {
+		if err := c.Publish(name, []byte("x"), "text/plain"); err != nil {
+			t.Fatalf("Failed to publish to %q: %v", name, err)
+		}
+		if path := <-paths; path != "/v1/stream/"+name {
+			t.Errorf("Expected the server to see stream %q, got path %q", name, path)
+		}
+	}
+}
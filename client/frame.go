@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const framesContentType = "application/vnd.yakapi.frames"
+
+// maxFrameSize guards against allocating for a corrupt length.
+const maxFrameSize = 256 << 20
+
+// readFrame reads one length-prefixed event: a uint32 length and the JSON
+// envelope without its data, then a uint32 length and the data. io.EOF is only
+// returned between frames.
+func readFrame(r *bufio.Reader, e *Event) error {
+	meta, err := readChunk(r)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(meta, e)
+	if err != nil {
+		return fmt.Errorf("invalid frame metadata: %v", err)
+	}
+
+	data, err := readChunk(r)
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	e.Data = data
+
+	return nil
+}
+
+func readChunk(r *bufio.Reader) ([]byte, error) {
+	var size [4]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d bytes", n)
+	}
+
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	if errors.Is(err, io.EOF) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, err
+}
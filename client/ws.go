@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrClosed is returned by Conn methods once the connection has closed.
+var ErrClosed = errors.New("connection closed")
+
+// closeTimeout is how long Close waits for the server to answer its close
+// message before giving up on it.
+const closeTimeout = time.Second
+
+// subscriptionBuffer is how far a subscriber may fall behind before it holds
+// up everything else arriving on the connection, including acks.
+const subscriptionBuffer = 64
+
+// wsRequest and wsResponse mirror the server's WebSocket protocol.
+type wsRequest struct {
+	Type        string `json:"type"`
+	ID          string `json:"id,omitempty"`
+	Stream      string `json:"stream"`
+	ContentType string `json:"content_type,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+type wsResponse struct {
+	Type         string `json:"type"`
+	ID           string `json:"id,omitempty"`
+	EventID      string `json:"event_id,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	Event        *Event `json:"event,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Conn is a WebSocket connection to the server, over which any number of
+// streams can be published to and subscribed to without a request each.
+type Conn struct {
+	conn *websocket.Conn
+
+	// writeMu serializes writes to the connection
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]chan wsResponse
+	subs    map[string]*wsSubscription
+	err     error
+
+	done chan struct{}
+}
+
+type wsSubscription struct {
+	ch chan Event
+
+	// stopping is closed by Unsubscribe so delivery doesn't block on a
+	// subscriber that has stopped reading.
+	stopping chan struct{}
+	stopOnce sync.Once
+}
+
+func (sub *wsSubscription) stop() {
+	sub.stopOnce.Do(func() { close(sub.stopping) })
+}
+
+// Dial opens a WebSocket connection to the server.
+func (c *Client) Dial(ctx context.Context) (*Conn, error) {
+	url := strings.TrimSuffix(c.BaseURL, "/") + "/v1/ws"
+	if rest, ok := strings.CutPrefix(url, "http"); ok {
+		url = "ws" + rest
+	}
+
+	header := http.Header{}
+	if c.Publisher != "" {
+		header.Set("X-Yakapi-Publisher", c.Publisher)
+	}
+
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %s: %v", url, err)
+	}
+
+	conn := &Conn{
+		conn:    ws,
+		pending: make(map[string]chan wsResponse),
+		subs:    make(map[string]*wsSubscription),
+		done:    make(chan struct{}),
+	}
+	go conn.read()
+
+	return conn, nil
+}
+
+// read dispatches responses until the connection fails, then closes every
+// subscription.
+func (c *Conn) read() {
+	var err error
+	for {
+		var resp wsResponse
+		err = c.conn.ReadJSON(&resp)
+		if err != nil {
+			break
+		}
+
+		switch {
+		case resp.Type == "event" && resp.Event != nil:
+			c.mu.Lock()
+			sub, ok := c.subs[resp.Subscription]
+			c.mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			if resp.Event.StreamName == "" {
+				resp.Event.StreamName = resp.Subscription
+			}
+			select {
+			case sub.ch <- *resp.Event:
+			case <-sub.stopping:
+			}
+		case resp.ID != "":
+			c.mu.Lock()
+			ch, ok := c.pending[resp.ID]
+			delete(c.pending, resp.ID)
+			c.mu.Unlock()
+			if ok {
+				ch <- resp
+			}
+		case resp.Type == "error" && resp.Subscription != "":
+			// The server ended the subscription
+			c.mu.Lock()
+			if sub, ok := c.subs[resp.Subscription]; ok {
+				delete(c.subs, resp.Subscription)
+				close(sub.ch)
+			}
+			c.mu.Unlock()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		err = ErrClosed
+	}
+	c.err = err
+	for _, sub := range c.subs {
+		close(sub.ch)
+	}
+	c.subs = nil
+	close(c.done)
+}
+
+// do sends a request and waits for its ack or error.
+func (c *Conn) do(ctx context.Context, req wsRequest) (wsResponse, error) {
+	ch := make(chan wsResponse, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return wsResponse{}, c.err
+	}
+	c.nextID++
+	req.ID = strconv.Itoa(c.nextID)
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+	}()
+
+	c.writeMu.Lock()
+	err := c.conn.WriteJSON(req)
+	c.writeMu.Unlock()
+	if err != nil {
+		return wsResponse{}, fmt.Errorf("error sending %s: %v", req.Type, err)
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Type == "error" {
+			return resp, errors.New(resp.Error)
+		}
+		return resp, nil
+	case <-c.done:
+		return wsResponse{}, c.err
+	case <-ctx.Done():
+		return wsResponse{}, ctx.Err()
+	}
+}
+
+// Publish publishes an event and waits for the server to accept it,
+// returning the event's ID.
+func (c *Conn) Publish(ctx context.Context, streamName string, b []byte, contentType string) (string, error) {
+	resp, err := c.do(ctx, wsRequest{
+		Type:        "publish",
+		Stream:      streamName,
+		ContentType: contentType,
+		Data:        b,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// Subscribe subscribes to a stream, or pattern of streams. The channel is
+// closed when the subscription or connection ends. It must be kept drained,
+// as a subscriber that falls behind holds up the whole connection.
+func (c *Conn) Subscribe(ctx context.Context, streamName string) (<-chan Event, error) {
+	sub := &wsSubscription{
+		ch:       make(chan Event, subscriptionBuffer),
+		stopping: make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	if _, ok := c.subs[streamName]; ok {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("already subscribed to %q", streamName)
+	}
+	if c.subs != nil {
+		c.subs[streamName] = sub
+	}
+	c.mu.Unlock()
+
+	_, err := c.do(ctx, wsRequest{Type: "subscribe", Stream: streamName})
+	if err != nil {
+		c.mu.Lock()
+		if c.subs[streamName] == sub {
+			delete(c.subs, streamName)
+		}
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	return sub.ch, nil
+}
+
+// Unsubscribe ends a subscription, closing its channel. Events still in
+// flight are discarded.
+func (c *Conn) Unsubscribe(ctx context.Context, streamName string) error {
+	c.mu.Lock()
+	sub, ok := c.subs[streamName]
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not subscribed to %q", streamName)
+	}
+	sub.stop()
+
+	_, err := c.do(ctx, wsRequest{Type: "unsubscribe", Stream: streamName})
+	if err != nil {
+		return err
+	}
+
+	// The server sends nothing more for the subscription after its ack, so
+	// the reader is done with the channel.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs[streamName] == sub {
+		delete(c.subs, streamName)
+		close(sub.ch)
+	}
+
+	return nil
+}
+
+// Close closes the connection, waiting a little for the server to answer its
+// close message, but no more, as it may never do so.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	for _, sub := range c.subs {
+		sub.stop()
+	}
+	c.mu.Unlock()
+
+	err := c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(closeTimeout))
+	if err != nil {
+		return c.conn.Close()
+	}
+
+	t := time.NewTimer(closeTimeout)
+	defer t.Stop()
+	select {
+	case <-c.done:
+	case <-t.C:
+	}
+	return c.conn.Close()
+}
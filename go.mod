@@ -9,6 +9,7 @@ require (
 	github.com/spf13/cobra v1.8.1
 	github.com/stretchr/testify v1.9.0
 	gitlab.com/greyxor/slogor v1.2.8
+	gopkg.in/yaml.v3 v3.0.1
 	tailscale.com v1.72.1
 )
 
@@ -47,5 +48,4 @@ require (
 	golang.org/x/text v0.18.0 // indirect
 	golang.zx2c4.com/wireguard/windows v0.5.3 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,419 @@
+// Package bag stores recorded events in a single file, indexed by when they
+// were recorded so a time range can be read without scanning the whole file.
+package bag
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rhettg/yakapi/client"
+)
+
+// A bag file is laid out as:
+//
+//	magic
+//	records, each:
+//	  uint32 body length
+//	  uint32 crc32 of body
+//	  body: int64 recorded unix nanoseconds, uint32 metadata length,
+//	        metadata JSON, data
+//	index entries, each: int64 recorded unix nanoseconds, int64 file offset
+//	trailer: int64 first and int64 last recorded unix nanoseconds,
+//	         uint64 record count, uint64 index offset, trailer magic
+//
+// The index and trailer are written on Close. A bag that was never closed,
+// such as when the recorder crashed, is read by scanning its records instead,
+// ignoring any partial record at the end.
+const (
+	magic        = "YAKBAG1\n"
+	trailerMagic = "YAKBAGIX"
+
+	recordHeaderSize = 8
+	indexEntrySize   = 16
+	trailerSize      = 32 + len(trailerMagic)
+
+	// indexEvery and indexSpan bound how many records, and how much time,
+	// may pass between index entries.
+	indexEvery = 1000
+	indexSpan  = time.Second
+
+	// maxRecordSize guards against allocating for a corrupt length.
+	maxRecordSize = 256 << 20
+)
+
+var (
+	ErrNotBag         = errors.New("not a bag file")
+	errCorruptRecord  = errors.New("corrupt record")
+	errCorruptTrailer = errors.New("corrupt index")
+)
+
+// Record is an event as it was recorded.
+type Record struct {
+	// Time is when the event was recorded, which orders the bag.
+	Time  time.Time
+	Event client.Event
+}
+
+type indexEntry struct {
+	time   int64
+	offset int64
+}
+
+// addIndex adds an entry for the record at offset, if enough records or time
+// have passed since the last.
+func addIndex(index []indexEntry, count uint64, ns, offset int64) []indexEntry {
+	if len(index) == 0 || count%indexEvery == 0 || ns-index[len(index)-1].time >= int64(indexSpan) {
+		index = append(index, indexEntry{time: ns, offset: offset})
+	}
+	return index
+}
+
+// Writer records events to a bag file.
+type Writer struct {
+	f      *os.File
+	w      *bufio.Writer
+	offset int64
+
+	first, last int64
+	count       uint64
+	index       []indexEntry
+}
+
+// Create creates a bag file, truncating it if it exists.
+func Create(path string) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{f: f, w: bufio.NewWriter(f)}
+	_, err = w.w.WriteString(magic)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.offset = int64(len(magic))
+
+	return w, nil
+}
+
+// Write records an event at time t. Records keep the order they're written
+// in, so a t earlier than the last record's is taken as the same time.
+func (w *Writer) Write(t time.Time, e client.Event) error {
+	ns := max(t.UnixNano(), w.last)
+
+	if w.count == 0 {
+		w.first = ns
+	}
+	w.index = addIndex(w.index, w.count, ns, w.offset)
+
+	record, err := encodeRecord(ns, e)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(record)
+	if err != nil {
+		return err
+	}
+
+	w.offset += int64(len(record))
+	w.last = ns
+	w.count++
+
+	return nil
+}
+
+// Flush writes buffered records to the file, so they survive the recorder
+// crashing.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Close writes the index and closes the file.
+func (w *Writer) Close() error {
+	b := make([]byte, 0, len(w.index)*indexEntrySize+trailerSize)
+	for _, entry := range w.index {
+		b = binary.BigEndian.AppendUint64(b, uint64(entry.time))
+		b = binary.BigEndian.AppendUint64(b, uint64(entry.offset))
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(w.first))
+	b = binary.BigEndian.AppendUint64(b, uint64(w.last))
+	b = binary.BigEndian.AppendUint64(b, w.count)
+	b = binary.BigEndian.AppendUint64(b, uint64(w.offset))
+	b = append(b, trailerMagic...)
+
+	_, err := w.w.Write(b)
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if err != nil {
+		w.f.Close()
+		return err
+	}
+
+	return w.f.Close()
+}
+
+// Reader reads a bag file.
+type Reader struct {
+	f *os.File
+
+	// end is where the records end
+	end int64
+
+	first, last int64
+	count       uint64
+	index       []indexEntry
+}
+
+// Open opens a bag file, reading its index.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{f: f}
+	err = r.open()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Reader) open() error {
+	head := make([]byte, len(magic))
+	_, err := io.ReadFull(r.f, head)
+	if err != nil || string(head) != magic {
+		return ErrNotBag
+	}
+
+	info, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = r.readIndex(info.Size())
+	if err == nil {
+		return nil
+	}
+
+	slog.Warn("bag has no index, scanning it", "path", r.f.Name(), "error", err)
+	return r.scan()
+}
+
+func (r *Reader) readIndex(size int64) error {
+	if size < int64(len(magic)+trailerSize) {
+		return errCorruptTrailer
+	}
+
+	trailer := make([]byte, trailerSize)
+	_, err := r.f.ReadAt(trailer, size-int64(trailerSize))
+	if err != nil {
+		return err
+	}
+	if string(trailer[32:]) != trailerMagic {
+		return errCorruptTrailer
+	}
+
+	r.first = int64(binary.BigEndian.Uint64(trailer[0:]))
+	r.last = int64(binary.BigEndian.Uint64(trailer[8:]))
+	r.count = binary.BigEndian.Uint64(trailer[16:])
+	r.end = int64(binary.BigEndian.Uint64(trailer[24:]))
+
+	indexSize := size - int64(trailerSize) - r.end
+	if r.end < int64(len(magic)) || indexSize < 0 || indexSize%indexEntrySize != 0 {
+		return errCorruptTrailer
+	}
+
+	b := make([]byte, indexSize)
+	_, err = r.f.ReadAt(b, r.end)
+	if err != nil {
+		return err
+	}
+
+	r.index = make([]indexEntry, 0, indexSize/indexEntrySize)
+	for i := 0; i < len(b); i += indexEntrySize {
+		r.index = append(r.index, indexEntry{
+			time:   int64(binary.BigEndian.Uint64(b[i:])),
+			offset: int64(binary.BigEndian.Uint64(b[i+8:])),
+		})
+	}
+
+	return nil
+}
+
+// scan reads every record to rebuild the index of a bag that wasn't closed.
+func (r *Reader) scan() error {
+	offset := int64(len(magic))
+	br := bufio.NewReader(io.NewSectionReader(r.f, offset, 1<<62))
+
+	r.index = nil
+	r.count = 0
+	for {
+		ns, _, n, err := readRecord(br)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			slog.Warn("ignoring damaged end of bag", "path", r.f.Name(), "offset", offset, "error", err)
+			break
+		}
+
+		if r.count == 0 {
+			r.first = ns
+		}
+		r.index = addIndex(r.index, r.count, ns, offset)
+		r.last = ns
+		r.count++
+		offset += n
+	}
+
+	r.end = offset
+	return nil
+}
+
+// Start and End are when the first and last events were recorded.
+func (r *Reader) Start() time.Time {
+	return time.Unix(0, r.first)
+}
+
+func (r *Reader) End() time.Time {
+	return time.Unix(0, r.last)
+}
+
+// Count is how many events the bag holds.
+func (r *Reader) Count() uint64 {
+	return r.count
+}
+
+// Read calls fn with each record recorded from from until to, in order.
+// Either may be zero to leave that end open. Reading stops at the first error
+// from fn, which is returned.
+func (r *Reader) Read(from, to time.Time, fn func(Record) error) error {
+	if r.count == 0 {
+		return nil
+	}
+
+	// Start from the last index entry before from
+	start := int64(len(magic))
+	if !from.IsZero() {
+		ns := from.UnixNano()
+		i := sort.Search(len(r.index), func(i int) bool {
+			return r.index[i].time >= ns
+		})
+		if i > 0 {
+			start = r.index[i-1].offset
+		}
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(r.f, start, r.end-start))
+	for {
+		ns, e, _, err := readRecord(br)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		t := time.Unix(0, ns)
+		if !from.IsZero() && t.Before(from) {
+			continue
+		}
+		if !to.IsZero() && t.After(to) {
+			return nil
+		}
+
+		err = fn(Record{Time: t, Event: e})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the file.
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
+
+func encodeRecord(ns int64, e client.Event) ([]byte, error) {
+	data := e.Data
+	e.Data = nil
+
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyLen := 8 + 4 + len(meta) + len(data)
+	b := make([]byte, recordHeaderSize+bodyLen)
+
+	body := b[recordHeaderSize:]
+	binary.BigEndian.PutUint64(body[0:], uint64(ns))
+	binary.BigEndian.PutUint32(body[8:], uint32(len(meta)))
+	copy(body[12:], meta)
+	copy(body[12+len(meta):], data)
+
+	binary.BigEndian.PutUint32(b[0:], uint32(bodyLen))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(body))
+
+	return b, nil
+}
+
+// readRecord decodes the next record, returning when it was recorded, the
+// event, and the number of bytes consumed. io.EOF is only returned at a clean
+// record boundary.
+func readRecord(r io.Reader) (int64, client.Event, int64, error) {
+	var e client.Event
+
+	header := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if errors.Is(err, io.EOF) {
+		return 0, e, 0, io.EOF
+	}
+	if err != nil {
+		return 0, e, 0, errCorruptRecord
+	}
+
+	bodyLen := binary.BigEndian.Uint32(header[0:])
+	if bodyLen < 12 || bodyLen > maxRecordSize {
+		return 0, e, 0, errCorruptRecord
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, e, 0, errCorruptRecord
+	}
+
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, e, 0, errCorruptRecord
+	}
+
+	ns := int64(binary.BigEndian.Uint64(body[0:]))
+	metaLen := binary.BigEndian.Uint32(body[8:])
+	if 12+int64(metaLen) > int64(bodyLen) {
+		return 0, e, 0, errCorruptRecord
+	}
+
+	err = json.Unmarshal(body[12:12+metaLen], &e)
+	if err != nil {
+		return 0, e, 0, fmt.Errorf("%w: %v", errCorruptRecord, err)
+	}
+	e.Data = body[12+metaLen:]
+
+	return ns, e, int64(recordHeaderSize + bodyLen), nil
+}
@@ -0,0 +1,167 @@
+package bag
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rhettg/yakapi/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2024, 9, 28, 17, 0, 0, 0, time.UTC)
+
+// record writes n events, one every 100ms, alternating between the telemetry
+// and eyes:front streams.
+func record(t *testing.T, n int, closed bool) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "mission.bag")
+	w, err := Create(path)
+	require.NoError(t, err)
+
+	for i := 0; i < n; i++ {
+		name := "telemetry"
+		if i%2 == 1 {
+			name = "eyes:front"
+		}
+		e := client.Event{ID: "id", StreamName: name, Time: start, ContentType: "text/plain", Data: []byte{byte(i)}}
+		require.NoError(t, w.Write(start.Add(time.Duration(i)*100*time.Millisecond), e))
+	}
+
+	if closed {
+		require.NoError(t, w.Close())
+	} else {
+		require.NoError(t, w.Flush())
+	}
+	return path
+}
+
+func readAll(t *testing.T, r *Reader, from, to time.Time) []Record {
+	t.Helper()
+
+	var records []Record
+	require.NoError(t, r.Read(from, to, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	}))
+	return records
+}
+
+func TestBag(t *testing.T) {
+	for _, closed := range []bool{true, false} {
+		name := "indexed"
+		if !closed {
+			name = "unclosed"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			r, err := Open(record(t, 2500, closed))
+			require.NoError(t, err)
+			defer r.Close()
+
+			assert.Equal(t, uint64(2500), r.Count())
+			assert.True(t, start.Equal(r.Start()))
+			assert.True(t, start.Add(249900*time.Millisecond).Equal(r.End()))
+
+			records := readAll(t, r, time.Time{}, time.Time{})
+			require.Len(t, records, 2500)
+			assert.Equal(t, "telemetry", records[0].Event.StreamName)
+			assert.Equal(t, "eyes:front", records[1].Event.StreamName)
+			assert.Equal(t, []byte{1}, records[1].Event.Data)
+			assert.True(t, start.Equal(records[1].Event.Time))
+
+			records = readAll(t, r, start.Add(150*time.Second), start.Add(151*time.Second))
+			require.Len(t, records, 11)
+			assert.True(t, start.Add(150*time.Second).Equal(records[0].Time))
+			assert.Equal(t, byte(1500%256), records[0].Event.Data[0])
+		})
+	}
+}
+
+func TestDamaged(t *testing.T) {
+	path := record(t, 10, false)
+
+	// A partial record, as left by a crash mid-write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 40, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	r, err := Open(path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	assert.Equal(t, uint64(10), r.Count())
+	assert.Len(t, readAll(t, r, time.Time{}, time.Time{}), 10)
+
+	require.NoError(t, os.WriteFile(path, []byte("not a bag"), 0o644))
+	_, err = Open(path)
+	assert.ErrorIs(t, err, ErrNotBag)
+}
+
+func TestPlay(t *testing.T) {
+	r, err := Open(record(t, 10, true))
+	require.NoError(t, err)
+	defer r.Close()
+
+	var played []client.Event
+	publish := func(ctx context.Context, e client.Event) error {
+		played = append(played, e)
+		return nil
+	}
+
+	t.Run("max speed", func(t *testing.T) {
+		played = nil
+		n, err := r.Play(context.Background(), PlayOptions{
+			Streams: []string{"eyes:*"},
+			Rename:  map[string]string{"eyes:front": "sim:eyes:front"},
+		}, publish)
+		require.NoError(t, err)
+
+		assert.Equal(t, 5, n)
+		assert.Equal(t, "sim:eyes:front", played[0].StreamName)
+		assert.Equal(t, []byte{1}, played[0].Data)
+	})
+
+	t.Run("scaled", func(t *testing.T) {
+		played = nil
+		began := time.Now()
+		n, err := r.Play(context.Background(), PlayOptions{
+			From:  start.Add(200 * time.Millisecond),
+			To:    start.Add(600 * time.Millisecond),
+			Speed: 4,
+		}, publish)
+		require.NoError(t, err)
+
+		// 400ms recorded, played in 100ms
+		assert.Equal(t, 5, n)
+		assert.Equal(t, []byte{2}, played[0].Data)
+		assert.GreaterOrEqual(t, time.Since(began), 100*time.Millisecond)
+		assert.Less(t, time.Since(began), 400*time.Millisecond)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		n, err := r.Play(ctx, PlayOptions{Speed: 1}, publish)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 1, n)
+	})
+}
+
+func TestParseRenames(t *testing.T) {
+	renames, err := ParseRenames("telemetry=sim:telemetry, ci=sim:ci")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"telemetry": "sim:telemetry", "ci": "sim:ci"}, renames)
+
+	_, err = ParseRenames("telemetry")
+	assert.Error(t, err)
+	_, err = ParseRenames("eyes:front=sim:*")
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package bag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rhettg/yakapi/client"
+	"github.com/rhettg/yakapi/internal/stream"
+)
+
+// PlayOptions selects which recorded events are played back, and how.
+type PlayOptions struct {
+	// From and To select the events recorded between them. Either may be
+	// zero to leave that end open.
+	From, To time.Time
+
+	// Streams selects events by stream name or pattern. Empty means every
+	// stream.
+	Streams []string
+
+	// Rename maps recorded stream names to the names they're played to.
+	Rename map[string]string
+
+	// Speed scales the time between events, so 2 plays twice as fast as
+	// recorded. Zero plays as fast as events can be published.
+	Speed float64
+}
+
+// ParseRenames reads a comma separated list of renames such as
+// "telemetry=sim:telemetry,ci=sim:ci".
+func ParseRenames(s string) (map[string]string, error) {
+	renames := make(map[string]string)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		from, to, ok := strings.Cut(item, "=")
+		if !ok || from == "" || to == "" || stream.IsPattern(to) {
+			return nil, fmt.Errorf("invalid rename: %q", item)
+		}
+		renames[from] = to
+	}
+
+	return renames, nil
+}
+
+func (opts PlayOptions) selects(name string) bool {
+	if len(opts.Streams) == 0 {
+		return true
+	}
+	for _, s := range opts.Streams {
+		if s == name || stream.Match(s, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Play publishes the selected events, keeping the time between them as
+// recorded, scaled by the speed. Each event's stream is renamed before
+// publish is called with it. It returns how many events were published.
+func (r *Reader) Play(ctx context.Context, opts PlayOptions, publish func(context.Context, client.Event) error) (int, error) {
+	if opts.Speed < 0 {
+		return 0, fmt.Errorf("invalid speed: %v", opts.Speed)
+	}
+
+	var first time.Time
+	var start time.Time
+	played := 0
+
+	err := r.Read(opts.From, opts.To, func(rec Record) error {
+		if !opts.selects(rec.Event.StreamName) {
+			return nil
+		}
+
+		if first.IsZero() {
+			first = rec.Time
+			start = time.Now()
+		}
+
+		if opts.Speed > 0 {
+			offset := time.Duration(float64(rec.Time.Sub(first)) / opts.Speed)
+			wait := time.Until(start.Add(offset))
+			if wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+					return ctx.Err()
+				}
+			}
+		}
+
+		e := rec.Event
+		if name, ok := opts.Rename[e.StreamName]; ok {
+			e.StreamName = name
+		}
+
+		err := publish(ctx, e)
+		if err != nil {
+			return fmt.Errorf("publishing to %s: %w", e.StreamName, err)
+		}
+		played++
+		return nil
+	})
+
+	return played, err
+}
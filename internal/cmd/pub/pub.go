@@ -2,6 +2,7 @@ package pub
 
 import (
 	"bufio"
+	"context"
 	"log/slog"
 	"os"
 
@@ -9,8 +10,16 @@ import (
 )
 
 func DoPub(serverURL string, stream string) error {
+	ctx := context.Background()
 	c := client.NewClient(serverURL)
 
+	// One connection for every line, rather than a request each
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -18,7 +27,7 @@ func DoPub(serverURL string, stream string) error {
 			continue
 		}
 
-		err := c.Publish(stream, []byte(line), "text/plain")
+		_, err := conn.Publish(ctx, stream, []byte(line), "text/plain")
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,106 @@
+package record
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rhettg/yakapi/client"
+	"github.com/rhettg/yakapi/internal/bag"
+)
+
+// flushInterval is how often recorded events are written out, bounding what
+// a crash loses.
+const flushInterval = time.Second
+
+// DoRecord records events from the streams to a bag file at path, until
+// interrupted or, if it's set, the duration has passed.
+func DoRecord(serverURL, path string, streams []string, duration time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	w, err := bag.Create(path)
+	if err != nil {
+		return err
+	}
+
+	c := client.NewClient(serverURL)
+	events := make(chan client.Event)
+	for _, name := range streams {
+		go subscribe(ctx, c, name, events)
+	}
+
+	slog.Info("recording", "path", path, "streams", streams)
+
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+
+	var count int
+	for {
+		select {
+		case e := <-events:
+			err := w.Write(time.Now(), e)
+			if err != nil {
+				w.Close()
+				return err
+			}
+			count++
+		case <-t.C:
+			err := w.Flush()
+			if err != nil {
+				w.Close()
+				return err
+			}
+		case <-ctx.Done():
+			slog.Info("finished recording", "path", path, "events", count)
+			return w.Close()
+		}
+	}
+}
+
+// subscribe sends a stream's events until ctx is done, resuming after the
+// last event received whenever the subscription ends.
+func subscribe(ctx context.Context, c *client.Client, name string, events chan<- client.Event) {
+	var last string
+	received := make(chan client.Event)
+
+	for {
+		done := make(chan error, 1)
+		go func() {
+			done <- c.SubscribeSince(ctx, name, last, received)
+		}()
+
+	forward:
+		for {
+			select {
+			case e := <-received:
+				last = e.ID
+				select {
+				case events <- e:
+				case <-ctx.Done():
+				}
+			case err := <-done:
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Warn("subscription ended, resubscribing", "stream", name, "error", err)
+				break forward
+			}
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/rhettg/yakapi/client"
+	"github.com/rhettg/yakapi/internal/bag"
+)
+
+// Options are the replay command's flags.
+type Options struct {
+	// Speed is a multiple of the recorded speed, or "max".
+	Speed string
+
+	// From and To are offsets from the start of the recording, such as
+	// "90s", or times.
+	From, To string
+
+	// Rename is a comma separated list of old=new stream names.
+	Rename string
+}
+
+// DoReplay publishes the events recorded in the bag file at path, from the
+// streams selected, or every stream if there are none.
+func DoReplay(serverURL, path string, streams []string, opts Options) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	r, err := bag.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	playOpts := bag.PlayOptions{Streams: streams}
+
+	if opts.Speed != "max" {
+		playOpts.Speed, err = strconv.ParseFloat(opts.Speed, 64)
+		if err != nil || playOpts.Speed <= 0 {
+			return fmt.Errorf("invalid speed: %q", opts.Speed)
+		}
+	}
+
+	playOpts.From, err = parseTime(opts.From, r.Start())
+	if err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	playOpts.To, err = parseTime(opts.To, r.Start())
+	if err != nil {
+		return fmt.Errorf("invalid to: %w", err)
+	}
+
+	playOpts.Rename, err = bag.ParseRenames(opts.Rename)
+	if err != nil {
+		return err
+	}
+
+	c := client.NewClient(serverURL)
+	c.Publisher = "replay"
+
+	// One connection for every event, rather than a request each
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	slog.Info("replaying", "path", path, "events", r.Count(), "recorded", r.End().Sub(r.Start()).Round(time.Millisecond))
+
+	n, err := r.Play(ctx, playOpts, func(ctx context.Context, e client.Event) error {
+		_, err := conn.Publish(ctx, e.StreamName, e.Data, e.ContentType)
+		return err
+	})
+	if ctx.Err() != nil {
+		slog.Info("replay interrupted", "events", n)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("finished replaying", "events", n)
+	return nil
+}
+
+// parseTime reads a time, or an offset from the start of the recording. Empty
+// is the zero time.
+func parseTime(s string, start time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return start.Add(d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/rhettg/yakapi/internal/stream"
+)
+
+// checkAckOptions rejects subscription options that don't make sense for
+// acked delivery.
+func checkAckOptions(streamName string, opts stream.OutOptions) error {
+	if stream.IsPattern(streamName) {
+		return errors.New("acked delivery can't subscribe to a stream pattern")
+	}
+
+	// Events left out would never be acked, so would keep coming back
+	if !opts.Filter.IsZero() || !opts.Sample.IsZero() {
+		return errors.New("acked delivery can't be filtered or sampled")
+	}
+
+	// Only these carry the delivery tag
+	if opts.Format != stream.FormatJSON && opts.Format != stream.FormatFramed {
+		return fmt.Errorf("acked delivery needs the %s or %s format", stream.FormatJSON, stream.FormatFramed)
+	}
+
+	return nil
+}
+
+// handleStreamSettle acks or nacks acked deliveries by their tags.
+func handleStreamSettle(w http.ResponseWriter, r *http.Request, streamName, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		errorResponse(w, fmt.Errorf("invalid request: %w", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Tags) == 0 {
+		errorResponse(w, errors.New("tags are required"), http.StatusBadRequest)
+		return
+	}
+
+	var unknown []string
+	if action == "ack" {
+		unknown = broker.Ack(streamName, req.Tags...)
+	} else {
+		unknown = broker.Nack(streamName, req.Tags...)
+	}
+
+	resp := struct {
+		Error   string   `json:"error,omitempty"`
+		Unknown []string `json:"unknown,omitempty"`
+	}{Unknown: unknown}
+
+	status := http.StatusOK
+	if len(unknown) > 0 {
+		// The rest were still settled
+		slog.Warn("unknown delivery tags", "stream", streamName, "action", action, "tags", unknown)
+		resp.Error = "unknown delivery tags, already settled or timed out"
+		status = http.StatusConflict
+	}
+
+	err = sendResponse(w, resp, status)
+	if err != nil {
+		slog.Error("error sending response", "error", err)
+	}
+}
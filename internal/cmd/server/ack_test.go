@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rhettg/yakapi/client"
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAckedSubscription(t *testing.T) {
+	sm := stream.NewManager()
+	useBroker(t, sm)
+	require.NoError(t, sm.DeclareQueue("ci", stream.DefaultGroup, stream.AckOptions{}))
+
+	server := httptest.NewServer(http.HandlerFunc(handleStream))
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	c := client.NewClient(server.URL)
+	require.NoError(t, c.Publish("ci", []byte(`{"cmd": "fwd"}`), "application/json"))
+	require.NoError(t, c.Publish("ci", []byte(`{"cmd": "stop"}`), "application/json"))
+
+	events, err := c.SubscribeAcked("ci", "")
+	require.NoError(t, err)
+
+	e := receiveEvent(t, events)
+	assert.JSONEq(t, `{"cmd": "fwd"}`, string(e.Data))
+	assert.Equal(t, 1, e.Attempt)
+	require.NoError(t, c.Nack(e))
+
+	e = receiveEvent(t, events)
+	assert.JSONEq(t, `{"cmd": "fwd"}`, string(e.Data))
+	assert.Equal(t, 2, e.Attempt)
+	require.NoError(t, c.Ack(e))
+	assert.ErrorIs(t, c.Ack(e), client.ErrUnknownTag)
+
+	e = receiveEvent(t, events)
+	assert.JSONEq(t, `{"cmd": "stop"}`, string(e.Data))
+	require.NoError(t, c.Ack(e))
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, url := range []string{
+			"/v1/stream/ci:*?ack=true&format=json",
+			"/v1/stream/ci?ack=true&format=raw",
+			"/v1/stream/ci?ack=true&format=json&filter=cmd",
+		} {
+			rr := httptest.NewRecorder()
+			handleStream(rr, httptest.NewRequest(http.MethodGet, url, nil))
+			assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+		}
+
+		rr := httptest.NewRecorder()
+		handleStream(rr, httptest.NewRequest(http.MethodPost, "/v1/stream/ci/ack", strings.NewReader(`{"tags": []}`)))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/rhettg/yakapi/internal/stream"
+)
+
+const (
+	maxBatchEvents = 1000
+	maxBatchBytes  = 16 << 20
+)
+
+// batchItem is one event in a batch publish. The payload is either base64
+// encoded in Data, or any JSON value in JSON, which implies application/json.
+type batchItem struct {
+	Stream      string          `json:"stream"`
+	ContentType string          `json:"content_type"`
+	Time        time.Time       `json:"time"`
+	Data        []byte          `json:"data"`
+	JSON        json.RawMessage `json:"json"`
+	TTL         string          `json:"ttl"`
+}
+
+type batchResult struct {
+	Stream string `json:"stream,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// decodeBatch reads either a JSON array of items or a sequence of them, one
+// per line.
+func decodeBatch(r io.Reader) ([]batchItem, error) {
+	br := bufio.NewReader(r)
+
+	// Peek past leading whitespace to tell an array from a sequence
+	var first byte
+	for {
+		b, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		first = b
+		break
+	}
+	br.UnreadByte()
+
+	d := json.NewDecoder(br)
+	if first == '[' {
+		var items []batchItem
+		err := d.Decode(&items)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := d.Token(); !errors.Is(err, io.EOF) {
+			return nil, errors.New("unexpected data after array")
+		}
+		return items, nil
+	}
+
+	var items []batchItem
+	for {
+		var item batchItem
+		err := d.Decode(&item)
+		if errors.Is(err, io.EOF) {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+func (item batchItem) event(defaultStream string) (stream.Event, error) {
+	name := item.Stream
+	if name == "" {
+		name = defaultStream
+	}
+	if name == "" {
+		return stream.Event{}, errors.New("stream is required")
+	}
+	if stream.IsPattern(name) {
+		return stream.Event{}, errors.New("cannot publish to a stream pattern")
+	}
+	if _, action := cutStreamAction(name); action != "" {
+		return stream.Event{}, fmt.Errorf("stream name can't end in /%s", action)
+	}
+
+	e := stream.NewEvent(item.ContentType, item.Data)
+	if item.JSON != nil {
+		if item.Data != nil {
+			return stream.Event{}, errors.New("only one of data and json may be given")
+		}
+		e.Data = item.JSON
+		if e.ContentType == "" {
+			e.ContentType = "application/json"
+		}
+	}
+	if !item.Time.IsZero() {
+		e.Time = item.Time
+	}
+	if item.TTL != "" {
+		ttl, err := stream.ParseTTL(item.TTL)
+		if err != nil {
+			return stream.Event{}, err
+		}
+		e.SetTTL(ttl)
+	}
+	e.Stream = name
+
+	return e, nil
+}
+
+// handleBatch publishes many events in one request, in order. A single invalid
+// event rejects the whole batch.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	items, err := decodeBatch(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil {
+		errorResponse(w, fmt.Errorf("invalid batch: %w", err), http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchEvents {
+		errorResponse(w, fmt.Errorf("batch of %d events exceeds limit of %d", len(items), maxBatchEvents), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp := struct {
+		Error   string        `json:"error,omitempty"`
+		Results []batchResult `json:"results"`
+	}{Results: make([]batchResult, len(items))}
+
+	events := make([]stream.Event, len(items))
+	failed := 0
+	for i, item := range items {
+		e, err := item.event(r.URL.Query().Get("stream"))
+		if err != nil {
+			resp.Results[i] = batchResult{Stream: item.Stream, Error: err.Error()}
+			failed++
+			continue
+		}
+
+		e.Publisher = publisher(r)
+		events[i] = e
+		resp.Results[i] = batchResult{Stream: e.Stream, ID: e.ID.String()}
+	}
+
+	if failed > 0 {
+		resp.Error = fmt.Sprintf("%d invalid events, none were published", failed)
+		err = sendResponse(w, resp, http.StatusBadRequest)
+		if err != nil {
+			slog.Error("error sending response", "error", err)
+		}
+		return
+	}
+
+	err = broker.PublishBatch(r.Context(), events)
+	var invalid stream.ValidationErrors
+	if errors.As(err, &invalid) {
+		for _, verr := range invalid {
+			resp.Results[verr.Index].ID = ""
+			resp.Results[verr.Index].Error = verr.Err.Error()
+		}
+		resp.Error = fmt.Sprintf("%d events don't match their schema, none were published", len(invalid))
+		err = sendResponse(w, resp, http.StatusUnprocessableEntity)
+		if err != nil {
+			slog.Error("error sending response", "error", err)
+		}
+		return
+	}
+	if err != nil {
+		slog.Warn("batch publish failed", "events", len(events), "error", err)
+		for i := range resp.Results {
+			resp.Results[i].ID = ""
+			resp.Results[i].Error = "not published"
+		}
+		resp.Error = "error streaming in, none were published"
+		code := http.StatusInternalServerError
+		if errors.Is(err, stream.ErrClosed) {
+			resp.Error = "shutting down, none were published"
+			code = http.StatusServiceUnavailable
+		}
+		err = sendResponse(w, resp, code)
+		if err != nil {
+			slog.Error("error sending response", "error", err)
+		}
+		return
+	}
+
+	slog.Debug("batch published", "events", len(events))
+	err = sendResponse(w, resp, http.StatusOK)
+	if err != nil {
+		slog.Error("error sending response", "error", err)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rhettg/yakapi/client"
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchHandler(t *testing.T) {
+	sm := stream.NewManager()
+	useBroker(t, sm)
+
+	r := sm.GetReader("gps:*", stream.ReaderOptions{BufferSize: 16})
+	defer sm.ReturnReader("gps:*", r)
+
+	next := func() stream.Event {
+		t.Helper()
+		select {
+		case e := <-r.C:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+			return stream.Event{}
+		}
+	}
+
+	t.Run("ndjson", func(t *testing.T) {
+		body := `{"json": {"lat": 1}}
+{"stream": "gps:fix", "content_type": "text/plain", "data": "M0Q=", "time": "2024-09-28T17:02:11Z"}
+`
+		rr := httptest.NewRecorder()
+		handleBatch(rr, httptest.NewRequest(http.MethodPost, "/v1/batch?stream=gps:position", strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		var resp struct {
+			Results []batchResult `json:"results"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		require.Len(t, resp.Results, 2)
+
+		e := next()
+		assert.Equal(t, "gps:position", e.Stream)
+		assert.Equal(t, "application/json", e.ContentType)
+		assert.JSONEq(t, `{"lat": 1}`, string(e.Data))
+		assert.Equal(t, resp.Results[0].ID, e.ID.String())
+
+		e = next()
+		assert.Equal(t, "gps:fix", e.Stream)
+		assert.Equal(t, "3D", string(e.Data))
+		assert.Equal(t, 2024, e.Time.Year())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		body := `[{"stream": "gps:a", "data": "MQ=="}, {"data": "Mg=="}]`
+		rr := httptest.NewRecorder()
+		handleBatch(rr, httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(body)))
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+
+		var resp struct {
+			Results []batchResult `json:"results"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		assert.Empty(t, resp.Results[0].Error)
+		assert.Equal(t, "stream is required", resp.Results[1].Error)
+		assert.Len(t, r.C, 0, "nothing published")
+	})
+
+	t.Run("reserved name", func(t *testing.T) {
+		body := `[{"stream": "gps/history", "data": "MQ=="}]`
+		rr := httptest.NewRecorder()
+		handleBatch(rr, httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), "stream name can't end in /history")
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		body := `[{"stream": "gps:a", "data": "MQ=="}] {"stream": "gps:b"}`
+		rr := httptest.NewRecorder()
+		handleBatch(rr, httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), "unexpected data after array")
+		assert.Len(t, r.C, 0, "nothing published")
+	})
+
+	t.Run("client", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(handleBatch))
+		defer server.Close()
+
+		c := client.NewClient(server.URL)
+		c.BaseURL = server.URL
+		ids, err := c.PublishBatch([]client.Event{
+			{StreamName: "gps:a", ContentType: "text/plain", Data: []byte("1")},
+			{StreamName: "gps:b", ContentType: "text/plain", Data: []byte("2")},
+			{StreamName: "gps:a", ContentType: "text/plain", Data: []byte("3")},
+		})
+		require.NoError(t, err)
+		require.Len(t, ids, 3)
+
+		for i, want := range []string{"1", "2", "3"} {
+			e := next()
+			assert.Equal(t, want, string(e.Data))
+			assert.Equal(t, ids[i], e.ID.String())
+		}
+
+		_, err = c.PublishBatch([]client.Event{{StreamName: "gps:a"}, {StreamName: "gps:*"}})
+		var berr *client.BatchError
+		require.ErrorAs(t, err, &berr)
+		assert.Equal(t, http.StatusBadRequest, berr.StatusCode)
+		assert.Len(t, berr.Invalid, 1)
+		assert.Contains(t, berr.Invalid, 1)
+	})
+}
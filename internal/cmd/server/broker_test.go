@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useBroker has the handlers use b until the test ends.
+func useBroker(t *testing.T, b stream.Broker) {
+	old := broker
+	broker = b
+	t.Cleanup(func() { broker = old })
+}
+
+// fakeBroker records what's published to it, failing with err if set. It
+// has no streams to subscribe to, so readers are closed straight away.
+type fakeBroker struct {
+	published []stream.Event
+	err       error
+}
+
+var _ stream.Broker = (*fakeBroker)(nil)
+
+func (b *fakeBroker) Publish(ctx context.Context, name string, e stream.Event) error {
+	if b.err != nil {
+		return b.err
+	}
+	e.Stream = name
+	b.published = append(b.published, e)
+	return nil
+}
+
+func (b *fakeBroker) PublishBatch(ctx context.Context, events []stream.Event) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.published = append(b.published, events...)
+	return nil
+}
+
+func (b *fakeBroker) GetReader(name string, opts stream.ReaderOptions) *stream.Reader {
+	r := stream.NewReader(opts.BufferSize)
+	r.Close()
+	return r
+}
+
+func (b *fakeBroker) ReturnReader(name string, r *stream.Reader) {
+	r.Close()
+}
+
+func (b *fakeBroker) Streams() []stream.StreamInfo {
+	infos := make([]stream.StreamInfo, 0, len(b.published))
+	for _, e := range b.published {
+		infos = append(infos, stream.StreamInfo{Name: e.Stream, Published: 1})
+	}
+	return infos
+}
+
+func (b *fakeBroker) Stream(name string) (stream.StreamInfo, bool) {
+	for _, info := range b.Streams() {
+		if info.Name == name {
+			return info, true
+		}
+	}
+	return stream.StreamInfo{}, false
+}
+
+func (b *fakeBroker) Latest(name string) (stream.Event, bool) {
+	return stream.Event{}, false
+}
+
+func (b *fakeBroker) History(name string, offset uint64, limit int) (stream.HistoryPage, error) {
+	return stream.HistoryPage{}, stream.ErrNoLog
+}
+
+func (b *fakeBroker) Ack(name string, tags ...string) []string  { return tags }
+func (b *fakeBroker) Nack(name string, tags ...string) []string { return tags }
+
+func (b *fakeBroker) SetSchema(name string, reg stream.Registration) {}
+
+func (b *fakeBroker) Schemas() map[string]stream.Registration {
+	return nil
+}
+
+func (b *fakeBroker) Close(ctx context.Context) error {
+	b.err = stream.ErrClosed
+	return nil
+}
+
+func TestHandlersWithFakeBroker(t *testing.T) {
+	fake := &fakeBroker{}
+	useBroker(t, fake)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/stream/ci", strings.NewReader("FWD 100"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Yakapi-Publisher", "operator")
+	req.Header.Set("X-Yakapi-Ttl", "30s")
+	rr := httptest.NewRecorder()
+	handleStream(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	require.Len(t, fake.published, 1)
+	e := fake.published[0]
+	assert.Equal(t, "ci", e.Stream)
+	assert.Equal(t, "FWD 100", string(e.Data))
+	assert.Equal(t, "text/plain", e.ContentType)
+	assert.Equal(t, "operator", e.Publisher)
+	assert.NotNil(t, e.Expires)
+
+	t.Run("list", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleStreams(rr, httptest.NewRequest(http.MethodGet, "/v1/streams", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var got struct {
+			Streams []stream.StreamInfo `json:"streams"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+		require.Len(t, got.Streams, 1)
+		assert.Equal(t, "ci", got.Streams[0].Name)
+	})
+
+	t.Run("publish fails", func(t *testing.T) {
+		fake.err = errors.New("backend down")
+
+		rr := httptest.NewRecorder()
+		handleStream(rr, httptest.NewRequest(http.MethodPost, "/v1/stream/ci", strings.NewReader("STOP")))
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		assert.Len(t, fake.published, 1)
+	})
+}
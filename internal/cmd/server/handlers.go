@@ -9,11 +9,13 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/rhettg/yakapi/internal/config"
 	"github.com/rhettg/yakapi/internal/gds"
 	"github.com/rhettg/yakapi/internal/stream"
 	"github.com/rhettg/yakapi/internal/telemetry"
@@ -22,8 +24,13 @@ import (
 
 var (
 	//go:embed assets/*
-	assets        embed.FS
-	streamManager *stream.Manager
+	assets embed.FS
+
+	// broker carries events between the server's publishers and subscribers
+	broker stream.Broker
+
+	// conf is the server's configuration
+	conf = config.Default()
 )
 
 type resource struct {
@@ -100,7 +107,7 @@ func me(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func doGDSCI(ctx context.Context, c *gds.Client, sm *stream.Manager) error {
+func doGDSCI(ctx context.Context, c *gds.Client, b stream.Broker) error {
 	startTime := time.Now()
 
 	slog.Info("retrieving commands from GDS")
@@ -110,19 +117,24 @@ func doGDSCI(ctx context.Context, c *gds.Client, sm *stream.Manager) error {
 		return fmt.Errorf("failed to retreive notes: %w", err)
 	}
 
-	s := sm.GetWriter("ci")
-	defer sm.ReturnWriter("ci")
-
 	for _, n := range notes {
 		slog.Info("processing note", "file", n.File, "note", n.Note, "created_at", n.CreatedAt)
 		if n.File != "commands.qi" {
 			continue
 		}
 
-		select {
-		case s <- n.Body:
-		case <-ctx.Done():
-			return ctx.Err()
+		e := stream.NewEvent("application/json", n.Body)
+		e.Publisher = "gds"
+
+		err := b.Publish(ctx, "ci", e)
+		var verr *stream.ValidationError
+		if errors.As(err, &verr) {
+			// Skipped so it doesn't hold up the notes after it
+			slog.Warn("skipping invalid note", "file", n.File, "created_at", n.CreatedAt, "error", err)
+			continue
+		}
+		if err != nil {
+			return err
 		}
 	}
 
@@ -139,7 +151,7 @@ func parseCamPath(path string) string {
 	return ""
 }
 
-func hijackStream(w http.ResponseWriter, r *http.Request, s stream.StreamChan) {
+func hijackStream(w http.ResponseWriter, r *http.Request, events <-chan stream.Event) {
 	// At the start of the handler, get the underlying hijacked connection
 	hj, ok := w.(http.Hijacker)
 	if !ok {
@@ -170,12 +182,12 @@ func hijackStream(w http.ResponseWriter, r *http.Request, s stream.StreamChan) {
 		select {
 		case <-r.Context().Done():
 			return
-		case data, ok := <-s:
+		case e, ok := <-events:
 			if !ok {
 				return
 			}
 
-			imageData, err := base64.StdEncoding.DecodeString(string(data))
+			imageData, err := base64.StdEncoding.DecodeString(string(e.Data))
 			if err != nil {
 				slog.Error("failed to decode base64 image", "error", err)
 				continue
@@ -210,10 +222,23 @@ func handleStreamEyes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stream := streamManager.GetReader(streamName)
-	defer streamManager.ReturnReader(streamName, stream)
+	opts, err := stream.ParseSampleOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader := broker.GetReader(streamName, stream.ReaderOptions{})
+	defer broker.ReturnReader(streamName, reader)
+
+	events := reader.C
+	if !opts.IsZero() {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		events = stream.Sample(ctx, reader.C, opts, stream.Filter{})
+	}
 
-	hijackStream(w, r, stream)
+	hijackStream(w, r, events)
 
 	/*
 		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
@@ -280,22 +305,20 @@ func homev1(w http.ResponseWriter, r *http.Request) {
 			{Name: "eyes", Ref: "/eyes"},
 			{Name: "eyes-api", Ref: "/v1/eyes/"},
 			{Name: "stream", Ref: "/v1/stream/"},
+			{Name: "streams", Ref: "/v1/streams"},
 		},
 	}
 
-	name := os.Getenv("YAKAPI_NAME")
-	if name != "" {
-		resp.Name = name
+	if conf.Name != "" {
+		resp.Name = conf.Name
 	}
 
-	project := os.Getenv("YAKAPI_PROJECT")
-	if project != "" {
-		resp.Resources = append(resp.Resources, resource{Name: "project", Ref: project})
+	if conf.Project != "" {
+		resp.Resources = append(resp.Resources, resource{Name: "project", Ref: conf.Project})
 	}
 
-	operator := os.Getenv("YAKAPI_OPERATOR")
-	if operator != "" {
-		resp.Resources = append(resp.Resources, resource{Name: "operator", Ref: operator})
+	if conf.Operator != "" {
+		resp.Resources = append(resp.Resources, resource{Name: "operator", Ref: conf.Operator})
 	}
 
 	err := sendResponse(w, resp, http.StatusOK)
@@ -306,8 +329,8 @@ func homev1(w http.ResponseWriter, r *http.Request) {
 }
 
 func fetchTelemetryData(ctx context.Context, out chan telemetry.Data) error {
-	stream := streamManager.GetReader("telemetry")
-	defer streamManager.ReturnReader("telemetry", stream)
+	stream := broker.GetReader("telemetry", stream.ReaderOptions{})
+	defer broker.ReturnReader("telemetry", stream)
 
 	allTelemetryData := make(telemetry.Data)
 
@@ -315,13 +338,13 @@ func fetchTelemetryData(ctx context.Context, out chan telemetry.Data) error {
 		select {
 		case <-ctx.Done():
 			return nil
-		case data, ok := <-stream:
+		case e, ok := <-stream.C:
 			if !ok {
 				return errors.New("stream closed")
 			}
 			// Load json telemetry from data
 			telemetryData := make(map[string]interface{})
-			err := json.Unmarshal([]byte(data), &telemetryData)
+			err := json.Unmarshal(e.Data, &telemetryData)
 			if err != nil {
 				slog.Warn("failed to unmarshal telemetry data", "error", err)
 				continue
@@ -343,6 +366,39 @@ func fetchTelemetryData(ctx context.Context, out chan telemetry.Data) error {
 	}
 }
 
+// publisher identifies who published a request, preferring the
+// X-Yakapi-Publisher header over the remote address.
+func publisher(r *http.Request) string {
+	if p := r.Header.Get("X-Yakapi-Publisher"); p != "" {
+		return p
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestEvent builds the event published by a request, taking its metadata
+// from the headers.
+func requestEvent(r *http.Request, body []byte) (stream.Event, error) {
+	e := stream.NewEvent(r.Header.Get("Content-Type"), body)
+	e.Publisher = publisher(r)
+	e.CorrelationID = r.Header.Get("X-Yakapi-Correlation-Id")
+	e.ReplyTo = r.Header.Get("X-Yakapi-Reply-To")
+
+	if v := r.Header.Get("X-Yakapi-Ttl"); v != "" {
+		ttl, err := stream.ParseTTL(v)
+		if err != nil {
+			return e, err
+		}
+		e.SetTTL(ttl)
+	}
+
+	return e, nil
+}
+
 func parseStreamPath(path string) string {
 	remaining, found := strings.CutPrefix(path, "/v1/stream/")
 	if found {
@@ -351,25 +407,238 @@ func parseStreamPath(path string) string {
 	return ""
 }
 
+// cutStreamAction splits a sub-resource such as "history" off the end of a
+// stream path. Streams can't be published to names ending in one, which would
+// be unreachable.
+func cutStreamAction(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return path, ""
+	}
+
+	switch action := path[i+1:]; action {
+	case "history", "latest", "ack", "nack", "request", "schema":
+		return path[:i], action
+	default:
+		return path, ""
+	}
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+func handleStreamHistory(w http.ResponseWriter, r *http.Request, streamName string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var offset uint64
+	if v := r.URL.Query().Get("offset"); v != "" {
+		var err error
+		offset, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			errorResponse(w, fmt.Errorf("invalid offset: %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			errorResponse(w, fmt.Errorf("invalid limit: %q", v), http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxHistoryLimit)
+	}
+
+	page, err := broker.History(streamName, offset, limit)
+	if errors.Is(err, stream.ErrNoLog) {
+		errorResponse(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("error reading stream history", "stream", streamName, "error", err)
+		errorResponse(w, errors.New("error reading history"), http.StatusInternalServerError)
+		return
+	}
+
+	err = sendResponse(w, page, http.StatusOK)
+	if err != nil {
+		slog.Error("error sending response", "error", err)
+		return
+	}
+}
+
+// handleStreamLatest serves a stream's retained event. The payload is returned
+// as published unless a JSON envelope is asked for.
+func handleStreamLatest(w http.ResponseWriter, r *http.Request, streamName string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format, err := stream.NegotiateFormat(r)
+	if err != nil {
+		errorResponse(w, err, http.StatusBadRequest)
+		return
+	}
+
+	e, ok := broker.Latest(streamName)
+	if !ok {
+		errorResponse(w, fmt.Errorf("no retained event for %q", streamName), http.StatusNotFound)
+		return
+	}
+
+	sendEvent(w, e, format)
+}
+
+// sendEvent responds with a single event, either its payload as it was
+// published, with its metadata in headers, or its JSON envelope.
+func sendEvent(w http.ResponseWriter, e stream.Event, format stream.Format) {
+	if format == stream.FormatJSON {
+		err := sendResponse(w, e, http.StatusOK)
+		if err != nil {
+			slog.Error("error sending response", "error", err)
+		}
+		return
+	}
+
+	if e.ContentType != "" {
+		w.Header().Set("Content-Type", e.ContentType)
+	}
+	w.Header().Set("Last-Modified", e.Time.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Yakapi-Id", e.ID.String())
+	w.Header().Set("X-Yakapi-Time", e.Time.Format(time.RFC3339Nano))
+	if e.Publisher != "" {
+		w.Header().Set("X-Yakapi-Publisher", e.Publisher)
+	}
+	if e.CorrelationID != "" {
+		w.Header().Set("X-Yakapi-Correlation-Id", e.CorrelationID)
+	}
+	if e.TTL > 0 {
+		w.Header().Set("X-Yakapi-Ttl", stream.FormatTTL(time.Duration(e.TTL*float64(time.Second))))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(e.Data)
+	if err != nil {
+		slog.Error("error sending response", "error", err)
+	}
+}
+
+// handleStreams lists the open streams, or describes one of them.
+func handleStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamName := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/streams"), "/")
+	if streamName == "" {
+		resp := struct {
+			Streams []stream.StreamInfo            `json:"streams"`
+			Schemas map[string]stream.Registration `json:"schemas"`
+		}{Streams: broker.Streams(), Schemas: broker.Schemas()}
+
+		err := sendResponse(w, resp, http.StatusOK)
+		if err != nil {
+			slog.Error("error sending response", "error", err)
+		}
+		return
+	}
+
+	info, ok := broker.Stream(streamName)
+	if !ok {
+		errorResponse(w, fmt.Errorf("no such stream: %q", streamName), http.StatusNotFound)
+		return
+	}
+
+	err := sendResponse(w, info, http.StatusOK)
+	if err != nil {
+		slog.Error("error sending response", "error", err)
+	}
+}
+
 func handleStream(w http.ResponseWriter, r *http.Request) {
-	streamName := parseStreamPath(r.URL.Path)
+	streamName, action := cutStreamAction(parseStreamPath(r.URL.Path))
 	if streamName == "" {
 		slog.Warn("invalid stream path", "path", r.URL.Path)
 		http.Error(w, "Invalid stream path", http.StatusBadRequest)
 		return
 	}
 
+	switch action {
+	case "history":
+		handleStreamHistory(w, r, streamName)
+		return
+	case "latest":
+		handleStreamLatest(w, r, streamName)
+		return
+	case "ack", "nack":
+		handleStreamSettle(w, r, streamName, action)
+		return
+	case "request":
+		handleStreamRequest(w, r, streamName)
+		return
+	case "schema":
+		handleStreamSchema(w, r, streamName)
+		return
+	}
+
+	if stream.IsPattern(streamName) && !stream.ValidPattern(streamName) {
+		http.Error(w, "Invalid stream pattern", http.StatusBadRequest)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
-		slog.Debug("stream out", "stream", streamName)
+		opts, err := stream.ParseOutOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if opts.Group != "" && stream.IsPattern(streamName) {
+			http.Error(w, "Consumer groups can't subscribe to a stream pattern", http.StatusBadRequest)
+			return
+		}
+		if opts.Ack {
+			err := checkAckOptions(streamName, opts)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		slog.Debug("stream out", "stream", streamName, "group", opts.Group)
+		if ct := opts.Format.ContentType(); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
 		w.Header().Set("Transfer-Encoding", "chunked")
-		err := stream.StreamOut(r.Context(), w, streamName, streamManager)
+		if opts.Format == stream.FormatSSE {
+			// Let EventSource know it's connected before the first event
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		err = stream.StreamOut(r.Context(), w, streamName, broker, opts)
 		if err != nil {
 			http.Error(w, "Error streaming out", http.StatusInternalServerError)
 			return
 		}
 		slog.Info("stream out complete", "stream", streamName)
 	case http.MethodPost:
+		if stream.IsPattern(streamName) {
+			http.Error(w, "Cannot publish to a stream pattern", http.StatusBadRequest)
+			return
+		}
+
 		slog.Debug("stream in", "stream", streamName)
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -379,7 +648,22 @@ func handleStream(w http.ResponseWriter, r *http.Request) {
 
 		slog.Debug("stream in", "stream", streamName, "body", string(body))
 
-		err = stream.StreamIn(r.Context(), streamName, body, streamManager)
+		e, err := requestEvent(r, body)
+		if err != nil {
+			errorResponse(w, err, http.StatusBadRequest)
+			return
+		}
+
+		err = stream.StreamIn(r.Context(), streamName, e, broker)
+		var verr *stream.ValidationError
+		if errors.As(err, &verr) {
+			errorResponse(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, stream.ErrClosed) {
+			errorResponse(w, errors.New("shutting down"), http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Error streaming in", http.StatusInternalServerError)
 			return
@@ -4,22 +4,20 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestHomeV1Handler(t *testing.T) {
-	// Save the original environment variables
-	originalName := os.Getenv("YAKAPI_NAME")
-	originalProject := os.Getenv("YAKAPI_PROJECT")
-	originalOperator := os.Getenv("YAKAPI_OPERATOR")
+	// Save the original configuration
+	originalConf := conf
+	defer func() { conf = originalConf }()
 
-	// Set up test environment variables
-	os.Setenv("YAKAPI_NAME", "Test YakAPI")
-	os.Setenv("YAKAPI_PROJECT", "https://test-project.com")
-	os.Setenv("YAKAPI_OPERATOR", "https://test-operator.com")
+	// Set up test configuration
+	conf.Name = "Test YakAPI"
+	conf.Project = "https://test-project.com"
+	conf.Operator = "https://test-operator.com"
 
 	// Create a request to pass to our handler
 	req, err := http.NewRequest("GET", "/v1", nil)
@@ -62,13 +60,9 @@ func TestHomeV1Handler(t *testing.T) {
 		{Name: "eyes", Ref: "/eyes"},
 		{Name: "eyes-api", Ref: "/v1/eyes/"},
 		{Name: "stream", Ref: "/v1/stream/"},
+		{Name: "streams", Ref: "/v1/streams"},
 		{Name: "project", Ref: "https://test-project.com"},
 		{Name: "operator", Ref: "https://test-operator.com"},
 	}
 	assert.ElementsMatch(t, expectedResources, response.Resources)
-
-	// Restore original environment variables
-	os.Setenv("YAKAPI_NAME", originalName)
-	os.Setenv("YAKAPI_PROJECT", originalProject)
-	os.Setenv("YAKAPI_OPERATOR", originalOperator)
 }
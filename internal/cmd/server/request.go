@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/rhettg/yakapi/internal/stream"
+)
+
+const (
+	defaultRequestTimeout = 10 * time.Second
+	maxRequestTimeout     = time.Minute
+)
+
+// handleStreamRequest publishes the request body to a stream and responds
+// with the reply, waiting up to the timeout for it.
+func handleStreamRequest(w http.ResponseWriter, r *http.Request, streamName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if stream.IsPattern(streamName) {
+		errorResponse(w, errors.New("cannot publish to a stream pattern"), http.StatusBadRequest)
+		return
+	}
+
+	format, err := stream.NegotiateFormat(r)
+	if err != nil {
+		errorResponse(w, err, http.StatusBadRequest)
+		return
+	}
+
+	timeout := defaultRequestTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 || timeout > maxRequestTimeout {
+			errorResponse(w, fmt.Errorf("invalid timeout: %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		errorResponse(w, errors.New("error reading request body"), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	e, err := requestEvent(r, body)
+	if err != nil {
+		errorResponse(w, err, http.StatusBadRequest)
+		return
+	}
+
+	reply, err := stream.Request(ctx, streamName, e, broker)
+	if errors.Is(err, context.DeadlineExceeded) {
+		errorResponse(w, fmt.Errorf("no reply within %s", timeout), http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, stream.ErrReplyExpired) {
+		errorResponse(w, err, http.StatusGatewayTimeout)
+		return
+	}
+	var verr *stream.ValidationError
+	if errors.As(err, &verr) {
+		errorResponse(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, stream.ErrClosed) {
+		errorResponse(w, errors.New("shutting down"), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		slog.Warn("stream request failed", "stream", streamName, "error", err)
+		errorResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	slog.Debug("stream request replied", "stream", streamName, "correlation_id", reply.CorrelationID)
+	sendEvent(w, reply, format)
+}
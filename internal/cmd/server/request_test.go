@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rhettg/yakapi/client"
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staleBroker answers every request with a reply that has already expired.
+type staleBroker struct {
+	fakeBroker
+	reply *stream.Reader
+}
+
+func (b *staleBroker) GetReader(name string, opts stream.ReaderOptions) *stream.Reader {
+	b.reply = stream.NewReader(1)
+	return b.reply
+}
+
+func (b *staleBroker) Publish(ctx context.Context, name string, e stream.Event) error {
+	reply := stream.NewEvent("application/json", []byte(`{"ok": true}`))
+	reply.CorrelationID = e.CorrelationID
+	reply.Time = time.Now().Add(-time.Minute)
+	reply.SetTTL(time.Second)
+	b.reply.Send(reply)
+	return nil
+}
+
+func TestStreamRequest(t *testing.T) {
+	sm := stream.NewManager()
+	useBroker(t, sm)
+
+	server := httptest.NewServer(http.HandlerFunc(handleStream))
+	defer server.Close()
+
+	c := client.NewClient(server.URL)
+
+	r := sm.GetReader("ci", stream.ReaderOptions{})
+	defer sm.ReturnReader("ci", r)
+
+	go func() {
+		e := <-r.C
+		req := client.Event{ID: e.ID.String(), CorrelationID: e.CorrelationID, ReplyTo: e.ReplyTo}
+		assert.NoError(t, c.Reply(req, []byte(`{"ok": true}`), "application/json"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply, err := c.Request(ctx, "ci", []byte(`{"cmd": "fwd"}`), "application/json")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ok": true}`, string(reply.Data))
+	assert.Equal(t, "ci:reply", reply.StreamName)
+	assert.NotEmpty(t, reply.CorrelationID)
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := c.Request(ctx, "ci", []byte(`{"cmd": "stop"}`), "application/json")
+		assert.ErrorIs(t, err, client.ErrNoReply)
+	})
+
+	t.Run("gateway timeout", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleStream(rr, httptest.NewRequest(http.MethodPost, "/v1/stream/ci/request?timeout=10ms", nil))
+		assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, url := range []string{
+			"/v1/stream/ci/request?timeout=2m",
+			"/v1/stream/ci/request?timeout=soon",
+			"/v1/stream/ci:*/request",
+		} {
+			rr := httptest.NewRecorder()
+			handleStream(rr, httptest.NewRequest(http.MethodPost, url, nil))
+			assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+		}
+	})
+	t.Run("expired reply", func(t *testing.T) {
+		useBroker(t, &staleBroker{})
+
+		rr := httptest.NewRecorder()
+		handleStream(rr, httptest.NewRequest(http.MethodPost, "/v1/stream/motor/request?timeout=5s", nil))
+		assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+		assert.Contains(t, rr.Body.String(), "reply expired")
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		closed := stream.NewManager()
+		require.NoError(t, closed.Close(context.Background()))
+		useBroker(t, closed)
+
+		rr := httptest.NewRecorder()
+		handleStream(rr, httptest.NewRequest(http.MethodPost, "/v1/stream/ci/request", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	})
+}
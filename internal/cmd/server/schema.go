@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/rhettg/yakapi/internal/stream"
+)
+
+const maxSchemaBytes = 1 << 20
+
+// handleStreamSchema serves, registers or removes the schema for a stream, or
+// pattern of streams.
+func handleStreamSchema(w http.ResponseWriter, r *http.Request, streamName string) {
+	if stream.IsPattern(streamName) && !stream.ValidPattern(streamName) {
+		errorResponse(w, errors.New("invalid stream pattern"), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		reg, ok := stream.LookupSchema(broker.Schemas(), streamName)
+		if !ok {
+			errorResponse(w, fmt.Errorf("no schema for %q", streamName), http.StatusNotFound)
+			return
+		}
+
+		err := sendResponse(w, reg, http.StatusOK)
+		if err != nil {
+			slog.Error("error sending response", "error", err)
+		}
+	case http.MethodPut:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSchemaBytes))
+		if err != nil {
+			errorResponse(w, errors.New("error reading request body"), http.StatusBadRequest)
+			return
+		}
+
+		schema, err := stream.ParseSchema(body)
+		if err != nil {
+			errorResponse(w, err, http.StatusBadRequest)
+			return
+		}
+
+		reg := stream.Registration{Schema: schema}
+		if v := r.URL.Query().Get("dead_letter"); v != "" {
+			reg.DeadLetter, err = strconv.ParseBool(v)
+			if err != nil {
+				errorResponse(w, fmt.Errorf("invalid dead_letter: %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		broker.SetSchema(streamName, reg)
+		slog.Info("schema registered", "stream", streamName, "dead_letter", reg.DeadLetter)
+
+		err = sendResponse(w, reg, http.StatusOK)
+		if err != nil {
+			slog.Error("error sending response", "error", err)
+		}
+	case http.MethodDelete:
+		if _, ok := broker.Schemas()[streamName]; !ok {
+			errorResponse(w, fmt.Errorf("no schema for %q", streamName), http.StatusNotFound)
+			return
+		}
+
+		broker.SetSchema(streamName, stream.Registration{})
+		slog.Info("schema removed", "stream", streamName)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
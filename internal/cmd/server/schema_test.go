@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rhettg/yakapi/internal/gds"
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamSchema(t *testing.T) {
+	sm := stream.NewManager()
+	useBroker(t, sm)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		handleStream(rr, req)
+		return rr
+	}
+
+	t.Run("register", func(t *testing.T) {
+		rr := do(http.MethodPut, "/v1/stream/motor:*/schema?dead_letter=true", `{"type": "object", "required": ["left"]}`)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		rr = do(http.MethodPut, "/v1/stream/ci/schema", `{"type": "object", "oneOf": []}`)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), "unsupported keyword")
+
+		rr = do(http.MethodGet, "/v1/stream/motor:left/schema", "")
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var reg stream.Registration
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &reg))
+		assert.True(t, reg.DeadLetter)
+
+		rr = do(http.MethodGet, "/v1/stream/ci/schema", "")
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("publish", func(t *testing.T) {
+		invalid := sm.GetReader("motor:left:invalid", stream.ReaderOptions{})
+		defer sm.ReturnReader("motor:left:invalid", invalid)
+
+		rr := do(http.MethodPost, "/v1/stream/motor:left", `{"right": 1}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		assert.Contains(t, rr.Body.String(), `missing required property \"left\"`)
+		assert.JSONEq(t, `{"right": 1}`, string((<-invalid.C).Data))
+
+		rr = do(http.MethodPost, "/v1/stream/motor:left", `{"left": 1}`)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		body := `{"stream": "motor:left", "json": {"left": 1}}
+{"stream": "motor:left", "json": {}}
+`
+		handleBatch(rr, httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(body)))
+		require.Equal(t, http.StatusUnprocessableEntity, rr.Code, rr.Body.String())
+
+		var resp struct {
+			Results []batchResult `json:"results"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		require.Len(t, resp.Results, 2)
+		assert.Empty(t, resp.Results[0].Error)
+		assert.Contains(t, resp.Results[1].Error, "missing required property")
+	})
+
+	t.Run("listing", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleStreams(rr, httptest.NewRequest(http.MethodGet, "/v1/streams", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var resp struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		assert.JSONEq(t, `{"schema": {"type": "object", "required": ["left"]}, "dead_letter": true}`, string(resp.Schemas["motor:*"]))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		rr := do(http.MethodDelete, "/v1/stream/motor:left/schema", "")
+		assert.Equal(t, http.StatusNotFound, rr.Code, "registered by pattern")
+
+		rr = do(http.MethodDelete, "/v1/stream/motor:*/schema", "")
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.Empty(t, sm.Schemas())
+	})
+}
+
+func TestGDSCISchema(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"commands.qi": [{"body": "fwd"}, {"body": {"cmd": "fwd"}}]}`))
+	}))
+	defer server.Close()
+
+	sm := stream.NewManager()
+	schema, err := stream.ParseSchema([]byte(`{"type": "object"}`))
+	require.NoError(t, err)
+	sm.SetSchema("ci", stream.Registration{Schema: schema})
+
+	r := sm.GetReader("ci", stream.ReaderOptions{})
+	defer sm.ReturnReader("ci", r)
+
+	// The invalid note is skipped rather than holding up the next
+	require.NoError(t, doGDSCI(context.Background(), gds.New(server.URL), sm))
+	select {
+	case e := <-r.C:
+		assert.JSONEq(t, `{"cmd": "fwd"}`, string(e.Data))
+	case <-time.After(time.Second):
+		t.Fatal("valid note not published")
+	}
+}
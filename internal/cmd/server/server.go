@@ -2,29 +2,42 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rhettg/yakapi/internal/config"
+	"github.com/rhettg/yakapi/internal/federation"
 	"github.com/rhettg/yakapi/internal/gds"
+	"github.com/rhettg/yakapi/internal/mqtt"
 	"github.com/rhettg/yakapi/internal/mw"
 	"github.com/rhettg/yakapi/internal/stream"
 	"github.com/rhettg/yakapi/internal/telemetry"
-	"github.com/spf13/cobra"
 )
 
 var startTime time.Time
 
+// shutdownTimeout is how long shutting down waits for publishes under way and
+// requests to finish.
+const shutdownTimeout = 10 * time.Second
+
 func init() {
 	startTime = time.Now()
 }
 
-func DoServer(cmd *cobra.Command, args []string) {
+// DoServer runs the server until it's interrupted.
+func DoServer(c config.Config) {
+	conf = c
+
 	promauto.NewGaugeFunc(prometheus.GaugeOpts{
 		Name: "yakapi_uptime_seconds",
 		Help: "The uptime of the yakapi service",
@@ -32,37 +45,54 @@ func DoServer(cmd *cobra.Command, args []string) {
 		return float64(time.Since(startTime).Seconds())
 	})
 
-	port := os.Getenv("YAKAPI_PORT")
-	if port == "" {
-		port = "8080"
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Checked by config.Validate, but before anything starts all the same
+	rules, err := c.Federation.Rules()
+	if err != nil {
+		slog.Error("invalid federation configuration", "error", err)
+		return
 	}
 
 	mux := setupServer()
 
-	streamManager = stream.NewManager()
+	sm, err := newManager(c)
+	if err != nil {
+		slog.Error("error setting up streams", "error", err)
+		return
+	}
+	prometheus.MustRegister(sm.Instrument(c.Metrics.MaxStreams))
 
-	if os.Getenv("YAKAPI_GDS_API_URL") != "" {
+	broker = sm
+
+	if c.GDS.URL != "" {
 		go func() {
-			c := gds.New(os.Getenv("YAKAPI_GDS_API_URL"))
+			c := gds.New(c.GDS.URL)
 			for {
-				err := doGDSCI(context.Background(), c, streamManager)
-				if err != nil {
+				err := doGDSCI(ctx, c, broker)
+				if err != nil && ctx.Err() == nil {
 					slog.Error("error running GDS CI", "error", err)
 				}
-				time.Sleep(10 * time.Second)
+
+				select {
+				case <-time.After(10 * time.Second):
+				case <-ctx.Done():
+					return
+				}
 			}
 		}()
 
 		source := make(chan telemetry.Data, 10)
 		go func() {
-			err := fetchTelemetryData(context.Background(), source)
+			err := fetchTelemetryData(ctx, source)
 			if err != nil {
 				slog.Error("error fetching telemetry data from Stream", "error", err)
 			}
 		}()
 
 		go func() {
-			c := gds.New(os.Getenv("YAKAPI_GDS_API_URL"))
+			c := gds.New(c.GDS.URL)
 
 			cachedTd := make(map[string]interface{})
 
@@ -75,6 +105,8 @@ func DoServer(cmd *cobra.Command, args []string) {
 				case td = <-source:
 				case <-time.After(1 * time.Second):
 					td = telemetry.Data{}
+				case <-ctx.Done():
+					return
 				}
 
 				for key, value := range td {
@@ -102,7 +134,7 @@ func DoServer(cmd *cobra.Command, args []string) {
 						time.Sleep(1 * time.Second)
 					}
 
-					err := c.SendTelemetry(context.Background(), td)
+					err := c.SendTelemetry(ctx, td)
 					if err != nil {
 						slog.Error("error uploading telemetry to GDS", "error", err)
 					} else {
@@ -117,34 +149,206 @@ func DoServer(cmd *cobra.Command, args []string) {
 
 	telemetrySource := make(chan telemetry.Data)
 	go func() {
-		err := fetchTelemetryData(context.Background(), telemetrySource)
+		err := fetchTelemetryData(ctx, telemetrySource)
 		if err != nil {
 			slog.Error("error fetching telemetry data from Stream", "error", err)
 		}
 	}()
 
 	go func() {
-		err := telemetry.Run(context.Background(), telemetrySource)
+		err := telemetry.Run(ctx, telemetrySource)
 		if err != nil {
 			slog.Error("error running telemetry", "error", err)
 		}
 	}()
 
+	server := &http.Server{Addr: fmt.Sprintf(":%d", c.Port), Handler: mux}
+	servers := []*http.Server{server}
+
+	if c.SFC.Enabled {
+		sfcServer := &http.Server{Addr: fmt.Sprintf(":%d", c.SFC.Port), Handler: setupSFCserver(ctx)}
+		servers = append(servers, sfcServer)
+		go func() {
+			slog.Info("starting sfc", "version", "1.0.0", "port", c.SFC.Port, "build", Revision)
+			err := sfcServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("error from sfc ListenAndServe", "error", err)
+			}
+		}()
+	}
+
+	if c.MQTT.Enabled {
+		go func() {
+			slog.Info("starting mqtt", "port", c.MQTT.Port)
+			err := mqtt.ListenAndServe(ctx, fmt.Sprintf(":%d", c.MQTT.Port), broker)
+			if err != nil {
+				slog.Error("error from mqtt ListenAndServe", "error", err)
+			}
+		}()
+	}
+
+	if remote := c.Federation.URL; remote != "" {
+		name := c.Name
+		if name == "" {
+			name = "YakBot"
+		}
+
+		link := &federation.Link{Broker: broker, Remote: remote, Name: name, Rules: rules}
+		go func() {
+			err := link.Run(ctx)
+			if err != nil {
+				slog.Error("error running federation", "remote", config.Redact(remote), "error", err)
+			}
+		}()
+	}
+
+	serveErr := make(chan error, 1)
 	go func() {
-		port := 8765
-		sfcMux := setupSFCserver()
-		slog.Info("starting sfc", "version", "1.0.0", "port", port, "build", Revision)
-		err := http.ListenAndServe(fmt.Sprintf(":%d", port), sfcMux)
+		slog.Info("starting", "version", "1.0.0", "port", c.Port, "build", Revision)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		slog.Error("error from ListenAndServe", "error", err)
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	}
+	stop()
+
+	shutdown(sm, servers...)
+	slog.Info("stopped")
+}
+
+// shutdown stops the servers taking new requests, and closes the broker. That
+// waits for publishes under way, then ends every subscription so the requests
+// serving them finish.
+func shutdown(b stream.Broker, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				slog.Error("error shutting down server", "addr", srv.Addr, "error", err)
+			}
+		}()
+	}
+
+	err := b.Close(ctx)
+	if err != nil {
+		slog.Error("error closing streams", "error", err)
+	}
+
+	wg.Wait()
+}
+
+// newManager sets up the streams as configured: their policies, retention and
+// TTLs, the schemas, the stream log and the queues for acked streams. Every
+// stream setting reaches the manager this way.
+func newManager(c config.Config) (*stream.Manager, error) {
+	sm := stream.NewManager()
+
+	err := configureStreams(sm, c.Streams)
+	if err != nil {
+		sm.Close(context.Background())
+		return nil, fmt.Errorf("invalid stream configuration: %w", err)
+	}
+
+	schemas, err := streamSchemas(c.Schemas)
+	if err != nil {
+		sm.Close(context.Background())
+		return nil, fmt.Errorf("invalid stream schema configuration: %w", err)
+	}
+	for name, reg := range schemas {
+		sm.SetSchema(name, reg)
+		slog.Info("schema registered", "stream", name, "dead_letter", reg.DeadLetter)
+	}
+
+	if c.Log.Dir != "" {
+		cfg := stream.LogConfig{
+			Dir:          c.Log.Dir,
+			SegmentBytes: stream.DefaultSegmentBytes,
+			MaxBytes:     c.Log.MaxBytes,
+			MaxAge:       time.Duration(c.Log.MaxAge),
+		}
+
+		err = sm.OpenLog(cfg)
 		if err != nil {
-			slog.Error("error from sfc ListenAndServe", "error", err)
+			sm.Close(context.Background())
+			return nil, fmt.Errorf("error opening stream log in %s: %w", cfg.Dir, err)
 		}
-	}()
+		slog.Info("stream log enabled", "dir", cfg.Dir, "max_bytes", cfg.MaxBytes, "max_age", cfg.MaxAge)
+	}
+
+	for _, name := range c.Streams.Acked {
+		err := sm.DeclareQueue(name, stream.DefaultGroup, stream.AckOptions{})
+		if err != nil {
+			sm.Close(context.Background())
+			return nil, fmt.Errorf("invalid acked stream configuration: %w", err)
+		}
+	}
+
+	return sm, nil
+}
+
+// configureStreams applies the delivery policies, retention, TTLs and idle
+// expiry of streams.
+func configureStreams(sm *stream.Manager, c config.Streams) error {
+	for name, spec := range c.Policies {
+		p, err := stream.ParsePolicy(spec)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		sm.SetPolicy(name, p)
+	}
+
+	for _, name := range c.Retained {
+		sm.SetRetained(name, true)
+	}
+
+	for name, d := range c.TTLs {
+		sm.SetTTL(name, time.Duration(d))
+	}
+
+	if c.IdleExpiry > 0 {
+		sm.SetIdleExpiry(time.Duration(c.IdleExpiry))
+	}
 
-	slog.Info("starting", "version", "1.0.0", "port", port, "build", Revision)
-	err := http.ListenAndServe(fmt.Sprintf(":%s", port), mux)
+	return nil
+}
+
+// streamSchemas are the schemas loaded from the schema directory, dead-lettering
+// the streams asked for.
+func streamSchemas(c config.Schemas) (map[string]stream.Registration, error) {
+	if c.Dir == "" {
+		return nil, nil
+	}
+
+	loaded, err := stream.LoadSchemas(c.Dir)
 	if err != nil {
-		slog.Error("error from ListenAndServe", "error", err)
+		return nil, err
 	}
+
+	regs := make(map[string]stream.Registration, len(loaded))
+	for name, schema := range loaded {
+		regs[name] = stream.Registration{Schema: schema}
+	}
+
+	for _, name := range c.DeadLetter {
+		reg, ok := regs[name]
+		if !ok {
+			return nil, fmt.Errorf("no schema to dead letter for %q", name)
+		}
+		reg.DeadLetter = true
+		regs[name] = reg
+	}
+
+	return regs, nil
 }
 
 func setupServer() *http.ServeMux {
@@ -169,7 +373,11 @@ func setupServer() *http.ServeMux {
 	mux.Handle("/v1", wrapper(http.HandlerFunc(homev1)))
 	mux.Handle("/v1/me", wrapper(http.HandlerFunc(me)))
 	mux.Handle("/v1/eyes/", http.HandlerFunc(handleStreamEyes))
+	mux.Handle("/v1/ws", http.HandlerFunc(handleWebSocket))
 	mux.Handle("/v1/stream/", wrapper(http.HandlerFunc(handleStream)))
+	mux.Handle("/v1/streams", wrapper(http.HandlerFunc(handleStreams)))
+	mux.Handle("/v1/batch", wrapper(http.HandlerFunc(handleBatch)))
+	mux.Handle("/v1/streams/", wrapper(http.HandlerFunc(handleStreams)))
 	mux.Handle("/metrics", wrapper(promhttp.Handler()))
 	mux.Handle("/eyes", wrapper(http.HandlerFunc(eyes)))
 
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rhettg/yakapi/internal/config"
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewManager(t *testing.T) {
+	c := config.Default()
+	c.Streams.Acked = []string{"orders"}
+	c.Log.Dir = t.TempDir()
+
+	sm, err := newManager(c)
+	require.NoError(t, err)
+	defer sm.Close(context.Background())
+
+	info, ok := sm.Stream("orders")
+	require.True(t, ok, "queued from startup")
+	assert.Len(t, info.Queues, 1)
+
+	require.NoError(t, sm.Publish(context.Background(), "telemetry", stream.NewEvent("text/plain", []byte("ok"))))
+	assert.Eventually(t, func() bool {
+		_, ok := sm.Latest("telemetry")
+		return ok
+	}, time.Second, time.Millisecond, "retained")
+
+	_, err = sm.History("telemetry", 0, 10)
+	assert.NoError(t, err, "logged")
+
+	t.Run("invalid", func(t *testing.T) {
+		c := config.Default()
+		c.Streams.Policies = map[string]string{"ci": "bogus"}
+
+		_, err := newManager(c)
+		assert.ErrorContains(t, err, "invalid stream configuration")
+	})
+}
@@ -3,13 +3,15 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
-	"sync"
+	"strings"
 
 	"github.com/rhettg/yakapi/internal/sfc"
+	"github.com/rhettg/yakapi/internal/stream"
 )
 
 type sfcValue struct {
@@ -26,14 +28,21 @@ func sfcWriteControlValues(ctx context.Context, cv chan sfc.ControlValue) error
 
 			slog.Debug("sfc control value", "region", cv.Region, "value", cv.Value)
 			streamName := fmt.Sprintf("sfc-control:%s", cv.Region)
-			s := streamManager.GetWriter(streamName)
 			value, err := json.Marshal(sfcValue{Value: cv.Value})
 			if err != nil {
 				slog.Error("error marshaling sfc control value", "error", err)
 				continue
 			}
-			s <- value
-			streamManager.ReturnWriter(streamName)
+			e := stream.NewEvent("application/json", value)
+			e.Publisher = "sfc"
+			err = broker.Publish(ctx, streamName, e)
+			if err != nil {
+				if errors.Is(err, stream.ErrClosed) || ctx.Err() != nil {
+					return err
+				}
+				// Only this value is lost, such as to a schema refusing it
+				slog.Warn("error publishing sfc control value", "stream", streamName, "error", err)
+			}
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -41,43 +50,71 @@ func sfcWriteControlValues(ctx context.Context, cv chan sfc.ControlValue) error
 }
 
 func sfcReadControlValues(ctx context.Context, cv chan sfc.ControlValue) error {
-	var wg sync.WaitGroup
+	const pattern = "sfc-control-set:*"
+	r := broker.GetReader(pattern, stream.ReaderOptions{})
+	defer broker.ReturnReader(pattern, r)
 
-	for _, r := range sfc.AllRegions {
-		wg.Add(1)
-		go func(region sfc.Region) {
-			defer wg.Done()
-			ch := streamManager.GetReader(fmt.Sprintf("sfc-control-set:%s", region))
-			defer streamManager.ReturnReader(fmt.Sprintf("sfc-control-set:%s", region), ch)
-
-			for {
-				select {
-				case data, ok := <-ch:
-					if !ok {
-						slog.Warn("Channel closed", "region", region)
-						return
-					}
-					slog.Debug("Received control value", "region", region, "data", string(data))
-					fv, err := strconv.ParseFloat(string(data), 64)
-					if err != nil {
-						slog.Debug("not a float")
-						cv <- sfc.ControlValue{Region: region, Value: data}
-						continue
-					}
-
-					cv <- sfc.ControlValue{Region: region, Value: fv}
-				case <-ctx.Done():
-					return
-				}
+	// The latest value for each region waiting to be taken, in the order
+	// regions were set, so a burst of values for one region can't push out
+	// the value of another.
+	pending := make(map[sfc.Region]interface{})
+	var order []sfc.Region
+
+	for {
+		var out chan sfc.ControlValue
+		var next sfc.ControlValue
+		if len(order) > 0 {
+			out = cv
+			next = sfc.ControlValue{Region: order[0], Value: pending[order[0]]}
+		}
+
+		select {
+		case e, ok := <-r.C:
+			if !ok {
+				slog.Warn("Channel closed", "stream", pattern)
+				return nil
+			}
+
+			region, ok := sfcRegion(e.Stream)
+			if !ok {
+				slog.Debug("not a region", "stream", e.Stream)
+				continue
+			}
+			slog.Debug("Received control value", "region", region, "data", string(e.Data))
+
+			var value interface{} = e.Data
+			fv, err := strconv.ParseFloat(string(e.Data), 64)
+			if err != nil {
+				slog.Debug("not a float")
+			} else {
+				value = fv
+			}
+
+			if _, ok := pending[region]; !ok {
+				order = append(order, region)
 			}
-		}(r)
+			pending[region] = value
+		case out <- next:
+			delete(pending, next.Region)
+			order = order[1:]
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
 
-	wg.Wait()
-	return ctx.Err()
+// sfcRegion finds the region a control set stream is for.
+func sfcRegion(name string) (sfc.Region, bool) {
+	_, region, _ := strings.Cut(name, ":")
+	for _, r := range sfc.AllRegions {
+		if string(r) == region {
+			return r, true
+		}
+	}
+	return "", false
 }
 
-func setupSFCserver() *http.ServeMux {
+func setupSFCserver(ctx context.Context) *http.ServeMux {
 	mux := http.NewServeMux()
 
 	/*
@@ -90,14 +127,14 @@ func setupSFCserver() *http.ServeMux {
 
 	cvIn := make(chan sfc.ControlValue)
 	go func() {
-		if err := sfcReadControlValues(context.Background(), cvIn); err != nil {
+		if err := sfcReadControlValues(ctx, cvIn); err != nil && ctx.Err() == nil {
 			slog.Error("Error in sfcReadControlValues", "error", err)
 		}
 	}()
 
 	cvOut := make(chan sfc.ControlValue)
 	go func() {
-		if err := sfcWriteControlValues(context.Background(), cvOut); err != nil {
+		if err := sfcWriteControlValues(ctx, cvOut); err != nil && ctx.Err() == nil {
 			slog.Error("Error in sfcWriteControlValues", "error", err)
 		}
 	}()
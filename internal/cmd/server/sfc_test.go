@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rhettg/yakapi/internal/sfc"
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSFCReadControlValues(t *testing.T) {
+	sm := stream.NewManager()
+	sm.SetPolicy("sfc-control-set:*", stream.Policy{Delivery: stream.DropOldest, BufferSize: 2})
+	useBroker(t, sm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cv := make(chan sfc.ControlValue)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sfcReadControlValues(ctx, cv)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	publish := func(name, value string) {
+		require.NoError(t, sm.Publish(ctx, name, stream.NewEvent("text/plain", []byte(value))))
+	}
+
+	// Wait for the reader to subscribe to the pattern
+	require.Eventually(t, func() bool {
+		publish("sfc-control-set:C", "0.5")
+		c, _ := sm.Stream("sfc-control-set:C")
+		return c.Readers == 1
+	}, time.Second, time.Millisecond)
+
+	// Nobody is taking values yet, so they back up
+	publish("sfc-control-set:B", "0.25")
+	for i := 0; i < 20; i++ {
+		publish("sfc-control-set:A", "1")
+	}
+	publish("sfc-control-set:bogus", "1")
+
+	// A burst on one region doesn't push out another's value
+	got := make(map[sfc.Region][]interface{})
+	timeout := time.After(100 * time.Millisecond)
+drain:
+	for {
+		select {
+		case v := <-cv:
+			got[v.Region] = append(got[v.Region], v.Value)
+		case <-timeout:
+			break drain
+		}
+	}
+
+	assert.Equal(t, []interface{}{0.25}, got[sfc.RegionB])
+	assert.NotEmpty(t, got[sfc.RegionA])
+	assert.Len(t, got, 3)
+}
+
+func TestSFCWriteControlValues(t *testing.T) {
+	sm := stream.NewManager()
+	schema, err := stream.ParseSchema([]byte(`{"type": "object", "properties": {"value": {"type": "number"}}}`))
+	require.NoError(t, err)
+	sm.SetSchema("sfc-control:*", stream.Registration{Schema: schema})
+	useBroker(t, sm)
+
+	r := sm.GetReader("sfc-control:*", stream.ReaderOptions{})
+	defer sm.ReturnReader("sfc-control:*", r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cv := make(chan sfc.ControlValue)
+	done := make(chan error)
+	go func() {
+		done <- sfcWriteControlValues(ctx, cv)
+	}()
+
+	// A value the schema refuses doesn't stop the ones after it
+	cv <- sfc.ControlValue{Region: sfc.RegionA, Value: "fast"}
+	select {
+	case cv <- sfc.ControlValue{Region: sfc.RegionB, Value: 0.5}:
+	case <-time.After(time.Second):
+		t.Fatal("writer stopped")
+	}
+
+	select {
+	case e := <-r.C:
+		assert.Equal(t, "sfc-control:B", e.Stream)
+		assert.JSONEq(t, `{"value": 0.5}`, string(e.Data))
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for control value")
+	}
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamsHandler(t *testing.T) {
+	sm := stream.NewManager()
+	useBroker(t, sm)
+
+	r := sm.GetReader("test", stream.ReaderOptions{})
+	defer sm.ReturnReader("test", r)
+
+	w := sm.GetWriter("test")
+	w <- stream.NewEvent("text/plain", []byte("hello"))
+	sm.ReturnWriter("test")
+
+	select {
+	case <-r.C:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	t.Run("list", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleStreams(rr, httptest.NewRequest(http.MethodGet, "/v1/streams", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var resp struct {
+			Streams []stream.StreamInfo `json:"streams"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		require.Len(t, resp.Streams, 1)
+
+		info := resp.Streams[0]
+		assert.Equal(t, "test", info.Name)
+		assert.Equal(t, 1, info.Readers)
+		assert.Equal(t, uint64(1), info.Published)
+		assert.Equal(t, uint64(5), info.Bytes)
+		assert.Equal(t, "text/plain", info.LastContentType)
+		assert.NotNil(t, info.LastPublished)
+		assert.Greater(t, info.MessageRate, 0.0)
+	})
+
+	t.Run("detail", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleStreams(rr, httptest.NewRequest(http.MethodGet, "/v1/streams/test", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var info stream.StreamInfo
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+		assert.Equal(t, "test", info.Name)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleStreams(rr, httptest.NewRequest(http.MethodGet, "/v1/streams/nope", nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
+func TestStreamLatestHandler(t *testing.T) {
+	sm := stream.NewManager()
+	useBroker(t, sm)
+	sm.SetRetained("telemetry", true)
+
+	r := sm.GetReader("telemetry", stream.ReaderOptions{})
+	defer sm.ReturnReader("telemetry", r)
+
+	w := sm.GetWriter("telemetry")
+	e := stream.NewEvent("application/json", []byte(`{"speed":1}`))
+	w <- e
+	sm.ReturnWriter("telemetry")
+
+	select {
+	case <-r.C:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	t.Run("raw", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleStream(rr, httptest.NewRequest(http.MethodGet, "/v1/stream/telemetry/latest", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		assert.Equal(t, e.ID.String(), rr.Header().Get("X-Yakapi-Id"))
+		assert.NotEmpty(t, rr.Header().Get("Last-Modified"))
+		assert.Equal(t, `{"speed":1}`, rr.Body.String())
+	})
+
+	t.Run("envelope", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleStream(rr, httptest.NewRequest(http.MethodGet, "/v1/stream/telemetry/latest?format=json", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var got stream.Event
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+		assert.Equal(t, e.ID, got.ID)
+		assert.Equal(t, "telemetry", got.Stream)
+	})
+
+	t.Run("not retained", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleStream(rr, httptest.NewRequest(http.MethodGet, "/v1/stream/other/latest", nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/stream/telemetry", strings.NewReader(`{"speed":2}`))
+		req.Header.Set("X-Yakapi-Ttl", "1m")
+		rr := httptest.NewRecorder()
+		handleStream(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		select {
+		case <-r.C:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+
+		rr = httptest.NewRecorder()
+		handleStream(rr, httptest.NewRequest(http.MethodGet, "/v1/stream/telemetry/latest", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, `{"speed":2}`, rr.Body.String())
+		left, err := stream.ParseTTL(rr.Header().Get("X-Yakapi-Ttl"))
+		require.NoError(t, err, "read as it's written")
+		assert.InDelta(t, time.Minute, left, float64(time.Second))
+
+		// And can be published again as it is
+		req = httptest.NewRequest(http.MethodPost, "/v1/stream/telemetry", strings.NewReader(`{"speed":2}`))
+		req.Header.Set("X-Yakapi-Ttl", rr.Header().Get("X-Yakapi-Ttl"))
+		rr = httptest.NewRecorder()
+		handleStream(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		select {
+		case <-r.C:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+
+		req = httptest.NewRequest(http.MethodPost, "/v1/stream/telemetry", strings.NewReader(`{"speed":3}`))
+		req.Header.Set("X-Yakapi-Ttl", "soon")
+		rr = httptest.NewRecorder()
+		handleStream(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
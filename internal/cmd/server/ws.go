@@ -0,0 +1,371 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/oklog/ulid/v2"
+	"github.com/rhettg/yakapi/internal/stream"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     wsCheckOrigin,
+}
+
+// wsCheckOrigin allows browsers to connect from the server's own origin, or
+// those configured. Other clients don't send an Origin.
+func wsCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range conf.WebSocket.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsRequest is a message from a WebSocket client. Type is one of "publish",
+// "subscribe" or "unsubscribe". The ID is echoed back in the ack or error.
+type wsRequest struct {
+	Type        string `json:"type"`
+	ID          string `json:"id,omitempty"`
+	Stream      string `json:"stream"`
+	ContentType string `json:"content_type,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+
+	// Subscription options, as for the stream endpoint
+	Since    string `json:"since,omitempty"`
+	Last     int    `json:"last,omitempty"`
+	Offset   uint64 `json:"offset,omitempty"`
+	Buffer   int    `json:"buffer,omitempty"`
+	Retained bool   `json:"retained,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// wsResponse is a message to a WebSocket client. Type is one of "ack",
+// "error" or "event". Events name the subscription they were delivered for.
+type wsResponse struct {
+	Type         string        `json:"type"`
+	ID           string        `json:"id,omitempty"`
+	EventID      string        `json:"event_id,omitempty"`
+	Subscription string        `json:"subscription,omitempty"`
+	Event        *stream.Event `json:"event,omitempty"`
+	Error        string        `json:"error,omitempty"`
+
+	// reader takes the event back if it can't be written.
+	reader *stream.Reader
+}
+
+func (req wsRequest) readerOptions() (stream.ReaderOptions, error) {
+	opts := stream.ReaderOptions{
+		Last:     req.Last,
+		Offset:   req.Offset,
+		Retained: req.Retained,
+		Group:    req.Group,
+	}
+
+	if req.Group != "" && stream.IsPattern(req.Stream) {
+		return opts, errors.New("consumer groups can't subscribe to a stream pattern")
+	}
+
+	if req.Since != "" {
+		id, err := ulid.Parse(req.Since)
+		if err != nil {
+			return opts, fmt.Errorf("invalid since: %w", err)
+		}
+		opts.Since = id
+	}
+
+	if req.Last < 0 {
+		return opts, fmt.Errorf("invalid last: %d", req.Last)
+	}
+
+	if req.Buffer < 0 || req.Buffer > stream.MaxBufferSize {
+		return opts, fmt.Errorf("invalid buffer: %d", req.Buffer)
+	}
+	opts.BufferSize = req.Buffer
+
+	return opts, nil
+}
+
+// wsSession is a single WebSocket connection, which may publish to and
+// subscribe to any number of streams.
+type wsSession struct {
+	ctx       context.Context
+	publisher string
+	out       chan wsResponse
+
+	// subs is only touched by the goroutine reading requests
+	subs map[string]*wsSubscription
+	wg   sync.WaitGroup
+}
+
+type wsSubscription struct {
+	cancel context.CancelFunc
+
+	// done is closed once the subscription ends, including when the stream
+	// disconnects it.
+	done chan struct{}
+}
+
+func (sub *wsSubscription) active() bool {
+	select {
+	case <-sub.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("failed to upgrade connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	s := &wsSession{
+		ctx:       ctx,
+		publisher: publisher(r),
+		out:       make(chan wsResponse),
+		subs:      make(map[string]*wsSubscription),
+	}
+
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		defer cancel()
+		err := s.write(conn)
+		if err != nil {
+			slog.Debug("websocket write ended", "error", err)
+		}
+	}()
+
+	conn.SetReadLimit(conf.WebSocket.MaxMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var req wsRequest
+		err := conn.ReadJSON(&req)
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Debug("websocket read ended", "error", err)
+			}
+			break
+		}
+
+		s.handle(req)
+	}
+
+	cancel()
+	s.wg.Wait()
+	<-writeDone
+}
+
+// write sends responses, and pings to keep the connection alive, until the
+// session ends.
+func (s *wsSession) write(conn *websocket.Conn) error {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case resp := <-s.out:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err := conn.WriteJSON(resp)
+			if err != nil {
+				if resp.reader != nil {
+					resp.reader.Redeliver(*resp.Event)
+				}
+				return err
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err := conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				return err
+			}
+		case <-s.ctx.Done():
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			return conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}
+	}
+}
+
+func (s *wsSession) send(resp wsResponse) {
+	s.sendContext(s.ctx, resp)
+}
+
+// sendContext gives up when ctx is done, so a subscription can end while the
+// connection is backed up. It returns whether the response was sent.
+func (s *wsSession) sendContext(ctx context.Context, resp wsResponse) bool {
+	select {
+	case s.out <- resp:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *wsSession) fail(req wsRequest, err error) {
+	s.send(wsResponse{Type: "error", ID: req.ID, Error: err.Error()})
+}
+
+func (s *wsSession) handle(req wsRequest) {
+	if req.Stream == "" {
+		s.fail(req, errors.New("stream is required"))
+		return
+	}
+
+	switch req.Type {
+	case "publish":
+		s.publish(req)
+	case "subscribe":
+		s.subscribe(req)
+	case "unsubscribe":
+		s.unsubscribe(req)
+	default:
+		s.fail(req, fmt.Errorf("unknown type: %q", req.Type))
+	}
+}
+
+func (s *wsSession) publish(req wsRequest) {
+	if stream.IsPattern(req.Stream) {
+		s.fail(req, errors.New("cannot publish to a stream pattern"))
+		return
+	}
+
+	e := stream.NewEvent(req.ContentType, req.Data)
+	e.Publisher = s.publisher
+	if req.TTL != "" {
+		ttl, err := stream.ParseTTL(req.TTL)
+		if err != nil {
+			s.fail(req, err)
+			return
+		}
+		e.SetTTL(ttl)
+	}
+
+	err := stream.StreamIn(s.ctx, req.Stream, e, broker)
+	var verr *stream.ValidationError
+	if errors.As(err, &verr) {
+		s.fail(req, err)
+		return
+	}
+	if errors.Is(err, stream.ErrClosed) {
+		s.fail(req, errors.New("shutting down"))
+		return
+	}
+	if err != nil {
+		s.fail(req, errors.New("error streaming in"))
+		return
+	}
+
+	s.send(wsResponse{Type: "ack", ID: req.ID, EventID: e.ID.String()})
+}
+
+func (s *wsSession) subscribe(req wsRequest) {
+	if stream.IsPattern(req.Stream) && !stream.ValidPattern(req.Stream) {
+		s.fail(req, errors.New("invalid stream pattern"))
+		return
+	}
+
+	if sub, ok := s.subs[req.Stream]; ok && sub.active() {
+		s.fail(req, fmt.Errorf("already subscribed to %q", req.Stream))
+		return
+	}
+
+	opts, err := req.readerOptions()
+	if err != nil {
+		s.fail(req, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	sub := &wsSubscription{cancel: cancel, done: make(chan struct{})}
+	s.subs[req.Stream] = sub
+
+	// Subscribe before acking so nothing published after the ack is missed
+	r := broker.GetReader(req.Stream, opts)
+	s.send(wsResponse{Type: "ack", ID: req.ID})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(sub.done)
+		defer broker.ReturnReader(req.Stream, r)
+
+		for {
+			select {
+			case e, ok := <-r.C:
+				if !ok {
+					s.sendContext(ctx, wsResponse{Type: "error", Subscription: req.Stream, Error: "subscription closed"})
+					return
+				}
+				e, ok = r.Fresh(e)
+				if !ok {
+					continue
+				}
+				// An event that isn't sent, or isn't written, goes back so
+				// another member of the reader's group can have it
+				if !s.sendContext(ctx, wsResponse{Type: "event", Subscription: req.Stream, Event: &e, reader: r}) {
+					r.Redeliver(e)
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *wsSession) unsubscribe(req wsRequest) {
+	sub, ok := s.subs[req.Stream]
+	if !ok || !sub.active() {
+		delete(s.subs, req.Stream)
+		s.fail(req, fmt.Errorf("not subscribed to %q", req.Stream))
+		return
+	}
+
+	sub.cancel()
+	<-sub.done
+	delete(s.subs, req.Stream)
+	s.send(wsResponse{Type: "ack", ID: req.ID})
+}
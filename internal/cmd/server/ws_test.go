@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rhettg/yakapi/client"
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receiveEvent(t *testing.T, ch <-chan client.Event) client.Event {
+	t.Helper()
+	select {
+	case e, ok := <-ch:
+		require.True(t, ok, "channel closed")
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return client.Event{}
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(origin string) error {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	assert.NoError(t, dial(""))
+	assert.NoError(t, dial(server.URL))
+	assert.Error(t, dial("http://example.com"))
+
+	old := conf
+	t.Cleanup(func() { conf = old })
+	conf.WebSocket.Origins = []string{"http://example.com"}
+	assert.NoError(t, dial("http://example.com"))
+	assert.Error(t, dial("http://example.org"))
+}
+
+func TestWebSocketReadLimit(t *testing.T) {
+	old := conf
+	t.Cleanup(func() { conf = old })
+	conf.WebSocket.MaxMessageBytes = 256
+
+	server := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	big := strings.Repeat("x", 1024)
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "publish", "stream": "motor", "content_type": big}))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "unexpected %v", err)
+}
+
+func TestWebSocketGroupRedelivery(t *testing.T) {
+	sm := stream.NewManager()
+	useBroker(t, sm)
+
+	other := sm.GetReader("ci", stream.ReaderOptions{Group: "workers", BufferSize: 16})
+	defer sm.ReturnReader("ci", other)
+
+	received := func() []string {
+		var got []string
+		for {
+			select {
+			case e := <-other.C:
+				got = append(got, string(e.Data))
+			case <-time.After(50 * time.Millisecond):
+				return got
+			}
+		}
+	}
+
+	t.Run("abandoned", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := &wsSession{ctx: ctx, out: make(chan wsResponse), subs: make(map[string]*wsSubscription)}
+
+		go s.subscribe(wsRequest{Type: "subscribe", Stream: "ci", Group: "workers", Buffer: 16})
+		assert.Equal(t, "ack", (<-s.out).Type)
+
+		for _, data := range []string{"0", "1", "2", "3"} {
+			require.NoError(t, sm.Publish(ctx, "ci", stream.NewEvent("text/plain", []byte(data))))
+		}
+
+		// The session takes its first event, then is stuck with the next
+		// when the connection goes
+		resp := <-s.out
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		s.wg.Wait()
+
+		got := append(received(), string(resp.Event.Data))
+		assert.ElementsMatch(t, []string{"0", "1", "2", "3"}, got)
+	})
+
+	t.Run("write failed", func(t *testing.T) {
+		conns := make(chan *websocket.Conn, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := wsUpgrader.Upgrade(w, r, nil)
+			require.NoError(t, err)
+			conns <- conn
+		}))
+		defer server.Close()
+
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		require.NoError(t, err)
+		defer client.Close()
+
+		conn := <-conns
+		conn.UnderlyingConn().Close()
+
+		r := sm.GetReader("ci", stream.ReaderOptions{Group: "workers", BufferSize: 16})
+		s := &wsSession{ctx: context.Background(), out: make(chan wsResponse, 1)}
+		e := stream.NewEvent("text/plain", []byte("4"))
+		s.out <- wsResponse{Type: "event", Subscription: "ci", Event: &e, reader: r}
+
+		assert.Error(t, s.write(conn))
+		sm.ReturnReader("ci", r)
+		assert.Equal(t, []string{"4"}, received())
+	})
+}
+
+func TestWebSocket(t *testing.T) {
+	sm := stream.NewManager()
+	useBroker(t, sm)
+
+	server := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := client.NewClient(server.URL)
+	c.Publisher = "tester"
+	conn, err := c.Dial(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ch, err := conn.Subscribe(ctx, "motor:*")
+	require.NoError(t, err)
+
+	_, err = conn.Subscribe(ctx, "motor:*")
+	assert.Error(t, err, "already subscribed")
+
+	id, err := conn.Publish(ctx, "motor:left", []byte("0.5"), "text/plain")
+	require.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	e := receiveEvent(t, ch)
+	assert.Equal(t, id, e.ID)
+	assert.Equal(t, "motor:left", e.StreamName)
+	assert.Equal(t, "tester", e.Publisher)
+	assert.Equal(t, "text/plain", e.ContentType)
+	assert.Equal(t, "0.5", string(e.Data))
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := conn.Publish(ctx, "motor:*", []byte("1"), "text/plain")
+		assert.Error(t, err)
+
+		_, err = conn.Subscribe(ctx, "motor:#:x")
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid event", func(t *testing.T) {
+		schema, err := stream.ParseSchema([]byte(`{"type": "number"}`))
+		require.NoError(t, err)
+		sm.SetSchema("motor:right", stream.Registration{Schema: schema})
+
+		_, err = conn.Publish(ctx, "motor:right", []byte(`"fast"`), "application/json")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "motor:right")
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		require.NoError(t, conn.Unsubscribe(ctx, "motor:*"))
+
+		_, ok := <-ch
+		assert.False(t, ok)
+
+		assert.Error(t, conn.Unsubscribe(ctx, "motor:*"))
+	})
+}
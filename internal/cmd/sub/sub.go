@@ -2,6 +2,7 @@ package sub
 
 import (
 	"fmt"
+	"log/slog"
 
 	"github.com/rhettg/yakapi/client"
 )
@@ -14,6 +15,9 @@ func DoSub(serverURL string, streams []string) error {
 	}
 
 	for event := range eventChan {
+		if event.Dropped > 0 {
+			slog.Warn("missed events", "stream", event.StreamName, "dropped", event.Dropped)
+		}
 		fmt.Printf("%s: %s\n", event.StreamName, string(event.Data))
 	}
 	return nil
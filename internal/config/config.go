@@ -0,0 +1,507 @@
+// Package config is the server's configuration, read from a YAML file with
+// YAKAPI_* environment variables and command line flags overriding it.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rhettg/yakapi/internal/federation"
+	"github.com/rhettg/yakapi/internal/stream"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the server can be configured with.
+type Config struct {
+	// Name, Project and Operator identify the rover. Project and Operator
+	// are URLs for more information.
+	Name     string `yaml:"name,omitempty"`
+	Project  string `yaml:"project,omitempty"`
+	Operator string `yaml:"operator,omitempty"`
+
+	Port int `yaml:"port"`
+
+	SFC        SFC        `yaml:"sfc"`
+	MQTT       MQTT       `yaml:"mqtt"`
+	WebSocket  WebSocket  `yaml:"websocket"`
+	Streams    Streams    `yaml:"streams"`
+	Log        Log        `yaml:"log"`
+	Schemas    Schemas    `yaml:"schemas"`
+	Metrics    Metrics    `yaml:"metrics"`
+	GDS        GDS        `yaml:"gds"`
+	Federation Federation `yaml:"federation"`
+}
+
+// SFC is the listener for the control surface.
+type SFC struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"`
+}
+
+// MQTT is the MQTT listener.
+type MQTT struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"`
+}
+
+// DefaultWebSocketMaxMessageBytes bounds the messages WebSocket clients send.
+const DefaultWebSocketMaxMessageBytes = 1 << 20
+
+// WebSocket is the /v1/ws endpoint.
+type WebSocket struct {
+	// Origins are the origins, besides the server's own, that browsers may
+	// connect from, or "*" for any.
+	Origins []string `yaml:"origins,omitempty"`
+
+	MaxMessageBytes int64 `yaml:"max_message_bytes"`
+}
+
+// Streams configures streams by name or pattern. Those configured by the
+// server itself are always included.
+type Streams struct {
+	// Policies are delivery policies, such as "block:32".
+	Policies map[string]string `yaml:"policies"`
+
+	Retained []string            `yaml:"retained"`
+	Acked    []string            `yaml:"acked"`
+	TTLs     map[string]Duration `yaml:"ttls,omitempty"`
+
+	// IdleExpiry is how long a stream that has been published to is kept,
+	// with its replay buffer, once nothing is using it.
+	IdleExpiry Duration `yaml:"idle_expiry"`
+}
+
+// Log is the durable stream log, enabled by giving it a directory.
+type Log struct {
+	Dir      string   `yaml:"dir,omitempty"`
+	MaxBytes int64    `yaml:"max_bytes"`
+	MaxAge   Duration `yaml:"max_age"`
+}
+
+// Schemas are the stream schemas registered at startup.
+type Schemas struct {
+	Dir        string   `yaml:"dir,omitempty"`
+	DeadLetter []string `yaml:"dead_letter,omitempty"`
+}
+
+type Metrics struct {
+	// MaxStreams is how many streams get their own label.
+	MaxStreams int `yaml:"max_streams"`
+}
+
+// GDS is the YakGDS mission, enabled by giving its URL.
+type GDS struct {
+	URL string `yaml:"url,omitempty"`
+}
+
+// Federation mirrors streams with another instance, enabled by giving its
+// URL.
+type Federation struct {
+	URL  string   `yaml:"url,omitempty"`
+	Push []string `yaml:"push,omitempty"`
+	Pull []string `yaml:"pull,omitempty"`
+}
+
+// Rules parses the streams to push and pull into federation rules.
+func (f Federation) Rules() ([]federation.Rule, error) {
+	return federation.ParseRules(strings.Join(f.Push, ","), strings.Join(f.Pull, ","))
+}
+
+// Duration is a time.Duration written as a string such as "500ms".
+type Duration time.Duration
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	v, err := time.ParseDuration(n.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", n.Line, n.Value)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Default is the configuration when nothing else is given.
+func Default() Config {
+	return Config{
+		Port: 8080,
+		SFC:  SFC{Enabled: true, Port: 8765},
+		MQTT: MQTT{Port: 1883},
+		WebSocket: WebSocket{
+			MaxMessageBytes: DefaultWebSocketMaxMessageBytes,
+		},
+		Streams: Streams{
+			Policies: map[string]string{
+				// Only the latest control value matters
+				"sfc-control:*":     "drop-oldest",
+				"sfc-control-set:*": "drop-oldest",
+			},
+
+			// State rather than events
+			Retained: []string{"telemetry", "sfc-control:*"},
+
+			IdleExpiry: Duration(stream.DefaultIdleExpiry),
+		},
+		Log: Log{
+			MaxBytes: stream.DefaultLogMaxBytes,
+			MaxAge:   Duration(stream.DefaultLogMaxAge),
+		},
+		Metrics: Metrics{MaxStreams: stream.DefaultMetricsStreams},
+	}
+}
+
+// Load reads the configuration file at path over the defaults, if there is
+// one, then applies the environment.
+func Load(path string, getenv func(string) string) (Config, error) {
+	c := Default()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+
+		err = c.decode(b)
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	err := c.applyEnv(getenv)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// decode reads YAML over the configuration. A list or map it gives replaces
+// the one already set, such as the default, so an empty one clears it.
+func (c *Config) decode(b []byte) error {
+	// Maps would otherwise be decoded into, keeping what's already there
+	policies, ttls := c.Streams.Policies, c.Streams.TTLs
+	c.Streams.Policies, c.Streams.TTLs = nil, nil
+
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	err := d.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if c.Streams.Policies == nil {
+		c.Streams.Policies = policies
+	}
+	if c.Streams.TTLs == nil {
+		c.Streams.TTLs = ttls
+	}
+	return nil
+}
+
+// merge adds names to a list, skipping those already in it.
+func merge(list []string, names []string) []string {
+	out := slices.Clone(list)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != "" && !slices.Contains(out, name) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func splitList(s string) []string {
+	return merge(nil, strings.Split(s, ","))
+}
+
+// applyEnv overrides the configuration with the YAKAPI_* environment
+// variables that are set.
+func (c *Config) applyEnv(getenv func(string) string) error {
+	str := func(key string, dst *string) {
+		if v := getenv(key); v != "" {
+			*dst = v
+		}
+	}
+	var errs []error
+	port := func(key string, dst *int) bool {
+		v := getenv(key)
+		if v == "" {
+			return false
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %q", key, v))
+		}
+		*dst = n
+		return true
+	}
+
+	str("YAKAPI_NAME", &c.Name)
+	str("YAKAPI_PROJECT", &c.Project)
+	str("YAKAPI_PROJECT_URL", &c.Project)
+	str("YAKAPI_OPERATOR", &c.Operator)
+
+	port("YAKAPI_PORT", &c.Port)
+	port("YAKAPI_SFC_PORT", &c.SFC.Port)
+	if port("YAKAPI_MQTT_PORT", &c.MQTT.Port) {
+		c.MQTT.Enabled = true
+	}
+
+	if v := getenv("YAKAPI_SFC_ENABLED"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid YAKAPI_SFC_ENABLED: %q", v))
+		}
+		c.SFC.Enabled = b
+	}
+
+	if v := getenv("YAKAPI_WS_ORIGINS"); v != "" {
+		c.WebSocket.Origins = splitList(v)
+	}
+	if v := getenv("YAKAPI_WS_MAX_MESSAGE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid YAKAPI_WS_MAX_MESSAGE_BYTES: %q", v))
+		}
+		c.WebSocket.MaxMessageBytes = n
+	}
+
+	if v := getenv("YAKAPI_STREAM_POLICIES"); v != "" {
+		for _, item := range splitList(v) {
+			name, spec, ok := strings.Cut(item, "=")
+			if !ok || name == "" {
+				errs = append(errs, fmt.Errorf("invalid YAKAPI_STREAM_POLICIES: %q", item))
+				continue
+			}
+			if c.Streams.Policies == nil {
+				c.Streams.Policies = make(map[string]string)
+			}
+			c.Streams.Policies[name] = spec
+		}
+	}
+
+	c.Streams.Retained = merge(c.Streams.Retained, splitList(getenv("YAKAPI_RETAINED_STREAMS")))
+	c.Streams.Acked = merge(c.Streams.Acked, splitList(getenv("YAKAPI_ACKED_STREAMS")))
+
+	if v := getenv("YAKAPI_STREAM_TTLS"); v != "" {
+		ttls, err := stream.ParseTTLs(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid YAKAPI_STREAM_TTLS: %w", err))
+		}
+		for name, d := range ttls {
+			if c.Streams.TTLs == nil {
+				c.Streams.TTLs = make(map[string]Duration)
+			}
+			c.Streams.TTLs[name] = Duration(d)
+		}
+	}
+
+	if v := getenv("YAKAPI_STREAM_IDLE_EXPIRY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid YAKAPI_STREAM_IDLE_EXPIRY: %q", v))
+		}
+		c.Streams.IdleExpiry = Duration(d)
+	}
+
+	str("YAKAPI_DATA_DIR", &c.Log.Dir)
+	if v := getenv("YAKAPI_LOG_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid YAKAPI_LOG_MAX_BYTES: %q", v))
+		}
+		c.Log.MaxBytes = n
+	}
+	if v := getenv("YAKAPI_LOG_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid YAKAPI_LOG_MAX_AGE: %q", v))
+		}
+		c.Log.MaxAge = Duration(d)
+	}
+
+	str("YAKAPI_SCHEMA_DIR", &c.Schemas.Dir)
+	c.Schemas.DeadLetter = merge(c.Schemas.DeadLetter, splitList(getenv("YAKAPI_SCHEMA_DEAD_LETTER")))
+
+	if v := getenv("YAKAPI_METRICS_MAX_STREAMS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid YAKAPI_METRICS_MAX_STREAMS: %q", v))
+		}
+		c.Metrics.MaxStreams = n
+	}
+
+	str("YAKAPI_GDS_API_URL", &c.GDS.URL)
+
+	str("YAKAPI_FEDERATION_URL", &c.Federation.URL)
+	c.Federation.Push = merge(c.Federation.Push, splitList(getenv("YAKAPI_FEDERATION_PUSH")))
+	c.Federation.Pull = merge(c.Federation.Pull, splitList(getenv("YAKAPI_FEDERATION_PULL")))
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the configuration makes sense, reporting every problem
+// found.
+func (c Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	ports := map[string]int{"port": c.Port}
+	if c.SFC.Enabled {
+		ports["sfc.port"] = c.SFC.Port
+	}
+	if c.MQTT.Enabled {
+		ports["mqtt.port"] = c.MQTT.Port
+	}
+	used := make(map[int]string)
+	for _, key := range []string{"port", "sfc.port", "mqtt.port"} {
+		p, ok := ports[key]
+		if !ok {
+			continue
+		}
+		if p <= 0 || p > 65535 {
+			fail("%s: invalid port %d", key, p)
+		} else if other, ok := used[p]; ok {
+			fail("%s: port %d is already used by %s", key, p, other)
+		}
+		used[p] = key
+	}
+
+	if c.WebSocket.MaxMessageBytes <= 0 {
+		fail("websocket.max_message_bytes: must be positive")
+	}
+	for _, origin := range c.WebSocket.Origins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			fail("websocket.origins: invalid origin %q", origin)
+		}
+	}
+
+	for name, spec := range c.Streams.Policies {
+		checkPattern(fail, "streams.policies", name)
+		_, err := stream.ParsePolicy(spec)
+		if err != nil {
+			fail("streams.policies: %s: %v", name, err)
+		}
+	}
+	for _, name := range c.Streams.Retained {
+		checkPattern(fail, "streams.retained", name)
+	}
+	for _, name := range c.Streams.Acked {
+		if stream.IsPattern(name) {
+			fail("streams.acked: %q is a pattern, acked streams must be named", name)
+		}
+	}
+	for name, d := range c.Streams.TTLs {
+		checkPattern(fail, "streams.ttls", name)
+		if d <= 0 {
+			fail("streams.ttls: %s: must be positive", name)
+		}
+	}
+
+	if c.Log.MaxBytes < 0 {
+		fail("log.max_bytes: must not be negative")
+	}
+	if c.Log.MaxAge < 0 {
+		fail("log.max_age: must not be negative")
+	}
+
+	if len(c.Schemas.DeadLetter) > 0 && c.Schemas.Dir == "" {
+		fail("schemas.dead_letter: needs schemas.dir")
+	}
+
+	if c.Metrics.MaxStreams < 0 {
+		fail("metrics.max_streams: must not be negative")
+	}
+
+	if c.GDS.URL != "" {
+		checkURL(fail, "gds.url", c.GDS.URL)
+	}
+
+	if c.Federation.URL != "" {
+		checkURL(fail, "federation.url", c.Federation.URL)
+	} else if len(c.Federation.Push)+len(c.Federation.Pull) > 0 {
+		fail("federation: push and pull need federation.url")
+	}
+	if _, err := c.Federation.Rules(); err != nil {
+		fail("federation: %v", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkPattern(fail func(string, ...any), key, name string) {
+	if name == "" || (stream.IsPattern(name) && !stream.ValidPattern(name)) {
+		fail("%s: invalid stream or pattern %q", key, name)
+	}
+}
+
+func checkURL(fail func(string, ...any), key, s string) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("%s: invalid URL %q", key, Redact(s))
+	}
+}
+
+// redacted replaces secrets in the configuration.
+const redacted = "REDACTED"
+
+// Redact hides the password and query parameters of a URL, where credentials
+// are usually kept.
+func Redact(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+
+	q := u.Query()
+	for key := range q {
+		q.Set(key, redacted)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// Redacted is a copy of the configuration that's safe to show, with its
+// secrets replaced.
+func (c Config) Redacted() Config {
+	if c.GDS.URL != "" {
+		c.GDS.URL = Redact(c.GDS.URL)
+	}
+	if c.Federation.URL != "" {
+		c.Federation.URL = Redact(c.Federation.URL)
+	}
+	return c
+}
+
+// Show writes the configuration as YAML, with its secrets redacted.
+func Show(w io.Writer, c Config) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+
+	err := enc.Encode(c.Redacted())
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// Flags are the command line flags overriding the configuration file and
+// environment.
+type Flags struct {
+	cmd *cobra.Command
+
+	path     string
+	name     string
+	port     int
+	sfcPort  int
+	mqttPort int
+	dataDir  string
+}
+
+// AddFlags adds the configuration flags to a command.
+func AddFlags(cmd *cobra.Command) *Flags {
+	f := &Flags{cmd: cmd}
+
+	fs := cmd.Flags()
+	fs.StringVarP(&f.path, "config", "c", os.Getenv("YAKAPI_CONFIG"), "Configuration file")
+	fs.StringVar(&f.name, "name", "", "Name of the rover")
+	fs.IntVar(&f.port, "port", 0, "Port for the api server to listen on")
+	fs.IntVar(&f.sfcPort, "sfc-port", 0, "Port for the sfc server to listen on")
+	fs.IntVar(&f.mqttPort, "mqtt-port", 0, "Port for the MQTT listener, enabling it")
+	fs.StringVar(&f.dataDir, "data-dir", "", "Directory for durable stream logs")
+
+	return f
+}
+
+// Load loads the configuration file named by --config, or YAKAPI_CONFIG, then
+// applies the environment and any flags given, and validates the result.
+func (f *Flags) Load() (Config, error) {
+	c, err := Load(f.path, os.Getenv)
+	if err != nil {
+		return c, err
+	}
+
+	fs := f.cmd.Flags()
+	if fs.Changed("name") {
+		c.Name = f.name
+	}
+	if fs.Changed("port") {
+		c.Port = f.port
+	}
+	if fs.Changed("sfc-port") {
+		c.SFC.Port = f.sfcPort
+	}
+	if fs.Changed("mqtt-port") {
+		c.MQTT.Enabled = true
+		c.MQTT.Port = f.mqttPort
+	}
+	if fs.Changed("data-dir") {
+		c.Log.Dir = f.dataDir
+	}
+
+	return c, c.Validate()
+}
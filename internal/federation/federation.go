@@ -0,0 +1,464 @@
+// Package federation mirrors streams between YakAPI instances, such as the
+// rover and a ground station, pushing local streams to a remote instance and
+// pulling remote streams into the local broker.
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rhettg/yakapi/client"
+	"github.com/rhettg/yakapi/internal/stream"
+)
+
+const (
+	// DefaultMinBackoff and DefaultMaxBackoff bound how long a rule waits
+	// before reconnecting, doubling after each failure.
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+
+	// DefaultStatusInterval is how often link status is published.
+	DefaultStatusInterval = 10 * time.Second
+
+	// viaPrefix marks the publisher of events a link has mirrored, so they
+	// aren't mirrored back.
+	viaPrefix = "via:"
+
+	// maxPushBatch is how many events are pushed in one request.
+	maxPushBatch = 100
+
+	// pushBuffer is how many events a push rule holds while the remote is
+	// behind or down before the stream's policy drops them.
+	pushBuffer = 256
+)
+
+// Direction is which way a rule mirrors events.
+type Direction int
+
+const (
+	// Push mirrors local streams to the remote instance.
+	Push Direction = iota
+
+	// Pull mirrors remote streams into the local broker.
+	Pull
+)
+
+func (d Direction) String() string {
+	if d == Pull {
+		return "pull"
+	}
+	return "push"
+}
+
+// Rule mirrors a stream, or every stream matching a pattern, in one
+// direction.
+type Rule struct {
+	Direction Direction
+	Stream    string
+}
+
+// ParseRules reads comma separated lists of streams to push and pull, such
+// as "telemetry,eyes:*" and "ci".
+func ParseRules(push, pull string) ([]Rule, error) {
+	var rules []Rule
+	for _, dir := range []struct {
+		d     Direction
+		names string
+	}{{Push, push}, {Pull, pull}} {
+		for _, name := range strings.Split(dir.names, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !stream.ValidPattern(name) {
+				return nil, fmt.Errorf("invalid %s stream: %q", dir.d, name)
+			}
+			rules = append(rules, Rule{Direction: dir.d, Stream: name})
+		}
+	}
+	return rules, nil
+}
+
+// Link mirrors streams between the local broker and a remote instance.
+//
+// Events a link mirrors are published as "via:" and the name of where they
+// came from, and events published that way are never mirrored, so streams
+// may be pushed and pulled in both directions without looping. It follows
+// that events aren't relayed on through a second link.
+//
+// A rule that loses its connection reconnects with backoff. Pull rules resume
+// after the last event they mirrored, so nothing still in the remote's replay
+// buffer is missed. Push rules hold their local reader for the life of the
+// link, keeping the stream open and buffering what's published while the
+// remote is down.
+type Link struct {
+	Broker stream.Broker
+
+	// Remote is the base URL of the remote instance.
+	Remote string
+
+	// Name identifies this instance on events pushed to the remote.
+	Name string
+
+	Rules []Rule
+
+	// MinBackoff and MaxBackoff bound the wait before reconnecting. Zero
+	// means DefaultMinBackoff and DefaultMaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// StatusInterval is how often link status is published to the
+	// telemetry stream. Zero means DefaultStatusInterval.
+	StatusInterval time.Duration
+
+	mu     sync.Mutex
+	status Status
+	down   map[Rule]bool
+}
+
+// Status is the state of a link, as published to telemetry.
+type Status struct {
+	// Connected is 0 once any rule has lost its connection, until it
+	// mirrors an event again, otherwise 1.
+	Connected int `json:"federation_connected"`
+
+	Pushed     uint64 `json:"federation_pushed"`
+	Pulled     uint64 `json:"federation_pulled"`
+	Reconnects uint64 `json:"federation_reconnects"`
+}
+
+// Run mirrors events until ctx is done.
+func (l *Link) Run(ctx context.Context) error {
+	u, err := url.Parse(l.Remote)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid remote: %q", l.Remote)
+	}
+	if len(l.Rules) == 0 {
+		return errors.New("no rules")
+	}
+
+	l.mu.Lock()
+	l.down = make(map[Rule]bool)
+	l.mu.Unlock()
+
+	c := client.NewClient(strings.TrimSuffix(l.Remote, "/"))
+	c.Publisher = viaPrefix + l.Name
+
+	var wg sync.WaitGroup
+	for _, rule := range l.Rules {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rule.Direction == Pull {
+				l.retry(ctx, rule, func(since string) (string, error) {
+					return l.pull(ctx, c, rule.Stream, since, viaPrefix+u.Host)
+				})
+			} else {
+				p := l.newPusher(rule.Stream)
+				defer p.close()
+				l.retry(ctx, rule, func(since string) (string, error) {
+					return p.push(ctx, c, since)
+				})
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.report(ctx)
+	}()
+
+	slog.Info("federation link started", "remote", l.Remote, "rules", len(l.Rules))
+	wg.Wait()
+	return nil
+}
+
+// Status returns the link's current status.
+func (l *Link) Status() Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.status
+	if len(l.down) == 0 {
+		s.Connected = 1
+	}
+	return s
+}
+
+// retry runs a rule until ctx is done, each attempt resuming after the last
+// event mirrored by the one before.
+func (l *Link) retry(ctx context.Context, rule Rule, attempt func(since string) (string, error)) {
+	minBackoff, maxBackoff := l.MinBackoff, l.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	var since string
+	backoff := minBackoff
+	for {
+		last, err := attempt(since)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// An attempt that got anywhere starts the backoff over
+		if last != since {
+			since = last
+			backoff = minBackoff
+		}
+
+		slog.Warn("federation rule disconnected", "remote", l.Remote, "direction", rule.Direction, "stream", rule.Stream, "error", err, "retry", backoff)
+		l.setDown(rule, true)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+
+		l.mu.Lock()
+		l.status.Reconnects++
+		l.mu.Unlock()
+	}
+}
+
+func (l *Link) setDown(rule Rule, down bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if down {
+		l.down[rule] = true
+	} else {
+		delete(l.down, rule)
+	}
+}
+
+// pusher pushes a rule's local events to the remote, holding its reader, and
+// any batch the remote didn't take, between attempts.
+type pusher struct {
+	l     *Link
+	name  string
+	r     *stream.Reader
+	batch []client.Event
+	last  string
+}
+
+func (l *Link) newPusher(name string) *pusher {
+	p := &pusher{l: l, name: name}
+	p.r = l.Broker.GetReader(name, stream.ReaderOptions{BufferSize: pushBuffer})
+	return p
+}
+
+func (p *pusher) close() {
+	p.l.Broker.ReturnReader(p.name, p.r)
+}
+
+// push sends local events to the remote, starting with the batch a failed
+// attempt left, until it fails. It returns the ID of the last event pushed.
+func (p *pusher) push(ctx context.Context, c *client.Client, since string) (string, error) {
+	for {
+		if len(p.batch) == 0 {
+			err := p.read(ctx)
+			if err != nil || ctx.Err() != nil {
+				return since, err
+			}
+		}
+
+		for len(p.batch) > 0 {
+			_, err := c.PublishBatch(p.batch)
+			var berr *client.BatchError
+			if errors.As(err, &berr) {
+				// Like pulled events, those the remote refuses are dropped
+				// rather than holding up the rest
+				slog.Warn("dropping invalid pushed events", "remote", p.l.Remote, "events", len(berr.Invalid), "error", err)
+				p.batch = dropInvalid(p.batch, berr.Invalid)
+				continue
+			}
+			if err != nil {
+				return since, err
+			}
+			p.l.setDown(Rule{Push, p.name}, false)
+
+			p.l.mu.Lock()
+			p.l.status.Pushed += uint64(len(p.batch))
+			p.l.mu.Unlock()
+			p.batch = nil
+		}
+		since = p.last
+	}
+}
+
+// read waits for the next event to push, then takes whatever else is waiting
+// along with it.
+func (p *pusher) read(ctx context.Context) error {
+	select {
+	case e, ok := <-p.r.C:
+		if !ok {
+			p.reopen()
+			return errors.New("stream closed")
+		}
+		p.add(e)
+	case <-ctx.Done():
+		return nil
+	}
+
+	for len(p.batch) < maxPushBatch {
+		select {
+		case e, ok := <-p.r.C:
+			if !ok {
+				return nil
+			}
+			p.add(e)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (p *pusher) add(e stream.Event) {
+	p.batch = p.l.appendPush(p.batch, p.r, e)
+	p.last = e.ID.String()
+}
+
+// reopen replaces a reader whose stream was closed, resuming after the last
+// event read.
+func (p *pusher) reopen() {
+	p.close()
+
+	var opts stream.ReaderOptions
+	opts.BufferSize = pushBuffer
+	if p.last != "" {
+		opts.Since = ulid.MustParse(p.last)
+	}
+	p.r = p.l.Broker.GetReader(p.name, opts)
+}
+
+// dropInvalid removes the events at the given indexes from a batch.
+func dropInvalid(batch []client.Event, invalid map[int]string) []client.Event {
+	kept := batch[:0]
+	for i, e := range batch {
+		if _, ok := invalid[i]; !ok {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// appendPush adds an event read from r to a push batch unless it was mirrored
+// here or has expired. It keeps its time, and its whole TTL counted from then,
+// so it expires on the remote when it would here.
+func (l *Link) appendPush(batch []client.Event, r *stream.Reader, e stream.Event) []client.Event {
+	if strings.HasPrefix(e.Publisher, viaPrefix) {
+		return batch
+	}
+	e, ok := r.Fresh(e)
+	if !ok {
+		return batch
+	}
+
+	ce := client.Event{
+		StreamName:  e.Stream,
+		Time:        e.Time,
+		ContentType: e.ContentType,
+		Data:        e.Data,
+	}
+	if e.Expires != nil {
+		ce.TTL = e.Expires.Sub(e.Time).Seconds()
+	}
+	return append(batch, ce)
+}
+
+// pull publishes remote events locally, after the event with ID since if set,
+// until the subscription ends. It returns the ID of the last event pulled.
+func (l *Link) pull(ctx context.Context, c *client.Client, name, since, publisher string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan client.Event)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SubscribeSince(ctx, name, since, events)
+	}()
+
+	for {
+		select {
+		case ce := <-events:
+			since = ce.ID
+			l.setDown(Rule{Pull, name}, false)
+
+			if strings.HasPrefix(ce.Publisher, viaPrefix) {
+				continue
+			}
+
+			e := stream.NewEvent(ce.ContentType, ce.Data)
+			e.Time = ce.Time
+			e.Expires = ce.Expires
+			e.Publisher = publisher
+			if e.Expired(time.Now()) {
+				continue
+			}
+
+			err := l.Broker.Publish(ctx, ce.StreamName, e)
+			var verr *stream.ValidationError
+			if errors.As(err, &verr) {
+				slog.Warn("dropping invalid federated event", "remote", l.Remote, "error", err)
+				continue
+			}
+			if err != nil {
+				return since, err
+			}
+
+			l.mu.Lock()
+			l.status.Pulled++
+			l.mu.Unlock()
+		case err := <-done:
+			return since, err
+		}
+	}
+}
+
+// report publishes the link's status to the telemetry stream until ctx is
+// done.
+func (l *Link) report(ctx context.Context) {
+	interval := l.StatusInterval
+	if interval <= 0 {
+		interval = DefaultStatusInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			b, err := json.Marshal(l.Status())
+			if err != nil {
+				slog.Error("error encoding federation status", "error", err)
+				continue
+			}
+
+			e := stream.NewEvent("application/json", b)
+			e.Publisher = "federation"
+			err = l.Broker.Publish(ctx, "telemetry", e)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("error publishing federation status", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
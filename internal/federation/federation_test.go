@@ -0,0 +1,346 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rhettg/yakapi/client"
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// remote stands in for the remote instance, taking batches and serving
+// subscriptions from canned events, a nil event ending the subscription.
+type remote struct {
+	mu       sync.Mutex
+	fail     int
+	sinces   []string
+	serve    chan *client.Event
+	received chan pushed
+}
+
+type pushed struct {
+	Stream    string `json:"stream"`
+	Data      []byte `json:"data"`
+	TTL       string `json:"ttl"`
+	Publisher string `json:"-"`
+}
+
+func newRemote(t *testing.T) (*remote, *httptest.Server) {
+	rm := &remote{serve: make(chan *client.Event), received: make(chan pushed, 16)}
+
+	server := httptest.NewServer(rm)
+	t.Cleanup(server.Close)
+	t.Cleanup(server.CloseClientConnections)
+
+	return rm, server
+}
+
+// failing has the next n requests fail.
+func (rm *remote) failing(n int) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.fail = n
+}
+
+func (rm *remote) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rm.mu.Lock()
+	if r.Method == http.MethodGet {
+		rm.sinces = append(rm.sinces, r.URL.Query().Get("since"))
+	}
+	fail := rm.fail > 0
+	if fail {
+		rm.fail--
+	}
+	rm.mu.Unlock()
+
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error": "unavailable"}`))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/batch":
+		var items []pushed
+		json.NewDecoder(r.Body).Decode(&items)
+
+		// Like a schema, refuse the whole batch over any "invalid" event
+		results := make([]map[string]string, len(items))
+		refused := false
+		for i, item := range items {
+			results[i] = map[string]string{}
+			if string(item.Data) == "invalid" {
+				results[i]["error"] = "invalid"
+				refused = true
+			}
+		}
+		if refused {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]any{"error": "invalid events", "results": results})
+			return
+		}
+
+		for i, item := range items {
+			item.Publisher = r.Header.Get("X-Yakapi-Publisher")
+			rm.received <- item
+			results[i] = map[string]string{"id": ulid.Make().String()}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"results": results})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/stream/"):
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case e := <-rm.serve:
+				if e == nil {
+					return
+				}
+				json.NewEncoder(w).Encode(e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (rm *remote) lastSince() []string {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return append([]string(nil), rm.sinces...)
+}
+
+func receive[T any](t *testing.T, c <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out")
+		var zero T
+		return zero
+	}
+}
+
+func runLink(t *testing.T, l *Link) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, l.Run(ctx))
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("telemetry, eyes/*", "ci")
+	require.NoError(t, err)
+	assert.Equal(t, []Rule{{Push, "telemetry"}, {Push, "eyes/*"}, {Pull, "ci"}}, rules)
+
+	_, err = ParseRules("eyes:#:front", "")
+	assert.Error(t, err)
+}
+
+func TestPush(t *testing.T) {
+	sm := stream.NewManager()
+	rm, server := newRemote(t)
+
+	runLink(t, &Link{
+		Broker:     sm,
+		Remote:     server.URL,
+		Name:       "rover",
+		Rules:      []Rule{{Push, "eyes:*"}},
+		MinBackoff: 10 * time.Millisecond,
+	})
+
+	// Wait for the link to subscribe
+	r := sm.GetReader("eyes:front", stream.ReaderOptions{})
+	defer sm.ReturnReader("eyes:front", r)
+	require.Eventually(t, func() bool {
+		info, ok := sm.Stream("eyes:front")
+		return ok && info.Readers > 1
+	}, time.Second, time.Millisecond)
+
+	publish := func(name, publisher, data string) {
+		e := stream.NewEvent("text/plain", []byte(data))
+		e.Publisher = publisher
+		require.NoError(t, sm.Publish(context.Background(), name, e))
+	}
+
+	publish("eyes:front", "", "1")
+	p := receive(t, rm.received)
+	assert.Equal(t, "eyes:front", p.Stream)
+	assert.Equal(t, "1", string(p.Data))
+	assert.Equal(t, "via:rover", p.Publisher)
+
+	t.Run("no loops", func(t *testing.T) {
+		publish("eyes:front", "via:ground", "mirrored")
+		publish("eyes:front", "", "2")
+		assert.Equal(t, "2", string(receive(t, rm.received).Data))
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		e := stream.NewEvent("text/plain", []byte("ttl"))
+		e.Time = time.Now().Add(-10 * time.Second)
+		e.SetTTL(time.Minute)
+		require.NoError(t, sm.Publish(context.Background(), "eyes:front", e))
+
+		p := receive(t, rm.received)
+		assert.Equal(t, "ttl", string(p.Data))
+		assert.Equal(t, "1m0s", p.TTL, "counted from the event's time")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		// Pushed together so the remote refuses them as one batch
+		events := []stream.Event{
+			stream.NewEvent("text/plain", []byte("invalid")),
+			stream.NewEvent("text/plain", []byte("valid")),
+		}
+		for i := range events {
+			events[i].Stream = "eyes:front"
+		}
+		err := sm.PublishBatch(context.Background(), events)
+		require.NoError(t, err)
+
+		assert.Equal(t, "valid", string(receive(t, rm.received).Data))
+
+		publish("eyes:front", "", "next")
+		assert.Equal(t, "next", string(receive(t, rm.received).Data))
+	})
+
+	t.Run("resumes", func(t *testing.T) {
+		rm.failing(2)
+		publish("eyes:front", "", "3")
+		publish("eyes:front", "", "4")
+
+		assert.Equal(t, "3", string(receive(t, rm.received).Data))
+		assert.Equal(t, "4", string(receive(t, rm.received).Data))
+	})
+}
+
+func TestPushRemoteDown(t *testing.T) {
+	sm := stream.NewManager()
+	rm, server := newRemote(t)
+
+	l := &Link{
+		Broker:     sm,
+		Remote:     server.URL,
+		Name:       "rover",
+		Rules:      []Rule{{Push, "telemetry"}},
+		MinBackoff: 10 * time.Millisecond,
+	}
+	runLink(t, l)
+
+	// The link is the stream's only reader
+	require.Eventually(t, func() bool {
+		info, ok := sm.Stream("telemetry")
+		return ok && info.Readers == 1
+	}, time.Second, time.Millisecond)
+
+	publish := func(data string) {
+		e := stream.NewEvent("text/plain", []byte(data))
+		require.NoError(t, sm.Publish(context.Background(), "telemetry", e))
+	}
+
+	publish("1")
+	assert.Equal(t, "1", string(receive(t, rm.received).Data))
+
+	rm.failing(3)
+	publish("2")
+
+	// Published while the link backs off, and held by its reader
+	require.Eventually(t, func() bool {
+		return l.Status().Reconnects > 0
+	}, time.Second, time.Millisecond)
+	info, ok := sm.Stream("telemetry")
+	require.True(t, ok)
+	assert.Equal(t, 1, info.Readers)
+	publish("3")
+
+	assert.Equal(t, "2", string(receive(t, rm.received).Data))
+	assert.Equal(t, "3", string(receive(t, rm.received).Data))
+}
+
+func TestPull(t *testing.T) {
+	sm := stream.NewManager()
+	rm, server := newRemote(t)
+	rm.failing(1)
+
+	r := sm.GetReader("ci", stream.ReaderOptions{})
+	defer sm.ReturnReader("ci", r)
+
+	l := &Link{
+		Broker:     sm,
+		Remote:     server.URL,
+		Name:       "rover",
+		Rules:      []Rule{{Pull, "ci"}},
+		MinBackoff: 10 * time.Millisecond,
+	}
+	runLink(t, l)
+
+	first := client.Event{ID: ulid.Make().String(), StreamName: "ci", Time: time.Now(), ContentType: "text/plain", Data: []byte("fwd")}
+	rm.serve <- &first
+	rm.serve <- &client.Event{ID: ulid.Make().String(), StreamName: "ci", Publisher: "via:rover", ContentType: "text/plain", Data: []byte("mirrored")}
+
+	e := receive(t, r.C)
+	assert.Equal(t, "fwd", string(e.Data))
+	assert.Equal(t, first.Time.UnixNano(), e.Time.UnixNano())
+	assert.True(t, strings.HasPrefix(e.Publisher, "via:127.0.0.1"))
+
+	// The remote going away is resumed from the last event seen
+	last := ulid.Make().String()
+	rm.serve <- &client.Event{ID: last, StreamName: "ci", Publisher: "via:rover", Data: []byte("mirrored")}
+	rm.serve <- nil
+
+	rm.serve <- &client.Event{ID: ulid.Make().String(), StreamName: "ci", ContentType: "text/plain", Data: []byte("stop")}
+	assert.Equal(t, "stop", string(receive(t, r.C).Data))
+	assert.Equal(t, []string{"", "", last}, rm.lastSince())
+
+	status := l.Status()
+	assert.Equal(t, 1, status.Connected)
+	assert.Equal(t, uint64(2), status.Pulled)
+	assert.Equal(t, uint64(2), status.Reconnects)
+}
+
+func TestStatus(t *testing.T) {
+	sm := stream.NewManager()
+	_, server := newRemote(t)
+	server.Close()
+
+	r := sm.GetReader("telemetry", stream.ReaderOptions{})
+	defer sm.ReturnReader("telemetry", r)
+
+	runLink(t, &Link{
+		Broker:         sm,
+		Remote:         server.URL,
+		Rules:          []Rule{{Pull, "ci"}},
+		MinBackoff:     10 * time.Millisecond,
+		StatusInterval: 20 * time.Millisecond,
+	})
+
+	for {
+		var status Status
+		require.NoError(t, json.Unmarshal(receive(t, r.C).Data, &status))
+		if status.Reconnects > 0 {
+			assert.Equal(t, 0, status.Connected)
+			return
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types, from the MQTT 3.1.1 specification.
+const (
+	typeConnect     byte = 1
+	typeConnack     byte = 2
+	typePublish     byte = 3
+	typePuback      byte = 4
+	typeSubscribe   byte = 8
+	typeSuback      byte = 9
+	typeUnsubscribe byte = 10
+	typeUnsuback    byte = 11
+	typePingreq     byte = 12
+	typePingresp    byte = 13
+	typeDisconnect  byte = 14
+)
+
+// CONNACK return codes, and the SUBACK code for a refused subscription.
+const (
+	connAccepted           byte = 0
+	connBadProtocolVersion byte = 1
+	connIdentifierRejected byte = 2
+	subscribeFailure       byte = 0x80
+)
+
+const (
+	// protocolLevel is MQTT 3.1.1.
+	protocolLevel byte = 4
+
+	// PUBLISH flags.
+	flagDup    byte = 0x08
+	flagRetain byte = 0x01
+
+	// maxLengthBytes is how long the remaining length of a packet may be.
+	maxLengthBytes = 4
+)
+
+var errMalformed = errors.New("malformed packet")
+
+// packet is a control packet as read off the wire: its type, the flags in
+// the low bits of the first byte, and everything after the remaining length.
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads a packet, refusing any larger than max.
+func readPacket(r *bufio.Reader, max int) (packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	var length, shift int
+	for i := 0; ; i++ {
+		if i == maxLengthBytes {
+			return packet{}, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > max {
+		return packet{}, fmt.Errorf("packet of %d bytes exceeds limit of %d", length, max)
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return packet{}, err
+	}
+
+	return packet{typ: first >> 4, flags: first & 0x0f, body: body}, nil
+}
+
+// encodePacket frames a packet body with its fixed header.
+func encodePacket(typ, flags byte, body []byte) []byte {
+	b := make([]byte, 0, 5+len(body))
+	b = append(b, typ<<4|flags)
+
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			break
+		}
+	}
+
+	return append(b, body...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// decoder reads the fields of a packet body, remembering the first error so
+// it only needs checking once at the end.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.b) < 1 {
+		d.err = errMalformed
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.b) < 2 {
+		d.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if d.err != nil || len(d.b) < n {
+		d.err = errMalformed
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// connectPacket is a client's CONNECT. Usernames and passwords are read but
+// not checked.
+type connectPacket struct {
+	protocol  string
+	level     byte
+	clean     bool
+	keepAlive uint16
+	clientID  string
+	will      *publishPacket
+	username  string
+	password  []byte
+}
+
+func parseConnect(p packet) (connectPacket, error) {
+	var c connectPacket
+	d := decoder{b: p.body}
+
+	c.protocol = d.string()
+	c.level = d.byte()
+	flags := d.byte()
+	c.keepAlive = d.uint16()
+	c.clientID = d.string()
+
+	c.clean = flags&0x02 != 0
+	if flags&0x04 != 0 {
+		c.will = &publishPacket{
+			qos:    (flags >> 3) & 0x03,
+			retain: flags&0x20 != 0,
+		}
+		c.will.topic = d.string()
+		c.will.payload = d.bytes()
+	}
+	if flags&0x80 != 0 {
+		c.username = d.string()
+	}
+	if flags&0x40 != 0 {
+		c.password = d.bytes()
+	}
+
+	if d.err != nil {
+		return c, d.err
+	}
+	if flags&0x01 != 0 {
+		return c, errMalformed
+	}
+	return c, nil
+}
+
+func encodeConnack(sessionPresent bool, code byte) []byte {
+	var ack byte
+	if sessionPresent {
+		ack = 1
+	}
+	return encodePacket(typeConnack, 0, []byte{ack, code})
+}
+
+// publishPacket is a PUBLISH, in either direction. The packet ID is only
+// present at QoS 1 and above.
+type publishPacket struct {
+	topic   string
+	id      uint16
+	qos     byte
+	retain  bool
+	dup     bool
+	payload []byte
+}
+
+func parsePublish(p packet) (publishPacket, error) {
+	pub := publishPacket{
+		qos:    (p.flags >> 1) & 0x03,
+		retain: p.flags&flagRetain != 0,
+		dup:    p.flags&flagDup != 0,
+	}
+
+	d := decoder{b: p.body}
+	pub.topic = d.string()
+	if pub.qos > 0 {
+		pub.id = d.uint16()
+	}
+	if d.err != nil {
+		return pub, d.err
+	}
+	pub.payload = d.b
+
+	return pub, nil
+}
+
+func (pub publishPacket) encode() []byte {
+	flags := pub.qos << 1
+	if pub.retain {
+		flags |= flagRetain
+	}
+	if pub.dup {
+		flags |= flagDup
+	}
+
+	b := make([]byte, 0, 4+len(pub.topic)+len(pub.payload))
+	b = appendString(b, pub.topic)
+	if pub.qos > 0 {
+		b = binary.BigEndian.AppendUint16(b, pub.id)
+	}
+	b = append(b, pub.payload...)
+
+	return encodePacket(typePublish, flags, b)
+}
+
+// encodeID encodes the packets that are nothing but a packet ID, such as
+// PUBACK.
+func encodeID(typ byte, id uint16) []byte {
+	return encodePacket(typ, 0, binary.BigEndian.AppendUint16(nil, id))
+}
+
+func parseID(p packet) (uint16, error) {
+	d := decoder{b: p.body}
+	id := d.uint16()
+	return id, d.err
+}
+
+// subscription is one topic filter of a SUBSCRIBE, with the QoS asked for.
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+func parseSubscribe(p packet) (uint16, []subscription, error) {
+	if p.flags != 0x02 {
+		return 0, nil, errMalformed
+	}
+
+	d := decoder{b: p.body}
+	id := d.uint16()
+
+	var subs []subscription
+	for d.err == nil && len(d.b) > 0 {
+		filter := d.string()
+		qos := d.byte()
+		subs = append(subs, subscription{filter: filter, qos: qos})
+	}
+
+	if d.err != nil || len(subs) == 0 {
+		return 0, nil, errMalformed
+	}
+	return id, subs, nil
+}
+
+func encodeSuback(id uint16, codes []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	return encodePacket(typeSuback, 0, append(b, codes...))
+}
+
+func parseUnsubscribe(p packet) (uint16, []string, error) {
+	if p.flags != 0x02 {
+		return 0, nil, errMalformed
+	}
+
+	d := decoder{b: p.body}
+	id := d.uint16()
+
+	var filters []string
+	for d.err == nil && len(d.b) > 0 {
+		filters = append(filters, d.string())
+	}
+
+	if d.err != nil || len(filters) == 0 {
+		return 0, nil, errMalformed
+	}
+	return id, filters, nil
+}
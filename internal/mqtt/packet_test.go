@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Encoders for the packets only clients send, for the tests to act as one.
+
+func (c connectPacket) encode() []byte {
+	var flags byte
+	if c.clean {
+		flags |= 0x02
+	}
+	if c.will != nil {
+		flags |= 0x04 | c.will.qos<<3
+		if c.will.retain {
+			flags |= 0x20
+		}
+	}
+	if c.username != "" {
+		flags |= 0x80
+	}
+	if c.password != nil {
+		flags |= 0x40
+	}
+
+	b := appendString(nil, c.protocol)
+	b = append(b, c.level, flags)
+	b = binary.BigEndian.AppendUint16(b, c.keepAlive)
+	b = appendString(b, c.clientID)
+	if c.will != nil {
+		b = appendString(b, c.will.topic)
+		b = appendString(b, string(c.will.payload))
+	}
+	if c.username != "" {
+		b = appendString(b, c.username)
+	}
+	if c.password != nil {
+		b = appendString(b, string(c.password))
+	}
+
+	return encodePacket(typeConnect, 0, b)
+}
+
+func encodeSubscribe(id uint16, subs []subscription) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	for _, s := range subs {
+		b = appendString(b, s.filter)
+		b = append(b, s.qos)
+	}
+	return encodePacket(typeSubscribe, 0x02, b)
+}
+
+func encodeUnsubscribe(id uint16, filters []string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	for _, f := range filters {
+		b = appendString(b, f)
+	}
+	return encodePacket(typeUnsubscribe, 0x02, b)
+}
+
+func TestRemainingLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097152} {
+		b := encodePacket(typePublish, 0, make([]byte, n))
+
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(b)), DefaultMaxPacketSize)
+		require.NoError(t, err, n)
+		assert.Equal(t, typePublish, p.typ)
+		assert.Len(t, p.body, n)
+	}
+
+	_, err := readPacket(bufio.NewReader(bytes.NewReader(encodePacket(typePublish, 0, make([]byte, 100)))), 99)
+	assert.Error(t, err, "too large")
+
+	_, err = readPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})), DefaultMaxPacketSize)
+	assert.ErrorIs(t, err, errMalformed)
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	read := func(b []byte) packet {
+		t.Helper()
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(b)), DefaultMaxPacketSize)
+		require.NoError(t, err)
+		return p
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		c := connectPacket{
+			protocol:  "MQTT",
+			level:     protocolLevel,
+			clean:     true,
+			keepAlive: 30,
+			clientID:  "rover",
+			will:      &publishPacket{topic: "status", qos: 1, retain: true, payload: []byte("offline")},
+			username:  "yak",
+			password:  []byte("secret"),
+		}
+
+		got, err := parseConnect(read(c.encode()))
+		require.NoError(t, err)
+		assert.Equal(t, c, got)
+	})
+
+	t.Run("publish", func(t *testing.T) {
+		pub := publishPacket{topic: "motor/a", id: 7, qos: 1, retain: true, dup: true, payload: []byte{0, 1, 2}}
+
+		got, err := parsePublish(read(pub.encode()))
+		require.NoError(t, err)
+		assert.Equal(t, pub, got)
+	})
+
+	t.Run("subscribe", func(t *testing.T) {
+		subs := []subscription{{"sfc-control/+", 1}, {"telemetry", 0}}
+
+		id, got, err := parseSubscribe(read(encodeSubscribe(3, subs)))
+		require.NoError(t, err)
+		assert.Equal(t, uint16(3), id)
+		assert.Equal(t, subs, got)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		_, err := parsePublish(packet{typ: typePublish, flags: 0x02, body: []byte{0, 5, 'a'}})
+		assert.ErrorIs(t, err, errMalformed)
+	})
+}
+
+func TestTopics(t *testing.T) {
+	assert.Equal(t, "sfc-control:A", streamName("sfc-control/A"))
+	assert.Equal(t, "sfc-control/A", topicName("sfc-control:A"))
+
+	assert.NoError(t, checkFilter("sfc-control/+"))
+	assert.NoError(t, checkFilter("#"))
+	assert.Error(t, checkFilter("eyes/#/front"))
+	assert.Error(t, checkFilter("eyes/fr+"))
+	assert.Error(t, checkFilter("eyes/*"))
+	assert.Error(t, checkFilter("eyes/front*"))
+
+	assert.NoError(t, checkTopic("telemetry"))
+	assert.Error(t, checkTopic("telemetry/+"))
+	assert.Error(t, checkTopic("telemetry/*"))
+	assert.Error(t, checkTopic(""))
+}
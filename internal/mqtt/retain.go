@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/rhettg/yakapi/internal/stream"
+)
+
+// maxRetained bounds how many topics may have a retained message.
+const maxRetained = 1024
+
+// retainedStore keeps the last retained message published to each topic.
+// It's MQTT's own, so clients can't change which streams retain their events.
+type retainedStore struct {
+	mu       sync.Mutex
+	messages map[string]publishPacket
+}
+
+// set keeps a retained message for its topic, or with an empty payload
+// forgets the topic's. It returns false if there's no room for another topic.
+func (rs *retainedStore) set(pub publishPacket) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if len(pub.payload) == 0 {
+		delete(rs.messages, pub.topic)
+		return true
+	}
+
+	if rs.messages == nil {
+		rs.messages = make(map[string]publishPacket)
+	}
+	if _, ok := rs.messages[pub.topic]; !ok && len(rs.messages) >= maxRetained {
+		return false
+	}
+
+	rs.messages[pub.topic] = publishPacket{
+		topic:   pub.topic,
+		qos:     pub.qos,
+		retain:  true,
+		payload: bytes.Clone(pub.payload),
+	}
+	return true
+}
+
+// matching returns the retained messages for the topics matching a filter,
+// in topic order.
+func (rs *retainedStore) matching(filter string) []publishPacket {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	pattern := streamName(filter)
+	var pubs []publishPacket
+	for topic, pub := range rs.messages {
+		if stream.Match(pattern, streamName(topic)) {
+			pubs = append(pubs, pub)
+		}
+	}
+
+	sort.Slice(pubs, func(i, j int) bool {
+		return pubs[i].topic < pubs[j].topic
+	})
+	return pubs
+}
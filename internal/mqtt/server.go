@@ -0,0 +1,601 @@
+// Package mqtt is an MQTT 3.1.1 broker listener mapping topics onto streams,
+// so devices with an MQTT client can publish and subscribe natively.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rhettg/yakapi/internal/stream"
+)
+
+const (
+	// DefaultMaxPacketSize bounds the packets clients may send.
+	DefaultMaxPacketSize = 4 << 20
+
+	// DefaultRetryInterval is how long a QoS 1 delivery waits for its
+	// PUBACK before it's sent again.
+	DefaultRetryInterval = 10 * time.Second
+
+	// maxInflight is how many QoS 1 deliveries a client may have unacked
+	// before its subscriptions wait.
+	maxInflight = 32
+
+	connectTimeout = 10 * time.Second
+	writeTimeout   = 10 * time.Second
+	outBuffer      = 64
+)
+
+// Server accepts MQTT clients, mapping what they publish and subscribe to
+// onto the broker's streams:
+//
+//   - QoS 0 and 1 are supported both ways. A QoS 1 publish is acked once the
+//     stream has taken it, and a QoS 1 delivery is sent again until it's
+//     acked. Subscriptions asking for QoS 2 are granted QoS 1.
+//   - A retained publish is kept as its topic's retained message, and a
+//     retained publish with an empty payload clears it. Subscribers receive
+//     the retained messages, and the retained events of streams that retain
+//     them, flagged as retained, when they subscribe.
+//   - A client's last will is published if it goes away without
+//     disconnecting.
+//
+// Sessions aren't kept once a client disconnects.
+type Server struct {
+	Broker stream.Broker
+
+	// MaxPacketSize bounds the packets clients may send. Zero means
+	// DefaultMaxPacketSize.
+	MaxPacketSize int
+
+	// RetryInterval is how long a QoS 1 delivery waits for its PUBACK
+	// before it's sent again. Zero means DefaultRetryInterval.
+	RetryInterval time.Duration
+
+	retained retainedStore
+}
+
+// ListenAndServe listens on addr and serves MQTT clients until ctx is done.
+func ListenAndServe(ctx context.Context, addr string, b stream.Broker) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &Server{Broker: b}
+	return srv.Serve(ctx, l)
+}
+
+// Serve accepts connections on l until ctx is done, then closes every
+// connection and returns once they're finished.
+func (srv *Server) Serve(ctx context.Context, l net.Listener) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.serveConn(ctx, conn)
+		}()
+	}
+}
+
+func (srv *Server) maxPacketSize() int {
+	if srv.MaxPacketSize > 0 {
+		return srv.MaxPacketSize
+	}
+	return DefaultMaxPacketSize
+}
+
+func (srv *Server) retryInterval() time.Duration {
+	if srv.RetryInterval > 0 {
+		return srv.RetryInterval
+	}
+	return DefaultRetryInterval
+}
+
+func (srv *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(r, srv.maxPacketSize())
+	if err != nil || p.typ != typeConnect {
+		slog.Debug("mqtt client didn't connect", "addr", conn.RemoteAddr(), "error", err)
+		return
+	}
+
+	c, err := parseConnect(p)
+	if err != nil {
+		slog.Debug("invalid mqtt connect", "addr", conn.RemoteAddr(), "error", err)
+		return
+	}
+
+	if c.protocol != "MQTT" || c.level != protocolLevel {
+		slog.Warn("unsupported mqtt protocol", "addr", conn.RemoteAddr(), "protocol", c.protocol, "level", c.level)
+		conn.Write(encodeConnack(false, connBadProtocolVersion))
+		return
+	}
+
+	if c.clientID == "" {
+		if !c.clean {
+			conn.Write(encodeConnack(false, connIdentifierRejected))
+			return
+		}
+		c.clientID = ulid.Make().String()
+	}
+
+	if c.will != nil {
+		if err := checkTopic(c.will.topic); err != nil || c.will.qos > 1 {
+			slog.Warn("invalid mqtt last will", "client_id", c.clientID, "topic", c.will.topic)
+			return
+		}
+	}
+
+	s := &session{
+		srv:      srv,
+		conn:     conn,
+		clientID: c.clientID,
+		out:      make(chan []byte, outBuffer),
+		subs:     make(map[string]*subscriber),
+		inflight: make(map[uint16]*delivery),
+		slots:    make(chan struct{}, maxInflight),
+	}
+	s.run(ctx, r, c)
+}
+
+// session is a connected client.
+type session struct {
+	srv      *Server
+	conn     net.Conn
+	clientID string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// out holds packets for the writer
+	out chan []byte
+
+	// subs is only used by the read loop
+	subs map[string]*subscriber
+
+	// inflight holds QoS 1 deliveries waiting for their PUBACK, each holding
+	// one of the slots
+	mu       sync.Mutex
+	nextID   uint16
+	inflight map[uint16]*delivery
+	slots    chan struct{}
+
+	wg sync.WaitGroup
+}
+
+// subscriber delivers a stream, or pattern, to the client once it's started.
+type subscriber struct {
+	name string
+	qos  byte
+	r    *stream.Reader
+
+	// replayed counts the events waiting when it subscribed, which hold the
+	// retained events
+	replayed int
+
+	// retained holds the retained messages to send before any events
+	retained []publishPacket
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type delivery struct {
+	pub  publishPacket
+	sent time.Time
+}
+
+func (s *session) run(ctx context.Context, r *bufio.Reader, c connectPacket) {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	defer s.cancel()
+
+	// Closing the connection is what stops the read loop
+	stop := context.AfterFunc(s.ctx, func() {
+		s.conn.Close()
+	})
+	defer stop()
+
+	s.wg.Add(2)
+	go s.write()
+	go s.retry()
+
+	s.send(encodeConnack(false, connAccepted))
+	slog.Info("mqtt client connected", "client_id", s.clientID, "addr", s.conn.RemoteAddr(), "keep_alive", c.keepAlive)
+
+	clean := s.read(r, time.Duration(c.keepAlive)*time.Second)
+
+	for filter := range s.subs {
+		s.unsubscribe(filter)
+	}
+	s.cancel()
+	s.wg.Wait()
+
+	slog.Info("mqtt client disconnected", "client_id", s.clientID, "clean", clean)
+
+	if !clean && c.will != nil {
+		err := s.publish(ctx, *c.will)
+		if err != nil {
+			slog.Error("error publishing mqtt last will", "client_id", s.clientID, "topic", c.will.topic, "error", err)
+		}
+	}
+}
+
+// read handles packets until the connection ends, reporting whether the
+// client disconnected cleanly.
+func (s *session) read(r *bufio.Reader, keepAlive time.Duration) bool {
+	for {
+		// Clients get half as long again as they said they'd be quiet for
+		var deadline time.Time
+		if keepAlive > 0 {
+			deadline = time.Now().Add(keepAlive * 3 / 2)
+		}
+		s.conn.SetReadDeadline(deadline)
+
+		p, err := readPacket(r, s.srv.maxPacketSize())
+		if err != nil {
+			if s.ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				slog.Warn("error reading from mqtt client", "client_id", s.clientID, "error", err)
+			}
+			return false
+		}
+
+		switch p.typ {
+		case typePublish:
+			err = s.handlePublish(p)
+		case typePuback:
+			err = s.handlePuback(p)
+		case typeSubscribe:
+			err = s.handleSubscribe(p)
+		case typeUnsubscribe:
+			err = s.handleUnsubscribe(p)
+		case typePingreq:
+			s.send(encodePacket(typePingresp, 0, nil))
+		case typeDisconnect:
+			return true
+		default:
+			err = fmt.Errorf("unsupported packet type %d", p.typ)
+		}
+
+		if err != nil {
+			slog.Warn("closing mqtt connection", "client_id", s.clientID, "error", err)
+			return false
+		}
+	}
+}
+
+func (s *session) write() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case b := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := s.conn.Write(b)
+			if err != nil {
+				s.cancel()
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// send queues a packet for the writer, returning false if the session ended
+// first.
+func (s *session) send(b []byte) bool {
+	return s.sendContext(s.ctx, b)
+}
+
+func (s *session) sendContext(ctx context.Context, b []byte) bool {
+	select {
+	case s.out <- b:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *session) handlePublish(p packet) error {
+	pub, err := parsePublish(p)
+	if err != nil {
+		return err
+	}
+	if pub.qos > 1 {
+		return errors.New("QoS 2 is not supported")
+	}
+	err = checkTopic(pub.topic)
+	if err != nil {
+		return err
+	}
+
+	err = s.publish(s.ctx, pub)
+	var verr *stream.ValidationError
+	if errors.As(err, &verr) {
+		// MQTT 3.1.1 has no way to refuse a message, so drop it
+		slog.Warn("dropping invalid mqtt message", "client_id", s.clientID, "topic", pub.topic, "error", err)
+	} else if err != nil {
+		return err
+	}
+
+	if pub.qos == 1 {
+		s.send(encodeID(typePuback, pub.id))
+	}
+	return nil
+}
+
+// publish publishes a message to the stream its topic maps to. A retained
+// message is only kept once the stream has taken it.
+func (s *session) publish(ctx context.Context, pub publishPacket) error {
+	name := streamName(pub.topic)
+
+	if pub.retain && len(pub.payload) == 0 {
+		s.srv.retained.set(pub)
+		return nil
+	}
+
+	e := stream.NewEvent(contentType(pub.payload), pub.payload)
+	e.Publisher = s.clientID
+	err := s.srv.Broker.Publish(ctx, name, e)
+	if err != nil {
+		return err
+	}
+
+	if pub.retain && !s.srv.retained.set(pub) {
+		slog.Warn("not retaining mqtt message, too many retained topics", "client_id", s.clientID, "topic", pub.topic)
+	}
+	return nil
+}
+
+// contentType guesses the content type of a payload, as MQTT 3.1.1 doesn't
+// carry one.
+func contentType(payload []byte) string {
+	switch {
+	case json.Valid(payload):
+		return "application/json"
+	case utf8.Valid(payload):
+		return "text/plain"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func (s *session) handlePuback(p packet) error {
+	id, err := parseID(p)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.inflight[id]; ok {
+		delete(s.inflight, id)
+		<-s.slots
+	}
+	return nil
+}
+
+func (s *session) handleSubscribe(p packet) error {
+	id, subs, err := parseSubscribe(p)
+	if err != nil {
+		return err
+	}
+
+	codes := make([]byte, len(subs))
+	for i, sub := range subs {
+		err := checkFilter(sub.filter)
+		if err != nil || sub.qos > 2 {
+			slog.Warn("refusing mqtt subscription", "client_id", s.clientID, "filter", sub.filter, "error", err)
+			codes[i] = subscribeFailure
+			continue
+		}
+
+		codes[i] = min(sub.qos, 1)
+		s.subscribe(sub.filter, codes[i])
+	}
+
+	// Ack before delivering anything, retained events included
+	s.send(encodeSuback(id, codes))
+	for _, sub := range s.subs {
+		if sub.done == nil {
+			s.start(sub)
+		}
+	}
+	return nil
+}
+
+// subscribe replaces any subscription to the filter, with one that's ready
+// to start.
+func (s *session) subscribe(filter string, qos byte) {
+	s.unsubscribe(filter)
+
+	name := streamName(filter)
+	r := s.srv.Broker.GetReader(name, stream.ReaderOptions{Retained: true})
+	sub := &subscriber{name: name, qos: qos, r: r, replayed: len(r.C)}
+
+	// A stream that retains its own events has the latest delivered already
+	for _, pub := range s.srv.retained.matching(filter) {
+		if _, ok := s.srv.Broker.Latest(streamName(pub.topic)); !ok {
+			pub.qos = min(pub.qos, qos)
+			sub.retained = append(sub.retained, pub)
+		}
+	}
+	s.subs[filter] = sub
+
+	slog.Debug("mqtt client subscribed", "client_id", s.clientID, "filter", filter, "qos", qos)
+}
+
+func (s *session) start(sub *subscriber) {
+	var ctx context.Context
+	ctx, sub.cancel = context.WithCancel(s.ctx)
+	sub.done = make(chan struct{})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(sub.done)
+		defer s.srv.Broker.ReturnReader(sub.name, sub.r)
+
+		for _, pub := range sub.retained {
+			if !s.deliverOne(ctx, pub) {
+				return
+			}
+		}
+		s.deliver(ctx, sub.r, sub.qos, sub.replayed)
+	}()
+}
+
+func (s *session) deliver(ctx context.Context, r *stream.Reader, qos byte, replayed int) {
+	for {
+		select {
+		case e, ok := <-r.C:
+			if !ok {
+				return
+			}
+
+			e, ok = r.Fresh(e)
+			if !ok {
+				continue
+			}
+
+			pub := publishPacket{topic: topicName(e.Stream), qos: qos, payload: e.Data}
+			if replayed > 0 {
+				replayed--
+				latest, ok := s.srv.Broker.Latest(e.Stream)
+				pub.retain = ok && latest.ID == e.ID
+			}
+
+			if !s.deliverOne(ctx, pub) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliverOne sends a message to the client, first waiting for room among the
+// unacked deliveries at QoS 1.
+func (s *session) deliverOne(ctx context.Context, pub publishPacket) bool {
+	if pub.qos == 0 {
+		return s.sendContext(ctx, pub.encode())
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+
+	s.mu.Lock()
+	pub.id = s.packetID()
+	s.inflight[pub.id] = &delivery{pub: pub, sent: time.Now()}
+	s.mu.Unlock()
+
+	return s.sendContext(ctx, pub.encode())
+}
+
+// packetID finds an unused packet ID. Requires s.mu.
+func (s *session) packetID() uint16 {
+	for {
+		s.nextID++
+		if _, ok := s.inflight[s.nextID]; s.nextID != 0 && !ok {
+			return s.nextID
+		}
+	}
+}
+
+// retry sends QoS 1 deliveries again once they've waited too long for their
+// PUBACK.
+func (s *session) retry() {
+	defer s.wg.Done()
+
+	interval := s.srv.retryInterval()
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			var resend [][]byte
+
+			s.mu.Lock()
+			for _, d := range s.inflight {
+				if now.Sub(d.sent) >= interval {
+					d.sent = now
+					d.pub.dup = true
+					resend = append(resend, d.pub.encode())
+				}
+			}
+			s.mu.Unlock()
+
+			for _, b := range resend {
+				if !s.send(b) {
+					return
+				}
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *session) handleUnsubscribe(p packet) error {
+	id, filters, err := parseUnsubscribe(p)
+	if err != nil {
+		return err
+	}
+
+	for _, filter := range filters {
+		s.unsubscribe(filter)
+	}
+
+	s.send(encodeID(typeUnsuback, id))
+	return nil
+}
+
+func (s *session) unsubscribe(filter string) {
+	sub, ok := s.subs[filter]
+	if !ok {
+		return
+	}
+
+	delete(s.subs, filter)
+	if sub.done == nil {
+		s.srv.Broker.ReturnReader(sub.name, sub.r)
+		return
+	}
+	sub.cancel()
+	<-sub.done
+}
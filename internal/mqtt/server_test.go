@@ -0,0 +1,282 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rhettg/yakapi/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient is just enough of an MQTT client to talk to the server.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startServer(t *testing.T, sm *stream.Manager) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv := &Server{Broker: sm, RetryInterval: 50 * time.Millisecond}
+		assert.NoError(t, srv.Serve(ctx, l))
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return l.Addr().String()
+}
+
+func connect(t *testing.T, addr string, c connectPacket) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	if c.protocol == "" {
+		c.protocol = "MQTT"
+		c.level = protocolLevel
+		c.clean = true
+	}
+
+	tc := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	tc.write(c.encode())
+
+	p := tc.read()
+	require.Equal(t, typeConnack, p.typ)
+	require.Equal(t, []byte{0, connAccepted}, p.body)
+
+	return tc
+}
+
+func (tc *testClient) write(b []byte) {
+	tc.t.Helper()
+	_, err := tc.conn.Write(b)
+	require.NoError(tc.t, err)
+}
+
+func (tc *testClient) read() packet {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := readPacket(tc.r, DefaultMaxPacketSize)
+	require.NoError(tc.t, err)
+	return p
+}
+
+func (tc *testClient) subscribe(filter string, qos byte) {
+	tc.t.Helper()
+	tc.write(encodeSubscribe(1, []subscription{{filter, qos}}))
+
+	p := tc.read()
+	require.Equal(tc.t, typeSuback, p.typ)
+	require.Equal(tc.t, []byte{0, 1, min(qos, 1)}, p.body)
+}
+
+func (tc *testClient) receive() publishPacket {
+	tc.t.Helper()
+	p := tc.read()
+	require.Equal(tc.t, typePublish, p.typ)
+
+	pub, err := parsePublish(p)
+	require.NoError(tc.t, err)
+	return pub
+}
+
+func receive(t *testing.T, r *stream.Reader) stream.Event {
+	t.Helper()
+	select {
+	case e := <-r.C:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return stream.Event{}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	sm := stream.NewManager()
+	addr := startServer(t, sm)
+
+	r := sm.GetReader("telemetry:imu", stream.ReaderOptions{})
+	defer sm.ReturnReader("telemetry:imu", r)
+
+	c := connect(t, addr, connectPacket{})
+
+	t.Run("qos 0", func(t *testing.T) {
+		c.write(publishPacket{topic: "telemetry/imu", payload: []byte(`{"heading":90}`)}.encode())
+
+		e := receive(t, r)
+		assert.Equal(t, `{"heading":90}`, string(e.Data))
+		assert.Equal(t, "application/json", e.ContentType)
+		assert.NotEmpty(t, e.Publisher)
+	})
+
+	t.Run("qos 1", func(t *testing.T) {
+		c.write(publishPacket{topic: "telemetry/imu", qos: 1, id: 9, payload: []byte("ok")}.encode())
+
+		p := c.read()
+		assert.Equal(t, typePuback, p.typ)
+		assert.Equal(t, []byte{0, 9}, p.body)
+		assert.Equal(t, "ok", string(receive(t, r).Data))
+	})
+
+	t.Run("retained", func(t *testing.T) {
+		c.write(publishPacket{topic: "state/motor", qos: 1, id: 10, retain: true, payload: []byte("0.8")}.encode())
+		c.read()
+
+		_, ok := sm.Latest("state:motor")
+		assert.False(t, ok, "the stream's retention is left alone")
+
+		sub := connect(t, addr, connectPacket{})
+		sub.subscribe("state/+", 1)
+		pub := sub.receive()
+		assert.Equal(t, "state/motor", pub.topic)
+		assert.Equal(t, "0.8", string(pub.payload))
+		assert.True(t, pub.retain)
+		assert.Equal(t, byte(1), pub.qos)
+		sub.write(encodeID(typePuback, pub.id))
+
+		c.write(publishPacket{topic: "state/motor", qos: 1, id: 11, retain: true}.encode())
+		c.read()
+
+		sub = connect(t, addr, connectPacket{})
+		sub.subscribe("state/+", 1)
+		sub.write(encodePacket(typePingreq, 0, nil))
+		assert.Equal(t, typePingresp, sub.read().typ, "cleared")
+	})
+
+	t.Run("retained invalid", func(t *testing.T) {
+		schema, err := stream.ParseSchema([]byte(`{"type": "number"}`))
+		require.NoError(t, err)
+		sm.SetSchema("state:motor", stream.Registration{Schema: schema})
+
+		c.write(publishPacket{topic: "state/motor", qos: 1, id: 12, retain: true, payload: []byte("fast")}.encode())
+		assert.Equal(t, typePuback, c.read().typ)
+
+		sub := connect(t, addr, connectPacket{})
+		sub.subscribe("state/+", 1)
+		sub.write(encodePacket(typePingreq, 0, nil))
+		assert.Equal(t, typePingresp, sub.read().typ, "not retained")
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		c.write(encodePacket(typePingreq, 0, nil))
+		assert.Equal(t, typePingresp, c.read().typ)
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	sm := stream.NewManager()
+	sm.SetRetained("sfc-control:*", true)
+	addr := startServer(t, sm)
+
+	r := sm.GetReader("sfc-control:A", stream.ReaderOptions{})
+	w := sm.GetWriter("sfc-control:A")
+	w <- stream.NewEvent("text/plain", []byte("0.5"))
+	receive(t, r)
+	sm.ReturnReader("sfc-control:A", r)
+
+	c := connect(t, addr, connectPacket{})
+	c.subscribe("sfc-control/+", 1)
+
+	pub := c.receive()
+	assert.Equal(t, "sfc-control/A", pub.topic)
+	assert.Equal(t, "0.5", string(pub.payload))
+	assert.True(t, pub.retain)
+	assert.Equal(t, byte(1), pub.qos)
+	c.write(encodeID(typePuback, pub.id))
+
+	w <- stream.NewEvent("text/plain", []byte("0.6"))
+	pub = c.receive()
+	assert.Equal(t, "0.6", string(pub.payload))
+	assert.False(t, pub.retain)
+
+	t.Run("redelivered until acked", func(t *testing.T) {
+		again := c.receive()
+		assert.Equal(t, pub.id, again.id)
+		assert.True(t, again.dup)
+		c.write(encodeID(typePuback, pub.id))
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		c.write(encodeUnsubscribe(2, []string{"sfc-control/+"}))
+		p := c.read()
+		require.Equal(t, typeUnsuback, p.typ)
+
+		w <- stream.NewEvent("text/plain", []byte("0.7"))
+		c.write(encodePacket(typePingreq, 0, nil))
+		assert.Equal(t, typePingresp, c.read().typ, "nothing delivered")
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		c.write(encodeSubscribe(3, []subscription{{"eyes/#/front", 0}}))
+		p := c.read()
+		assert.Equal(t, typeSuback, p.typ)
+		assert.Equal(t, []byte{0, 3, subscribeFailure}, p.body)
+	})
+
+	sm.ReturnWriter("sfc-control:A")
+}
+
+func TestLastWill(t *testing.T) {
+	sm := stream.NewManager()
+	addr := startServer(t, sm)
+
+	r := sm.GetReader("status", stream.ReaderOptions{})
+	defer sm.ReturnReader("status", r)
+
+	will := &publishPacket{topic: "status", payload: []byte("offline")}
+
+	t.Run("disconnect", func(t *testing.T) {
+		c := connect(t, addr, connectPacket{protocol: "MQTT", level: protocolLevel, clean: true, clientID: "a", will: will})
+		c.write(encodePacket(typeDisconnect, 0, nil))
+		c.conn.Close()
+
+		select {
+		case e := <-r.C:
+			t.Fatalf("unexpected will: %s", e.Data)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("dropped", func(t *testing.T) {
+		c := connect(t, addr, connectPacket{protocol: "MQTT", level: protocolLevel, clean: true, clientID: "b", will: will})
+		c.conn.Close()
+
+		e := receive(t, r)
+		assert.Equal(t, "offline", string(e.Data))
+		assert.Equal(t, "b", e.Publisher)
+	})
+}
+
+func TestConnectRefused(t *testing.T) {
+	sm := stream.NewManager()
+	addr := startServer(t, sm)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(connectPacket{protocol: "MQIsdp", level: 3, clean: true, clientID: "old"}.encode())
+	require.NoError(t, err)
+
+	tc := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	p := tc.read()
+	assert.Equal(t, typeConnack, p.typ)
+	assert.Equal(t, []byte{0, connBadProtocolVersion}, p.body)
+}
@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+// Topics map onto streams level by level. Streams separate levels with ':'
+// as well as '/', so "sfc-control/A" is the stream "sfc-control:A", and
+// events from "sfc-control:A" are published to the topic "sfc-control/A".
+// The wildcards mean the same in both, though topics can't use the stream
+// wildcard '*'.
+
+// streamName is the stream a topic, or topic filter, maps to.
+func streamName(topic string) string {
+	return strings.ReplaceAll(topic, "/", ":")
+}
+
+// topicName is the topic a stream's events are published to.
+func topicName(stream string) string {
+	return strings.ReplaceAll(stream, ":", "/")
+}
+
+// checkTopic checks a topic can be published to.
+func checkTopic(topic string) error {
+	if topic == "" {
+		return errors.New("empty topic")
+	}
+	if strings.ContainsAny(topic, "+#*") {
+		return errors.New("wildcards are not allowed in a topic")
+	}
+	return nil
+}
+
+// checkFilter checks a topic filter is well formed: each wildcard fills a
+// whole level, # comes last, and there's no '*', which would be a wildcard
+// once it's a stream pattern.
+func checkFilter(filter string) error {
+	if filter == "" {
+		return errors.New("empty topic filter")
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if l == "#" && i != len(levels)-1 {
+			return errors.New("# must be the last level of a topic filter")
+		}
+		if l != "+" && l != "#" && strings.ContainsAny(l, "+#") {
+			return errors.New("wildcards must fill a whole level")
+		}
+		if strings.Contains(l, "*") {
+			return errors.New("* is not allowed in a topic filter")
+		}
+	}
+	return nil
+}
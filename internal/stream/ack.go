@@ -0,0 +1,485 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// DefaultVisibility is how long an acked subscriber has to ack an event
+	// before it's delivered again.
+	DefaultVisibility = 30 * time.Second
+
+	// DefaultMaxAttempts is how many times an event is delivered before it's
+	// given up on and sent to the dead letter stream.
+	DefaultMaxAttempts = 5
+
+	// DefaultQueueLimit is how many events a queue holds waiting for a
+	// subscriber before dropping the oldest.
+	DefaultQueueLimit = 1000
+
+	// DefaultGroup is the queue acked subscribers share when they don't name
+	// a group.
+	DefaultGroup = "default"
+)
+
+// AckOptions configure a queue for acked delivery.
+type AckOptions struct {
+	// Visibility is how long a delivery waits for an ack before the event is
+	// delivered again.
+	Visibility time.Duration
+
+	// MaxAttempts is how many deliveries an event gets before it's sent to
+	// the dead letter stream.
+	MaxAttempts int
+
+	// DeadLetter is the stream events are sent to once they run out of
+	// attempts. It defaults to the stream's name with ":dead" appended.
+	DeadLetter string
+
+	// Limit is how many events may wait for a subscriber.
+	Limit int
+}
+
+func (o AckOptions) withDefaults(name string) AckOptions {
+	if o.Visibility <= 0 {
+		o.Visibility = DefaultVisibility
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultMaxAttempts
+	}
+	if o.DeadLetter == "" {
+		o.DeadLetter = name + ":dead"
+	}
+	if o.Limit <= 0 {
+		o.Limit = DefaultQueueLimit
+	}
+	return o
+}
+
+// QueueInfo describes a queue of events for acked subscribers.
+type QueueInfo struct {
+	Group        string `json:"group"`
+	Members      int    `json:"members"`
+	Pending      int    `json:"pending"`
+	InFlight     int    `json:"in_flight"`
+	Acked        uint64 `json:"acked"`
+	Redelivered  uint64 `json:"redelivered"`
+	DeadLettered uint64 `json:"dead_lettered"`
+	Dropped      uint64 `json:"dropped"`
+	Expired      uint64 `json:"expired"`
+}
+
+// queue holds a stream's events for a group of acked subscribers. Each event
+// goes to one member, and is delivered again if it isn't acked within the
+// visibility timeout, or is nacked, or its member leaves. Queues outlive
+// their members, so events published while every subscriber is restarting
+// are waiting for them when they're back.
+type queue struct {
+	stream string
+	group  string
+	opts   AckOptions
+
+	// in receives every event published to the stream
+	in *Reader
+
+	// deadLetter publishes an event that has run out of attempts
+	deadLetter func(Event)
+
+	mu       sync.Mutex
+	ready    []*delivery
+	inFlight map[string]*delivery
+	members  []*member
+	next     int
+	stats    QueueInfo
+
+	wake chan struct{}
+}
+
+type delivery struct {
+	event    Event
+	attempts int
+	tag      string
+	member   *member
+	deadline time.Time
+}
+
+type member struct {
+	r *Reader
+
+	// prefetch is how many unacked events the member may hold
+	prefetch int
+	inFlight int
+}
+
+func newQueue(stream, group string, opts AckOptions, in *Reader, deadLetter func(Event)) *queue {
+	q := &queue{
+		stream:     stream,
+		group:      group,
+		opts:       opts.withDefaults(stream),
+		in:         in,
+		deadLetter: deadLetter,
+		inFlight:   make(map[string]*delivery),
+		wake:       make(chan struct{}, 1),
+	}
+
+	go q.run()
+
+	return q
+}
+
+func (q *queue) run() {
+	tick := min(max(q.opts.Visibility/10, 10*time.Millisecond), time.Second)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-q.in.C:
+			if !ok {
+				slog.Error("queue disconnected from stream", "stream", q.stream, "group", q.group)
+				return
+			}
+			q.push(e)
+		case <-q.wake:
+		case <-ticker.C:
+			q.expire(time.Now())
+		}
+
+		q.dispatch()
+	}
+}
+
+func (q *queue) push(e Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e.Dropped = 0
+	q.ready = append(q.ready, &delivery{event: e})
+	if len(q.ready) > q.opts.Limit {
+		q.ready = q.ready[1:]
+		q.stats.Dropped++
+	}
+}
+
+func (q *queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands waiting events to members with room for them, in turn.
+func (q *queue) dispatch() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for len(q.ready) > 0 {
+		d := q.ready[0]
+
+		// Better not at all than late
+		if d.event.Expired(now) {
+			q.ready = q.ready[1:]
+			q.stats.Expired++
+			continue
+		}
+
+		m := q.nextMember()
+		if m == nil {
+			return
+		}
+
+		d.attempts++
+		d.tag = ulid.Make().String()
+		d.member = m
+		d.deadline = time.Now().Add(q.opts.Visibility)
+
+		e := d.event
+		e.DeliveryTag = d.tag
+		e.Attempt = d.attempts
+		if !m.r.tryDeliver(e) {
+			// Still holding an event that timed out before it was read,
+			// so try again later
+			d.attempts--
+			d.tag = ""
+			d.member = nil
+			return
+		}
+
+		q.ready = q.ready[1:]
+		q.inFlight[d.tag] = d
+		m.inFlight++
+	}
+}
+
+// nextMember finds the next member with room for another event. Requires
+// q.mu.
+func (q *queue) nextMember() *member {
+	for i := range q.members {
+		m := q.members[(q.next+i)%len(q.members)]
+		if m.inFlight < m.prefetch {
+			q.next = (q.next + i + 1) % len(q.members)
+			return m
+		}
+	}
+	return nil
+}
+
+// expire takes back deliveries that have waited too long for an ack.
+func (q *queue) expire(now time.Time) {
+	var dead []Event
+
+	q.mu.Lock()
+	for tag, d := range q.inFlight {
+		if now.After(d.deadline) {
+			slog.Debug("delivery timed out", "stream", q.stream, "group", q.group, "tag", tag, "attempts", d.attempts)
+			dead = q.retry(d, dead)
+		}
+	}
+	q.mu.Unlock()
+
+	q.sendDead(dead)
+}
+
+// retry takes back a delivery, queueing its event to be delivered again or,
+// once it has used up its attempts, adding it to dead. Requires q.mu.
+func (q *queue) retry(d *delivery, dead []Event) []Event {
+	delete(q.inFlight, d.tag)
+	d.member.inFlight--
+	d.member = nil
+	d.tag = ""
+
+	if d.attempts >= q.opts.MaxAttempts {
+		q.stats.DeadLettered++
+		e := d.event
+		e.Attempt = d.attempts
+		return append(dead, e)
+	}
+
+	// Ahead of newer events, which is where it was
+	q.stats.Redelivered++
+	q.ready = append([]*delivery{d}, q.ready...)
+	return dead
+}
+
+func (q *queue) sendDead(dead []Event) {
+	for _, e := range dead {
+		slog.Warn("sending event to dead letter stream", "stream", q.stream, "group", q.group, "id", e.ID, "attempts", e.Attempt, "dead_letter", q.opts.DeadLetter)
+		e.Offset = 0
+		q.deadLetter(e)
+	}
+}
+
+// settle acks or nacks the deliveries with the given tags, returning those
+// that aren't outstanding.
+func (q *queue) settle(tags []string, ack bool) (unknown []string) {
+	var dead []Event
+
+	q.mu.Lock()
+	for _, tag := range tags {
+		d, ok := q.inFlight[tag]
+		if !ok {
+			unknown = append(unknown, tag)
+			continue
+		}
+
+		if ack {
+			delete(q.inFlight, tag)
+			d.member.inFlight--
+			q.stats.Acked++
+			continue
+		}
+		dead = q.retry(d, dead)
+	}
+	q.mu.Unlock()
+
+	q.sendDead(dead)
+	q.notify()
+
+	return unknown
+}
+
+// join adds a member that may hold up to prefetch unacked events.
+func (q *queue) join(prefetch int) *Reader {
+	r := newReader(Policy{Delivery: DropNewest, BufferSize: prefetch}, 0)
+
+	q.mu.Lock()
+	q.members = append(q.members, &member{r: r, prefetch: prefetch})
+	q.mu.Unlock()
+
+	q.notify()
+	return r
+}
+
+// leave removes a member, delivering its unacked events again.
+func (q *queue) leave(r *Reader) {
+	var dead []Event
+
+	q.mu.Lock()
+	for i, m := range q.members {
+		if m.r != r {
+			continue
+		}
+
+		q.members = append(q.members[:i], q.members[i+1:]...)
+		r.close()
+
+		for _, d := range q.inFlight {
+			if d.member == m {
+				dead = q.retry(d, dead)
+			}
+		}
+		break
+	}
+	q.mu.Unlock()
+
+	q.sendDead(dead)
+	q.notify()
+}
+
+func (q *queue) info() QueueInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	info := q.stats
+	info.Group = q.group
+	info.Members = len(q.members)
+	info.Pending = len(q.ready)
+	info.InFlight = len(q.inFlight)
+	return info
+}
+
+// queueInfo requires the stream to be locked.
+func (s *Stream) queueInfo() []QueueInfo {
+	var queues []QueueInfo
+	for _, q := range s.queues {
+		queues = append(queues, q.info())
+	}
+
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].Group < queues[j].Group
+	})
+
+	return queues
+}
+
+// DeclareQueue sets up a queue of a stream's events for acked subscribers in
+// the named group, so events are kept for them from now on, even before
+// they first subscribe. Queues are otherwise created by the first acked
+// subscriber. Declaring an existing queue changes nothing.
+func (sm *Manager) DeclareQueue(name, group string, opts AckOptions) error {
+	if IsPattern(name) {
+		return fmt.Errorf("cannot queue a stream pattern: %q", name)
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.queue(name, group, opts)
+	return nil
+}
+
+// queue finds or creates a stream's queue for a group. Requires the manager
+// to be locked.
+func (sm *Manager) queue(name, group string, opts AckOptions) *queue {
+	if group == "" {
+		group = DefaultGroup
+	}
+
+	s := sm.streams[name]
+	if s == nil {
+		s = sm.newStream(name)
+		sm.streams[name] = s
+	}
+
+	s.mu.RLock()
+	q, ok := s.queues[group]
+	s.mu.RUnlock()
+	if ok {
+		return q
+	}
+
+	opts = opts.withDefaults(name)
+	in := s.newQueueReader()
+	deadLetter := func(e Event) {
+		// Queued, so dead events are kept until someone acks them
+		err := sm.DeclareQueue(opts.DeadLetter, DefaultGroup, AckOptions{})
+		if err == nil {
+			err = sm.Publish(context.Background(), opts.DeadLetter, e)
+		}
+		if err != nil {
+			slog.Warn("failed to dead letter event", "stream", name, "group", group, "id", e.ID, "dead_letter", opts.DeadLetter, "error", err)
+		}
+	}
+
+	q = newQueue(name, group, opts, in, deadLetter)
+
+	s.mu.Lock()
+	s.queues[group] = q
+	s.mu.Unlock()
+
+	slog.Info("created queue", "stream", name, "group", group, "visibility", opts.Visibility, "max_attempts", opts.MaxAttempts, "dead_letter", opts.DeadLetter)
+
+	return q
+}
+
+// getQueueReader requires the manager to be locked.
+func (sm *Manager) getQueueReader(name string, opts ReaderOptions) *Reader {
+	q := sm.queue(name, opts.Group, AckOptions{})
+
+	prefetch := opts.BufferSize
+	if prefetch <= 0 {
+		prefetch = 1
+	}
+
+	r := q.join(prefetch)
+	sm.queued[r] = q
+	return r
+}
+
+// Ack acknowledges acked deliveries from a stream by their tags, so they
+// aren't delivered again. Tags that aren't outstanding are returned.
+func (sm *Manager) Ack(name string, tags ...string) []string {
+	return sm.settle(name, tags, true)
+}
+
+// Nack hands back acked deliveries from a stream by their tags, to be
+// delivered again straight away, or sent to the dead letter stream once
+// they're out of attempts. Tags that aren't outstanding are returned.
+func (sm *Manager) Nack(name string, tags ...string) []string {
+	return sm.settle(name, tags, false)
+}
+
+func (sm *Manager) settle(name string, tags []string, ack bool) []string {
+	sm.mu.RLock()
+	s, ok := sm.streams[name]
+	sm.mu.RUnlock()
+	if !ok {
+		return tags
+	}
+
+	s.mu.RLock()
+	queues := make([]*queue, 0, len(s.queues))
+	for _, q := range s.queues {
+		queues = append(queues, q)
+	}
+	s.mu.RUnlock()
+
+	// Tags are unique, so whatever one queue doesn't know about is tried on
+	// the next
+	for _, q := range queues {
+		tags = q.settle(tags, ack)
+		if len(tags) == 0 {
+			break
+		}
+	}
+
+	return tags
+}
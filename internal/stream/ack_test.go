@@ -0,0 +1,140 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue(t *testing.T) {
+	sm := NewManager()
+	require.NoError(t, sm.DeclareQueue("ci", DefaultGroup, AckOptions{}))
+
+	// Published before anyone subscribes
+	publish(t, sm, "ci", "one", "two")
+
+	r := sm.GetReader("ci", ReaderOptions{Ack: true})
+	defer sm.ReturnReader("ci", r)
+
+	e := receive(t, r)
+	assert.Equal(t, "one", string(e.Data))
+	assert.NotEmpty(t, e.DeliveryTag)
+	assert.Equal(t, 1, e.Attempt)
+
+	// One unacked event at a time by default
+	assert.Never(t, func() bool { return len(r.C) > 0 }, 50*time.Millisecond, time.Millisecond)
+
+	assert.Empty(t, sm.Ack("ci", e.DeliveryTag))
+	assert.Equal(t, "two", string(receive(t, r).Data))
+
+	assert.Equal(t, []string{e.DeliveryTag}, sm.Ack("ci", e.DeliveryTag), "already acked")
+
+	info, _ := sm.Stream("ci")
+	require.Len(t, info.Queues, 1)
+	assert.Equal(t, QueueInfo{Group: DefaultGroup, Members: 1, InFlight: 1, Acked: 1}, info.Queues[0])
+}
+
+func TestQueueRedelivery(t *testing.T) {
+	sm := NewManager()
+	sm.mu.Lock()
+	sm.queue("ci", "", AckOptions{Visibility: 100 * time.Millisecond, MaxAttempts: 3})
+	sm.mu.Unlock()
+
+	dead := sm.GetReader("ci:dead", ReaderOptions{})
+	defer sm.ReturnReader("ci:dead", dead)
+
+	r := sm.GetReader("ci", ReaderOptions{Ack: true})
+	publish(t, sm, "ci", "poison")
+
+	t.Run("timeout", func(t *testing.T) {
+		first := receive(t, r)
+		assert.Equal(t, 1, first.Attempt)
+
+		e := receive(t, r)
+		assert.Equal(t, "poison", string(e.Data))
+		assert.Equal(t, 2, e.Attempt)
+		assert.Equal(t, []string{first.DeliveryTag}, sm.Ack("ci", first.DeliveryTag), "too late")
+	})
+
+	t.Run("member leaves", func(t *testing.T) {
+		sm.ReturnReader("ci", r)
+		r = sm.GetReader("ci", ReaderOptions{Ack: true})
+
+		e := receive(t, r)
+		assert.Equal(t, 3, e.Attempt)
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		e := receive(t, dead)
+		assert.Equal(t, "poison", string(e.Data))
+		assert.Equal(t, "ci:dead", e.Stream)
+		assert.Equal(t, 3, e.Attempt)
+		assert.Empty(t, e.DeliveryTag)
+
+		// Kept for whoever looks later
+		later := sm.GetReader("ci:dead", ReaderOptions{Ack: true})
+		defer sm.ReturnReader("ci:dead", later)
+		assert.Equal(t, "poison", string(receive(t, later).Data))
+	})
+
+	sm.ReturnReader("ci", r)
+}
+
+func TestQueueNack(t *testing.T) {
+	sm := NewManager()
+
+	a := sm.GetReader("ci", ReaderOptions{Ack: true, Group: "workers"})
+	defer sm.ReturnReader("ci", a)
+	b := sm.GetReader("ci", ReaderOptions{Ack: true, Group: "workers", BufferSize: 2})
+	defer sm.ReturnReader("ci", b)
+
+	publish(t, sm, "ci", "one")
+	e := receive(t, a)
+	assert.Empty(t, sm.Nack("ci", e.DeliveryTag))
+
+	e = receive(t, b)
+	assert.Equal(t, "one", string(e.Data))
+	assert.Equal(t, 2, e.Attempt)
+	assert.Empty(t, sm.Ack("ci", e.DeliveryTag))
+
+	info, _ := sm.Stream("ci")
+	assert.Equal(t, []QueueInfo{{Group: "workers", Members: 2, Acked: 1, Redelivered: 1}}, info.Queues)
+}
+
+func TestQueueDisconnectPolicy(t *testing.T) {
+	sm := NewManager()
+	sm.SetPolicy("ci", Policy{Delivery: Disconnect, BufferSize: 1})
+
+	sm.mu.Lock()
+	q := sm.queue("ci", "", AckOptions{Limit: 2 * MaxBufferSize})
+	sm.mu.Unlock()
+
+	// Hold up the queue so a burst overflows its input buffer
+	q.mu.Lock()
+	publishN(t, sm, "ci", 2)
+	require.Eventually(t, func() bool { return len(q.in.C) == 1 }, time.Second, time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		publishN(t, sm, "ci", MaxBufferSize+1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	q.mu.Unlock()
+	<-done
+
+	r := sm.GetReader("ci", ReaderOptions{Ack: true, BufferSize: MaxBufferSize})
+	defer sm.ReturnReader("ci", r)
+
+	n := 0
+	for n < MaxBufferSize+3 {
+		e := receive(t, r)
+		assert.Empty(t, sm.Ack("ci", e.DeliveryTag))
+		n++
+	}
+
+	publish(t, sm, "ci", "after")
+	assert.Equal(t, "after", string(receive(t, r).Data))
+}
@@ -0,0 +1,75 @@
+package stream
+
+import "context"
+
+// Broker carries events from publishers to subscribers. Manager is the
+// in-memory implementation. The server depends only on this, so persistent or
+// networked backends, or fakes in tests, can stand in for it.
+type Broker interface {
+	// Publish publishes an event to a stream, waiting until the stream takes
+	// it or ctx is done.
+	Publish(ctx context.Context, name string, e Event) error
+
+	// PublishBatch publishes events, each to the stream it names, in order.
+	// Either all of them are published or, if any is refused or ctx is done
+	// first, none are.
+	PublishBatch(ctx context.Context, events []Event) error
+
+	// GetReader subscribes to a stream, or every stream matching a pattern.
+	// The reader must be closed with ReturnReader. Backends other than
+	// Manager deliver to readers from NewReader.
+	GetReader(name string, opts ReaderOptions) *Reader
+	ReturnReader(name string, r *Reader)
+
+	// Streams lists the open streams, and Stream describes one of them.
+	Streams() []StreamInfo
+	Stream(name string) (StreamInfo, bool)
+
+	// Latest returns a stream's unexpired retained event, and History reads
+	// its log.
+	Latest(name string) (Event, bool)
+	History(name string, offset uint64, limit int) (HistoryPage, error)
+
+	// Ack and Nack settle acked deliveries by their tags, returning those
+	// that aren't outstanding.
+	Ack(name string, tags ...string) []string
+	Nack(name string, tags ...string) []string
+
+	// SetSchema registers the schema events published to a stream must
+	// satisfy, and Schemas lists them. Publishing an event that doesn't
+	// returns a ValidationError, or ValidationErrors for a batch.
+	SetSchema(name string, reg Registration)
+	Schemas() map[string]Registration
+
+	// Close refuses publishing from then on, waits until ctx is done for
+	// publishes under way, then ends every subscription.
+	Close(ctx context.Context) error
+}
+
+var _ Broker = (*Manager)(nil)
+
+// Publish publishes an event to a stream, waiting until the stream takes it
+// or ctx is done. Events that don't satisfy the stream's schema are refused,
+// as is everything once the manager is closed.
+func (sm *Manager) Publish(ctx context.Context, name string, e Event) error {
+	err := sm.begin()
+	if err != nil {
+		return err
+	}
+	defer sm.publishing.Done()
+
+	err = sm.refuse(ctx, name, e)
+	if err != nil {
+		return err
+	}
+
+	w := sm.GetWriter(name)
+	defer sm.ReturnWriter(name)
+
+	select {
+	case w <- e:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,57 @@
+package stream
+
+import (
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Event is a single message published to a stream.
+type Event struct {
+	ID          ulid.ULID `json:"id"`
+	Offset      uint64    `json:"offset,omitempty"`
+	Stream      string    `json:"stream,omitempty"`
+	Time        time.Time `json:"time"`
+	ContentType string    `json:"content_type,omitempty"`
+	Publisher   string    `json:"publisher,omitempty"`
+	Data        []byte    `json:"data"`
+
+	// Dropped is set on delivery to the number of events the reader missed
+	// just before this one.
+	Dropped uint64 `json:"dropped,omitempty"`
+
+	// DeliveryTag identifies an acked delivery, to ack or nack it by. Attempt
+	// counts the deliveries of the event so far, starting at 1.
+	DeliveryTag string `json:"delivery_tag,omitempty"`
+	Attempt     int    `json:"attempt,omitempty"`
+
+	// CorrelationID ties a reply to its request, and ReplyTo names the stream
+	// a request's reply should be published to.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	ReplyTo       string `json:"reply_to,omitempty"`
+
+	// Expires is when the event goes stale and is discarded rather than
+	// delivered. TTL is set on delivery to the seconds it has left.
+	Expires *time.Time `json:"expires,omitempty"`
+	TTL     float64    `json:"ttl,omitempty"`
+}
+
+// NewEvent creates an event with a fresh ID, stamped with the current time.
+func NewEvent(contentType string, data []byte) Event {
+	return Event{
+		ID:          ulid.Make(),
+		Time:        time.Now(),
+		ContentType: contentType,
+		Data:        data,
+	}
+}
+
+// stamp fills in the ID and time of events built without NewEvent.
+func (e *Event) stamp() {
+	if isZeroID(e.ID) {
+		e.ID = ulid.Make()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+}
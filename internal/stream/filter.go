@@ -0,0 +1,290 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Filter selects which events a subscription receives and which of their
+// fields, for payloads that are JSON. It's applied before events are written,
+// so nothing filtered out is sent to the subscriber.
+//
+// Predicates are written as a dotted path to a field, optionally compared to
+// a value:
+//
+//	cmd            cmd is present
+//	!error         error is not present
+//	cmd==fwd       cmd is the string "fwd"
+//	speed>=1.5     speed is a number of at least 1.5
+//	gps.fix!=true  gps.fix is anything but true
+//
+// Values are JSON literals, or otherwise strings. Array elements are selected
+// by index, as in wheels.0.rpm. An event must match every predicate, so one
+// whose payload isn't JSON never matches.
+type Filter struct {
+	predicates []predicate
+
+	// fields, if any, are the only fields kept in delivered payloads
+	fields [][]string
+}
+
+type predicate struct {
+	path   []string
+	op     string
+	negate bool
+
+	// value is a float64, string, bool or nil, and raw the literal it was
+	// parsed from.
+	value any
+	raw   string
+}
+
+// filterOps are checked in order, so two character operators come first.
+var filterOps = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+// ParseFilter reads the filter and fields query parameters. There may be any
+// number of filter parameters, and fields is a comma separated list of paths.
+func ParseFilter(q url.Values) (Filter, error) {
+	var f Filter
+
+	for _, expr := range q["filter"] {
+		p, err := parsePredicate(expr)
+		if err != nil {
+			return f, fmt.Errorf("invalid filter %q: %w", expr, err)
+		}
+		f.predicates = append(f.predicates, p)
+	}
+
+	if fields := q.Get("fields"); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			path, err := parsePath(strings.TrimSpace(field))
+			if err != nil {
+				return f, fmt.Errorf("invalid fields %q: %w", fields, err)
+			}
+			f.fields = append(f.fields, path)
+		}
+	}
+
+	return f, nil
+}
+
+func parsePredicate(expr string) (predicate, error) {
+	var p predicate
+
+	for i := 0; i < len(expr) && p.op == ""; i++ {
+		for _, op := range filterOps {
+			if strings.HasPrefix(expr[i:], op) {
+				p.op = op
+				p.raw = expr[i+len(op):]
+				expr = expr[:i]
+				break
+			}
+		}
+	}
+
+	if p.op == "" {
+		if strings.Contains(expr, "=") {
+			return p, errors.New("unknown operator, use ==")
+		}
+		expr, p.negate = strings.CutPrefix(expr, "!")
+	}
+
+	path, err := parsePath(expr)
+	if err != nil {
+		return p, err
+	}
+	p.path = path
+
+	if p.op != "" {
+		p.value = parseLiteral(p.raw)
+		if _, ok := p.value.(float64); !ok && p.op != "==" && p.op != "!=" {
+			return p, fmt.Errorf("%s needs a number", p.op)
+		}
+	}
+
+	return p, nil
+}
+
+func parsePath(s string) ([]string, error) {
+	if s == "" {
+		return nil, errors.New("empty path")
+	}
+
+	path := strings.Split(s, ".")
+	for _, key := range path {
+		if key == "" {
+			return nil, fmt.Errorf("empty key in path %q", s)
+		}
+	}
+
+	return path, nil
+}
+
+func parseLiteral(raw string) any {
+	var v any
+	err := json.Unmarshal([]byte(raw), &v)
+	if err != nil {
+		return raw
+	}
+
+	switch v := v.(type) {
+	case float64, string, bool, nil:
+		return v
+	default:
+		// Objects and arrays can't be compared to, so take them literally
+		return raw
+	}
+}
+
+// IsZero reports whether the filter lets every event through untouched.
+func (f Filter) IsZero() bool {
+	return len(f.predicates) == 0 && len(f.fields) == 0
+}
+
+// Apply reports whether the event passes the filter, returning it with its
+// payload projected to the selected fields. Payloads that aren't JSON
+// objects are delivered as they are when only fields are selected.
+func (f Filter) Apply(e Event) (Event, bool) {
+	if f.IsZero() {
+		return e, true
+	}
+
+	d := json.NewDecoder(bytes.NewReader(e.Data))
+	d.UseNumber()
+
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return e, len(f.predicates) == 0
+	}
+
+	for _, p := range f.predicates {
+		if !p.match(v) {
+			return e, false
+		}
+	}
+
+	obj, ok := v.(map[string]any)
+	if len(f.fields) == 0 || !ok {
+		return e, true
+	}
+
+	b, err := json.Marshal(project(obj, f.fields))
+	if err != nil {
+		return e, true
+	}
+	e.Data = b
+
+	return e, true
+}
+
+func (p predicate) match(v any) bool {
+	field, ok := lookupPath(v, p.path)
+
+	switch p.op {
+	case "":
+		return ok != p.negate
+	case "==":
+		return ok && p.equal(field)
+	case "!=":
+		return !ok || !p.equal(field)
+	}
+
+	n, isNum := field.(json.Number)
+	if !ok || !isNum {
+		return false
+	}
+	x, err := n.Float64()
+	if err != nil {
+		return false
+	}
+	y := p.value.(float64)
+
+	switch p.op {
+	case ">":
+		return x > y
+	case ">=":
+		return x >= y
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	}
+
+	return false
+}
+
+func (p predicate) equal(field any) bool {
+	switch field := field.(type) {
+	case json.Number:
+		y, ok := p.value.(float64)
+		if !ok {
+			return false
+		}
+		x, err := field.Float64()
+		return err == nil && x == y
+	case string:
+		// Compare strings to the literal as written, so id==123 matches "123"
+		if s, ok := p.value.(string); ok {
+			return field == s
+		}
+		return field == p.raw
+	case bool, nil:
+		return field == p.value
+	default:
+		return false
+	}
+}
+
+func lookupPath(v any, path []string) (any, bool) {
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]any:
+			child, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// project builds an object holding only the given fields of obj, keeping
+// their nesting. Missing fields are left out.
+func project(obj map[string]any, fields [][]string) map[string]any {
+	out := make(map[string]any)
+
+	for _, path := range fields {
+		v, ok := lookupPath(obj, path)
+		if !ok {
+			continue
+		}
+
+		node := out
+		for _, key := range path[:len(path)-1] {
+			child, ok := node[key].(map[string]any)
+			if !ok {
+				child = make(map[string]any)
+				node[key] = child
+			}
+			node = child
+		}
+		node[path[len(path)-1]] = v
+	}
+
+	return out
+}
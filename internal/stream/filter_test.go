@@ -0,0 +1,116 @@
+package stream
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterMatch(t *testing.T) {
+	data := `{"cmd": "fwd", "id": "123", "speed": 1.5, "gps": {"fix": true}, "wheels": [{"rpm": 40}], "note": null}`
+
+	testCases := []struct {
+		filter string
+		match  bool
+	}{
+		{"cmd", true},
+		{"error", false},
+		{"!error", true},
+		{"!cmd", false},
+		{"cmd==fwd", true},
+		{`cmd=="fwd"`, true},
+		{"cmd==back", false},
+		{"cmd!=back", true},
+		{"error!=x", true},
+		{"id==123", true},
+		{"speed==1.5", true},
+		{"speed>1", true},
+		{"speed>=1.5", true},
+		{"speed<1.5", false},
+		{"speed<=2", true},
+		{"cmd>1", false},
+		{"gps.fix==true", true},
+		{"gps.fix!=true", false},
+		{"wheels.0.rpm>30", true},
+		{"wheels.1.rpm", false},
+		{"note==null", true},
+	}
+
+	for _, tc := range testCases {
+		f, err := ParseFilter(url.Values{"filter": {tc.filter}})
+		require.NoError(t, err, tc.filter)
+
+		_, ok := f.Apply(NewEvent("application/json", []byte(data)))
+		assert.Equal(t, tc.match, ok, tc.filter)
+	}
+
+	t.Run("all", func(t *testing.T) {
+		f, err := ParseFilter(url.Values{"filter": {"cmd==fwd", "speed>2"}})
+		require.NoError(t, err)
+		_, ok := f.Apply(NewEvent("application/json", []byte(data)))
+		assert.False(t, ok)
+	})
+
+	t.Run("not json", func(t *testing.T) {
+		f, err := ParseFilter(url.Values{"filter": {"!cmd"}})
+		require.NoError(t, err)
+		_, ok := f.Apply(NewEvent("text/plain", []byte("fwd 10")))
+		assert.False(t, ok)
+	})
+}
+
+func TestParseFilterInvalid(t *testing.T) {
+	for _, bad := range []string{"", "cmd=fwd", "==fwd", "a..b", "speed>fast", "!"} {
+		_, err := ParseFilter(url.Values{"filter": {bad}})
+		assert.Error(t, err, bad)
+	}
+
+	_, err := ParseFilter(url.Values{"fields": {"a,,b"}})
+	assert.Error(t, err)
+}
+
+func TestFilterFields(t *testing.T) {
+	f, err := ParseFilter(url.Values{"fields": {"battery,gps.lat,missing"}})
+	require.NoError(t, err)
+
+	e, ok := f.Apply(NewEvent("application/json", []byte(`{"battery": 12.60, "temp": 40, "gps": {"lat": 37.77, "lon": -122.42}}`)))
+	require.True(t, ok)
+	assert.JSONEq(t, `{"battery": 12.60, "gps": {"lat": 37.77}}`, string(e.Data))
+	assert.Contains(t, string(e.Data), "12.60", "numbers are kept as written")
+
+	e, ok = f.Apply(NewEvent("text/plain", []byte("hello")))
+	require.True(t, ok)
+	assert.Equal(t, "hello", string(e.Data))
+}
+
+func TestStreamOutFilter(t *testing.T) {
+	sm := NewManager()
+	f, err := ParseFilter(url.Values{"filter": {"cmd==fwd"}, "fields": {"cmd"}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var out strings.Builder
+	done := make(chan error)
+	go func() {
+		done <- StreamOut(ctx, &out, "ci", sm, OutOptions{Format: FormatRaw, Filter: f})
+	}()
+
+	require.Eventually(t, func() bool {
+		info, ok := sm.Stream("ci")
+		return ok && info.Readers == 1
+	}, time.Second, time.Millisecond)
+
+	for _, data := range []string{`{"cmd": "fwd", "n": 1}`, `{"cmd": "back"}`, `not json`, `{"cmd": "fwd", "n": 2}`} {
+		require.NoError(t, StreamIn(ctx, "ci", NewEvent("application/json", []byte(data)), sm))
+	}
+
+	require.NoError(t, <-done)
+	assert.Equal(t, "{\"cmd\":\"fwd\"}\n{\"cmd\":\"fwd\"}\n", out.String())
+}
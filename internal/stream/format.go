@@ -0,0 +1,149 @@
+package stream
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Format is the wire representation StreamOut uses for events.
+type Format string
+
+const (
+	// FormatRaw writes each event's payload followed by a newline.
+	FormatRaw Format = "raw"
+
+	// FormatJSON writes each event as a JSON envelope on its own line.
+	FormatJSON Format = "json"
+
+	// FormatFramed writes each event as a length-prefixed binary frame, so
+	// payloads of any size and content survive intact:
+	//
+	//	uint32 metadata length, metadata JSON (the envelope without data)
+	//	uint32 data length, data
+	//
+	// Lengths are big endian.
+	FormatFramed Format = "frames"
+
+	// FormatSSE writes each event as a Server-Sent Events frame, named after
+	// the stream it was published to. Payloads that aren't valid UTF-8 are
+	// base64 encoded, and their name suffixed with ".base64".
+	FormatSSE Format = "sse"
+)
+
+// DefaultKeepalive is how often an idle SSE subscription sends a comment, so
+// proxies and browsers don't give up on it.
+const DefaultKeepalive = 15 * time.Second
+
+// ContentType is the Content-Type of a subscription response in this format.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatJSON:
+		return "application/x-ndjson"
+	case FormatSSE:
+		return "text/event-stream"
+	case FormatFramed:
+		return "application/vnd.yakapi.frames"
+	default:
+		return ""
+	}
+}
+
+func writeEvent(w io.Writer, e Event, format Format) error {
+	switch format {
+	case FormatFramed:
+		err := writeFrame(w, e)
+		if err != nil {
+			return errors.New("error writing event")
+		}
+	case FormatSSE:
+		err := writeSSE(w, e)
+		if err != nil {
+			return errors.New("error writing event")
+		}
+	case FormatJSON:
+		err := json.NewEncoder(w).Encode(e)
+		if err != nil {
+			return errors.New("error writing event")
+		}
+	default:
+		_, err := w.Write(e.Data)
+		if err != nil {
+			return errors.New("error writing data")
+		}
+
+		_, err = w.Write([]byte("\n"))
+		if err != nil {
+			return errors.New("error writing newline")
+		}
+	}
+
+	return nil
+}
+
+func writeFrame(w io.Writer, e Event) error {
+	data := e.Data
+	e.Data = nil
+
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 0, 8+len(meta)+len(data))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(meta)))
+	b = append(b, meta...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+
+	// A single write keeps the frame in one chunk where possible, though
+	// readers mustn't rely on it.
+	_, err = w.Write(b)
+	return err
+}
+
+// sseBase64 is appended to the SSE event name of base64 encoded payloads.
+const sseBase64 = ".base64"
+
+// writeSSE writes an event frame. Each line of the payload gets its own data
+// field, which EventSource joins back together with newlines, so line breaks
+// all come back as "\n". A payload that isn't UTF-8 is base64 encoded, and
+// the event named for its stream with a ".base64" suffix, so it's only
+// delivered to listeners expecting it.
+func writeSSE(w io.Writer, e Event) error {
+	var b strings.Builder
+
+	name := e.Stream
+	data := string(e.Data)
+	if !utf8.ValidString(data) {
+		data = base64.StdEncoding.EncodeToString(e.Data)
+		name = strings.TrimPrefix(name+sseBase64, ".") // just "base64" unnamed
+	}
+
+	fmt.Fprintf(&b, "id: %s\n", e.ID)
+	if name != "" {
+		fmt.Fprintf(&b, "event: %s\n", name)
+	}
+
+	// SSE ends lines at CRLF, LF or a lone CR
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeKeepalive(w io.Writer) error {
+	_, err := io.WriteString(w, ": keepalive\n\n")
+	return err
+}
@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteEvent(t *testing.T) {
+	e := NewEvent("application/octet-stream", []byte{0, 1, '\n', 2})
+	e.Publisher = "tester"
+
+	t.Run("raw", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeEvent(&buf, e, FormatRaw))
+		assert.Equal(t, append(e.Data, '\n'), buf.Bytes())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeEvent(&buf, e, FormatJSON))
+
+		var got Event
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+		assert.Equal(t, e.ID, got.ID)
+		assert.True(t, e.Time.Equal(got.Time))
+		assert.Equal(t, e.ContentType, got.ContentType)
+		assert.Equal(t, e.Publisher, got.Publisher)
+		assert.Equal(t, e.Data, got.Data)
+	})
+
+	t.Run("frames", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeEvent(&buf, e, FormatFramed))
+		b := buf.Bytes()
+
+		metaLen := binary.BigEndian.Uint32(b)
+		var got Event
+		require.NoError(t, json.Unmarshal(b[4:4+metaLen], &got))
+		assert.Equal(t, e.ID, got.ID)
+		assert.Equal(t, e.Publisher, got.Publisher)
+		assert.Nil(t, got.Data)
+
+		b = b[4+metaLen:]
+		require.Equal(t, uint32(len(e.Data)), binary.BigEndian.Uint32(b))
+		assert.Equal(t, e.Data, b[4:])
+	})
+}
+
+func TestWriteSSE(t *testing.T) {
+	e := NewEvent("text/plain", []byte("one\r\ntwo\nthree\rfour"))
+	e.Stream = "test"
+
+	var buf bytes.Buffer
+	require.NoError(t, writeEvent(&buf, e, FormatSSE))
+	assert.Equal(t, "id: "+e.ID.String()+"\nevent: test\ndata: one\ndata: two\ndata: three\ndata: four\n\n", buf.String())
+
+	t.Run("binary", func(t *testing.T) {
+		e := NewEvent("application/octet-stream", []byte{0xff, 0xfe})
+		e.Stream = "eyes"
+
+		var buf bytes.Buffer
+		require.NoError(t, writeEvent(&buf, e, FormatSSE))
+		assert.Equal(t, "id: "+e.ID.String()+"\nevent: eyes.base64\ndata: //4=\n\n", buf.String())
+
+		e.Stream = ""
+		buf.Reset()
+		require.NoError(t, writeEvent(&buf, e, FormatSSE))
+		assert.Equal(t, "id: "+e.ID.String()+"\nevent: base64\ndata: //4=\n\n", buf.String())
+	})
+}
+
+func TestStreamOutKeepalive(t *testing.T) {
+	sm := NewManager()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	w := httptest.NewRecorder()
+	opts := OutOptions{Format: FormatSSE, Keepalive: 10 * time.Millisecond}
+	require.NoError(t, StreamOut(ctx, w, "test", sm, opts))
+
+	assert.Contains(t, w.Body.String(), ": keepalive\n\n")
+}
@@ -0,0 +1,187 @@
+package stream
+
+import (
+	"log/slog"
+	"sort"
+)
+
+// group is a named set of readers sharing a stream's events, each event going
+// to just one of them.
+type group struct {
+	name    string
+	members []*Reader
+
+	// next is the member whose turn it is
+	next int
+
+	// left is closed, and replaced, whenever a member leaves.
+	left chan struct{}
+}
+
+// GroupInfo describes a consumer group.
+type GroupInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
+
+// joinGroup adds a reader to the named group, creating it if needed. Requires
+// the stream to be locked.
+func (s *Stream) joinGroup(name string, r *Reader) {
+	g, ok := s.groups[name]
+	if !ok {
+		g = &group{name: name, left: make(chan struct{})}
+		s.groups[name] = g
+	}
+
+	r.group = name
+	g.members = append(g.members, r)
+	slog.Debug("reader joined group", "stream", s.Name, "group", name, "members", len(g.members))
+}
+
+// leaveGroup removes a reader from its group, returning the group if it still
+// has members to take over the reader's events. Requires the stream to be
+// locked.
+func (s *Stream) leaveGroup(r *Reader) *group {
+	g, ok := s.groups[r.group]
+	if !ok {
+		return nil
+	}
+
+	for i, m := range g.members {
+		if m == r {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.signal()
+	slog.Debug("reader left group", "stream", s.Name, "group", g.name, "members", len(g.members))
+
+	if len(g.members) == 0 {
+		delete(s.groups, g.name)
+		return nil
+	}
+	return g
+}
+
+// signal wakes anyone waiting for a member to leave. Requires the stream to be
+// locked.
+func (g *group) signal() {
+	close(g.left)
+	g.left = make(chan struct{})
+}
+
+// turn picks the members to offer the next event to, starting with the one
+// whose turn it is. Members that are closed but yet to leave are skipped. It
+// also returns a channel closed when a member next leaves.
+func (s *Stream) turn(g *group) ([]*Reader, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(g.members)
+	if n == 0 {
+		return nil, nil
+	}
+
+	start := g.next % n
+	g.next = start + 1
+
+	members := make([]*Reader, 0, n)
+	for i := 0; i < n; i++ {
+		r := g.members[(start+i)%n]
+		if !r.isClosed() {
+			members = append(members, r)
+		}
+	}
+	return members, g.left
+}
+
+// deliverGroup hands an event to one member of a group, returning whether one
+// took it and the number of events dropped. Members are taken in turn,
+// skipping those with full buffers. When every member is full the stream's
+// policy applies to the one whose turn it is.
+func (s *Stream) deliverGroup(g *group, e Event) (bool, uint64) {
+	for {
+		members, left := s.turn(g)
+		if left == nil {
+			// Everyone left, so there is no one to take it
+			return false, 1
+		}
+		if len(members) == 0 {
+			// Everyone is on their way out, so see who is left once they go
+			<-left
+			continue
+		}
+
+		for _, r := range members {
+			if r.tryDeliver(e) {
+				return true, 0
+			}
+		}
+
+		r := members[0]
+		delivered, ok, dropped := r.deliverCounted(e)
+		if !ok {
+			slog.Warn("disconnecting slow group member from stream", "stream", s.Name, "group", g.name)
+			s.disconnect(r)
+		}
+		if delivered || dropped > 0 {
+			return delivered, dropped
+		}
+
+		// The member closed while we waited, so try whoever is left once it
+		// has gone
+		<-left
+	}
+}
+
+// redeliver hands the events a departing member hadn't finished with to the
+// rest of its group, or counts them as dropped if there's no one left.
+func (s *Stream) redeliver(g *group, r *Reader) {
+	events := r.unfinished()
+	if len(events) == 0 {
+		return
+	}
+
+	slog.Info("redelivering events from departed group member", "stream", s.Name, "group", r.group, "events", len(events))
+
+	var dropped uint64
+	for _, e := range events {
+		e.Dropped = 0
+		if g == nil {
+			dropped++
+			continue
+		}
+		_, n := s.deliverGroup(g, e)
+		dropped += n
+	}
+
+	if dropped > 0 {
+		s.mu.Lock()
+		s.stats.dropped += dropped
+		s.metrics.drop(dropped)
+		s.mu.Unlock()
+	}
+}
+
+// groupInfo requires the stream to be locked.
+func (s *Stream) groupInfo() []GroupInfo {
+	var groups []GroupInfo
+	for _, g := range s.groups {
+		groups = append(groups, GroupInfo{Name: g.name, Members: len(g.members)})
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+
+	return groups
+}
+
+// groupMembers requires the stream to be locked.
+func (s *Stream) groupMembers() int {
+	n := 0
+	for _, g := range s.groups {
+		n += len(g.members)
+	}
+	return n
+}
@@ -0,0 +1,147 @@
+package stream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func publishN(t *testing.T, sm *Manager, name string, n int) {
+	t.Helper()
+	msgs := make([]string, n)
+	for i := range msgs {
+		msgs[i] = fmt.Sprint(i)
+	}
+	publish(t, sm, name, msgs...)
+}
+
+// collect receives events until none arrive for a little while.
+func collect(r *Reader) []string {
+	var got []string
+	for {
+		select {
+		case e, ok := <-r.C:
+			if !ok {
+				return got
+			}
+			got = append(got, string(e.Data))
+		case <-time.After(50 * time.Millisecond):
+			return got
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	sm := NewManager()
+
+	all := sm.GetReader("ci", ReaderOptions{BufferSize: 16})
+	defer sm.ReturnReader("ci", all)
+
+	a := sm.GetReader("ci", ReaderOptions{Group: "workers", BufferSize: 16})
+	defer sm.ReturnReader("ci", a)
+	b := sm.GetReader("ci", ReaderOptions{Group: "workers", BufferSize: 16})
+	defer sm.ReturnReader("ci", b)
+
+	publishN(t, sm, "ci", 10)
+
+	gotA, gotB := collect(a), collect(b)
+	assert.Len(t, gotA, 5, "members take turns")
+	assert.Len(t, gotB, 5)
+	assert.ElementsMatch(t, collect(all), append(gotA, gotB...), "each event goes to one member")
+
+	info, ok := sm.Stream("ci")
+	require.True(t, ok)
+	assert.Equal(t, 3, info.Readers)
+	assert.Equal(t, []GroupInfo{{Name: "workers", Members: 2}}, info.Groups)
+}
+
+func TestGroupSkipsFullMembers(t *testing.T) {
+	sm := NewManager()
+
+	a := sm.GetReader("ci", ReaderOptions{Group: "workers", BufferSize: 1})
+	defer sm.ReturnReader("ci", a)
+	b := sm.GetReader("ci", ReaderOptions{Group: "workers", BufferSize: 16})
+	defer sm.ReturnReader("ci", b)
+
+	publishN(t, sm, "ci", 6)
+
+	assert.Len(t, collect(a), 1)
+	assert.Len(t, collect(b), 5)
+
+	info, _ := sm.Stream("ci")
+	assert.Zero(t, info.Dropped)
+}
+
+func TestGroupRedelivery(t *testing.T) {
+	sm := NewManager()
+
+	a := sm.GetReader("ci", ReaderOptions{Group: "workers", BufferSize: 16})
+	b := sm.GetReader("ci", ReaderOptions{Group: "workers", BufferSize: 16})
+	defer sm.ReturnReader("ci", b)
+
+	publishN(t, sm, "ci", 4)
+
+	// a fails partway through its first event and leaves without reading
+	// the rest
+	e := <-a.C
+	a.Redeliver(e)
+	sm.ReturnReader("ci", a)
+
+	assert.ElementsMatch(t, []string{"0", "1", "2", "3"}, collect(b))
+
+	info, _ := sm.Stream("ci")
+	assert.Equal(t, []GroupInfo{{Name: "workers", Members: 1}}, info.Groups)
+}
+
+func TestGroupLastMemberLeaves(t *testing.T) {
+	sm := NewManager()
+	w := sm.GetWriter("ci")
+	defer sm.ReturnWriter("ci")
+
+	a := sm.GetReader("ci", ReaderOptions{Group: "workers", BufferSize: 16})
+	publishN(t, sm, "ci", 2)
+	require.Eventually(t, func() bool { return len(a.C) == 2 }, time.Second, time.Millisecond)
+	sm.ReturnReader("ci", a)
+
+	assert.Eventually(t, func() bool {
+		info, _ := sm.Stream("ci")
+		return info.Dropped == 2 && len(info.Groups) == 0
+	}, time.Second, time.Millisecond)
+
+	// A new member starts afresh
+	b := sm.GetReader("ci", ReaderOptions{Group: "workers"})
+	defer sm.ReturnReader("ci", b)
+	w <- NewEvent("text/plain", []byte("next"))
+	assert.Equal(t, []string{"next"}, collect(b))
+}
+
+func TestGroupClosedMember(t *testing.T) {
+	sm := NewManager()
+
+	a := sm.GetReader("ci", ReaderOptions{Group: "workers", BufferSize: 16})
+	b := sm.GetReader("ci", ReaderOptions{Group: "workers", BufferSize: 16})
+
+	// a is on its way out but hasn't left yet, so it's passed over
+	a.close()
+	publishN(t, sm, "ci", 4)
+	assert.Equal(t, []string{"0", "1", "2", "3"}, collect(b))
+
+	// With no one else, delivery waits for it to leave rather than spinning
+	sm.ReturnReader("ci", b)
+	w := sm.GetWriter("ci")
+	defer sm.ReturnWriter("ci")
+	w <- NewEvent("text/plain", []byte("4"))
+
+	time.Sleep(20 * time.Millisecond)
+	info, _ := sm.Stream("ci")
+	assert.Zero(t, info.Dropped)
+
+	sm.ReturnReader("ci", a)
+	assert.Eventually(t, func() bool {
+		info, _ := sm.Stream("ci")
+		return info.Dropped == 1 && len(info.Groups) == 0
+	}, time.Second, time.Millisecond)
+}
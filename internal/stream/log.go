@@ -0,0 +1,505 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentBytes = 4 << 20
+	DefaultLogMaxBytes  = 64 << 20
+	DefaultLogMaxAge    = 24 * time.Hour
+
+	segmentExt = ".seg"
+
+	// recordHeaderSize is the length and checksum preceding each record.
+	recordHeaderSize = 8
+
+	// maxRecordSize guards against allocating for a corrupt length.
+	maxRecordSize = 256 << 20
+)
+
+var (
+	errCorruptRecord = errors.New("corrupt record")
+	errRecordTooBig  = errors.New("event too big for the log")
+)
+
+// LogConfig configures the durable log kept for each stream.
+type LogConfig struct {
+	// Dir holds one directory of segment files per stream.
+	Dir string
+
+	// SegmentBytes is the size at which the active segment is rolled.
+	SegmentBytes int64
+
+	// MaxBytes bounds the total size of a stream's log. Zero means unlimited.
+	MaxBytes int64
+
+	// MaxAge removes segments whose newest event is older than this. Zero
+	// means unlimited.
+	MaxAge time.Duration
+}
+
+type segment struct {
+	base    uint64
+	next    uint64
+	size    int64
+	modTime time.Time
+	path    string
+}
+
+// Log is an append-only sequence of events stored as segment files on disk.
+// Each event is assigned an offset, starting at 1, that never changes.
+//
+// Records are written straight to the file without fsync, so they survive the
+// process crashing but not necessarily the machine losing power.
+type Log struct {
+	dir      string
+	cfg      LogConfig
+	segments []*segment
+	active   *os.File
+	next     uint64
+
+	mu sync.Mutex
+}
+
+// logDir is the directory holding the segments for a stream.
+func logDir(root, name string) string {
+	return filepath.Join(root, url.PathEscape(name))
+}
+
+// OpenLog opens the log in dir, recovering any existing segments. A partially
+// written record at the end of the log, as left by a crash, is truncated.
+func OpenLog(dir string, cfg LogConfig) (*Log, error) {
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = DefaultSegmentBytes
+	}
+
+	l := &Log{dir: dir, cfg: cfg, next: 1}
+
+	err := l.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	l.retain()
+
+	return l, nil
+}
+
+func (l *Log) recover() error {
+	files, err := os.ReadDir(l.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		base, ok := strings.CutSuffix(f.Name(), segmentExt)
+		if !ok || f.IsDir() {
+			continue
+		}
+
+		offset, err := strconv.ParseUint(base, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		l.segments = append(l.segments, &segment{
+			base: offset,
+			path: filepath.Join(l.dir, f.Name()),
+		})
+	}
+
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].base < l.segments[j].base
+	})
+
+	for i, seg := range l.segments {
+		last := i == len(l.segments)-1
+		err := scanSegment(seg, last)
+		if err != nil {
+			return fmt.Errorf("recovering %s: %w", seg.path, err)
+		}
+	}
+
+	if len(l.segments) > 0 {
+		l.next = l.segments[len(l.segments)-1].next
+	}
+
+	return nil
+}
+
+// scanSegment reads every record in a segment to find its extent. Trailing
+// garbage is truncated from the last segment.
+func scanSegment(seg *segment, last bool) error {
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	seg.modTime = info.ModTime()
+	seg.next = seg.base
+
+	r := bufio.NewReader(f)
+	var size int64
+	for {
+		e, n, err := readRecord(r, info.Size()-size)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			slog.Warn("truncating damaged log segment", "path", seg.path, "offset", seg.next, "error", err)
+			break
+		}
+		if e.Offset != seg.next {
+			slog.Warn("truncating out of sequence log segment", "path", seg.path, "offset", e.Offset, "expected", seg.next)
+			break
+		}
+
+		size += n
+		seg.next++
+	}
+
+	seg.size = size
+	if last && size < info.Size() {
+		return f.Truncate(size)
+	}
+
+	return nil
+}
+
+func (l *Log) roll() error {
+	if l.active != nil {
+		err := l.active.Close()
+		if err != nil {
+			return err
+		}
+		l.active = nil
+	}
+
+	err := os.MkdirAll(l.dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	seg := &segment{
+		base:    l.next,
+		next:    l.next,
+		modTime: time.Now(),
+		path:    filepath.Join(l.dir, fmt.Sprintf("%020d%s", l.next, segmentExt)),
+	}
+
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	l.active = f
+	l.segments = append(l.segments, seg)
+	l.retain()
+
+	return nil
+}
+
+// openActive reopens the last recovered segment for appending.
+func (l *Log) openActive() error {
+	if len(l.segments) == 0 {
+		return l.roll()
+	}
+
+	seg := l.segments[len(l.segments)-1]
+	if seg.size >= l.cfg.SegmentBytes {
+		return l.roll()
+	}
+
+	f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.active = f
+
+	return nil
+}
+
+// Append writes an event to the log and returns the offset assigned to it.
+func (l *Log) Append(e Event) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		err := l.openActive()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	seg := l.segments[len(l.segments)-1]
+	if seg.size >= l.cfg.SegmentBytes {
+		err := l.roll()
+		if err != nil {
+			return 0, err
+		}
+		seg = l.segments[len(l.segments)-1]
+	}
+
+	e.Offset = l.next
+	record, err := encodeRecord(e)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = l.active.Write(record)
+	if err != nil {
+		return 0, err
+	}
+
+	seg.size += int64(len(record))
+	seg.next = l.next + 1
+	seg.modTime = time.Now()
+	l.next++
+
+	l.retainAge()
+
+	return e.Offset, nil
+}
+
+// retain removes the oldest segments until the log is within its limits.
+// The active segment is never removed.
+func (l *Log) retain() {
+	if l.cfg.MaxBytes > 0 {
+		var total int64
+		for _, seg := range l.segments {
+			total += seg.size
+		}
+
+		for len(l.segments) > 1 && total > l.cfg.MaxBytes {
+			total -= l.segments[0].size
+			l.removeOldest()
+		}
+	}
+
+	l.retainAge()
+}
+
+func (l *Log) retainAge() {
+	if l.cfg.MaxAge <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-l.cfg.MaxAge)
+	for len(l.segments) > 1 && l.segments[0].modTime.Before(cutoff) {
+		l.removeOldest()
+	}
+}
+
+func (l *Log) removeOldest() {
+	seg := l.segments[0]
+	l.segments = l.segments[1:]
+
+	err := os.Remove(seg.path)
+	if err != nil {
+		slog.Error("error removing log segment", "path", seg.path, "error", err)
+		return
+	}
+	slog.Debug("removed log segment", "path", seg.path)
+}
+
+// FirstOffset is the offset of the oldest event still retained.
+func (l *Log) FirstOffset() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.segments) == 0 {
+		return l.next
+	}
+	return l.segments[0].base
+}
+
+// NextOffset is the offset the next appended event will receive.
+func (l *Log) NextOffset() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.next
+}
+
+// Read returns up to limit events starting at offset. Offsets older than the
+// retained log start from the oldest event instead.
+func (l *Log) Read(offset uint64, limit int) ([]Event, error) {
+	l.mu.Lock()
+	segments := make([]segment, len(l.segments))
+	for i, seg := range l.segments {
+		segments[i] = *seg
+	}
+	l.mu.Unlock()
+
+	events := make([]Event, 0)
+	for _, seg := range segments {
+		if len(events) >= limit {
+			break
+		}
+		if seg.next <= offset {
+			continue
+		}
+
+		var err error
+		events, err = readSegment(seg, offset, limit, events)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+func readSegment(seg segment, offset uint64, limit int, events []Event) ([]Event, error) {
+	f, err := os.Open(seg.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Removed by retention since we looked
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Only read what was written when we looked, the active segment may
+	// be growing underneath us.
+	r := bufio.NewReader(io.LimitReader(f, seg.size))
+	var read int64
+	for len(events) < limit {
+		e, n, err := readRecord(r, seg.size-read)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", seg.path, err)
+		}
+		read += n
+
+		if e.Offset < offset {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// Close syncs and closes the active segment.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return nil
+	}
+
+	err := l.active.Sync()
+	if cerr := l.active.Close(); err == nil {
+		err = cerr
+	}
+	l.active = nil
+	return err
+}
+
+// Records are framed as:
+//
+//	uint32 body length
+//	uint32 crc32 of body
+//	body: uint64 offset, uint32 metadata length, metadata JSON, data
+func encodeRecord(e Event) ([]byte, error) {
+	data := e.Data
+	e.Data = nil
+
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyLen := 8 + 4 + len(meta) + len(data)
+	if bodyLen > maxRecordSize {
+		return nil, errRecordTooBig
+	}
+	b := make([]byte, recordHeaderSize+bodyLen)
+
+	body := b[recordHeaderSize:]
+	binary.BigEndian.PutUint64(body[0:], e.Offset)
+	binary.BigEndian.PutUint32(body[8:], uint32(len(meta)))
+	copy(body[12:], meta)
+	copy(body[12+len(meta):], data)
+
+	binary.BigEndian.PutUint32(b[0:], uint32(bodyLen))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(body))
+
+	return b, nil
+}
+
+// readRecord decodes the next record from the remaining bytes of a segment,
+// returning the event and the number of bytes consumed. io.EOF is only
+// returned at a clean record boundary.
+func readRecord(r io.Reader, remaining int64) (Event, int64, error) {
+	var e Event
+
+	header := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if errors.Is(err, io.EOF) {
+		return e, 0, io.EOF
+	}
+	if err != nil {
+		return e, 0, errCorruptRecord
+	}
+
+	bodyLen := binary.BigEndian.Uint32(header[0:])
+	if bodyLen < 12 || bodyLen > maxRecordSize || int64(bodyLen) > remaining-recordHeaderSize {
+		return e, 0, errCorruptRecord
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return e, 0, errCorruptRecord
+	}
+
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return e, 0, errCorruptRecord
+	}
+
+	offset := binary.BigEndian.Uint64(body[0:])
+	metaLen := binary.BigEndian.Uint32(body[8:])
+	if 12+int64(metaLen) > int64(bodyLen) {
+		return e, 0, errCorruptRecord
+	}
+
+	err = json.Unmarshal(body[12:12+metaLen], &e)
+	if err != nil {
+		return e, 0, errCorruptRecord
+	}
+
+	e.Offset = offset
+	e.Data = body[12+metaLen:]
+
+	return e, int64(recordHeaderSize + bodyLen), nil
+}
@@ -0,0 +1,198 @@
+package stream
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendN(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := l.Append(NewEvent("text/plain", []byte(fmt.Sprintf("event %d", i))))
+		require.NoError(t, err)
+	}
+}
+
+func TestLogAppendRead(t *testing.T) {
+	l, err := OpenLog(t.TempDir(), LogConfig{SegmentBytes: 256})
+	require.NoError(t, err)
+	defer l.Close()
+
+	appendN(t, l, 20)
+
+	assert.Equal(t, uint64(1), l.FirstOffset())
+	assert.Equal(t, uint64(21), l.NextOffset())
+	assert.Greater(t, len(l.segments), 1, "expected log to roll segments")
+
+	events, err := l.Read(5, 3)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	for i, e := range events {
+		assert.Equal(t, uint64(5+i), e.Offset)
+		assert.Equal(t, fmt.Sprintf("event %d", 4+i), string(e.Data))
+		assert.Equal(t, "text/plain", e.ContentType)
+	}
+
+	events, err = l.Read(19, 10)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+}
+
+func TestLogRecover(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := OpenLog(dir, LogConfig{SegmentBytes: 256})
+	require.NoError(t, err)
+	appendN(t, l, 10)
+	require.NoError(t, l.Close())
+
+	// Simulate a crash part way through writing a record
+	seg := l.segments[len(l.segments)-1]
+	f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	l, err = OpenLog(dir, LogConfig{SegmentBytes: 256})
+	require.NoError(t, err)
+	defer l.Close()
+
+	assert.Equal(t, uint64(11), l.NextOffset())
+
+	offset, err := l.Append(NewEvent("text/plain", []byte("after crash")))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), offset)
+
+	events, err := l.Read(10, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "event 9", string(events[0].Data))
+	assert.Equal(t, "after crash", string(events[1].Data))
+
+	t.Run("corrupt length", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := OpenLog(dir, LogConfig{})
+		require.NoError(t, err)
+		appendN(t, l, 3)
+		require.NoError(t, l.Close())
+
+		// A length far beyond the segment isn't read
+		f, err := os.OpenFile(l.segments[0].path, os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, 1, 2, 3})
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		l, err = OpenLog(dir, LogConfig{})
+		require.NoError(t, err)
+		defer l.Close()
+		assert.Equal(t, uint64(4), l.NextOffset())
+	})
+}
+
+func TestLogRetention(t *testing.T) {
+	t.Run("size", func(t *testing.T) {
+		l, err := OpenLog(t.TempDir(), LogConfig{SegmentBytes: 256, MaxBytes: 1024})
+		require.NoError(t, err)
+		defer l.Close()
+
+		appendN(t, l, 100)
+
+		var total int64
+		for _, seg := range l.segments {
+			total += seg.size
+		}
+		assert.LessOrEqual(t, total, int64(1024+256))
+		assert.Greater(t, l.FirstOffset(), uint64(1))
+
+		events, err := l.Read(0, 1)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, l.FirstOffset(), events[0].Offset)
+	})
+
+	t.Run("age", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := OpenLog(dir, LogConfig{SegmentBytes: 256})
+		require.NoError(t, err)
+		appendN(t, l, 20)
+		require.NoError(t, l.Close())
+
+		old := time.Now().Add(-2 * time.Hour)
+		for _, seg := range l.segments[:len(l.segments)-1] {
+			require.NoError(t, os.Chtimes(seg.path, old, old))
+		}
+
+		l, err = OpenLog(dir, LogConfig{SegmentBytes: 256, MaxAge: time.Hour})
+		require.NoError(t, err)
+		defer l.Close()
+
+		assert.Len(t, l.segments, 1)
+		files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+		require.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+}
+
+func TestManagerLog(t *testing.T) {
+	dir := t.TempDir()
+	cfg := LogConfig{Dir: dir, SegmentBytes: 256}
+
+	sm := NewManager()
+	require.NoError(t, sm.OpenLog(cfg))
+
+	live := sm.GetReader("test/log", ReaderOptions{})
+	publish(t, sm, "test/log", "one", "two", "three")
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, uint64(i), receive(t, live).Offset)
+	}
+	sm.ReturnReader("test/log", live)
+
+	// A new manager over the same directory recovers the stream
+	sm = NewManager()
+	require.NoError(t, sm.OpenLog(cfg))
+
+	page, err := sm.History("test/log", 2, 10)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), page.FirstOffset)
+	assert.Equal(t, uint64(3), page.LastOffset)
+	assert.Equal(t, uint64(4), page.Next)
+	require.Len(t, page.Events, 2)
+	assert.Equal(t, "two", string(page.Events[0].Data))
+
+	t.Run("replay buffer recovered", func(t *testing.T) {
+		ch := sm.GetReader("test/log", ReaderOptions{Last: 1})
+		defer sm.ReturnReader("test/log", ch)
+		assert.Equal(t, "three", string(receive(t, ch).Data))
+	})
+
+	t.Run("replay from offset then live", func(t *testing.T) {
+		ch := sm.GetReader("test/log", ReaderOptions{Offset: 2})
+		defer sm.ReturnReader("test/log", ch)
+
+		assert.Equal(t, "two", string(receive(t, ch).Data))
+		assert.Equal(t, "three", string(receive(t, ch).Data))
+
+		publish(t, sm, "test/log", "four")
+		e := receive(t, ch)
+		assert.Equal(t, "four", string(e.Data))
+		assert.Equal(t, uint64(4), e.Offset)
+	})
+
+	t.Run("close while catching up", func(t *testing.T) {
+		ch := sm.GetReader("test/log", ReaderOptions{Offset: 1})
+		sm.ReturnReader("test/log", ch)
+	})
+
+	t.Run("no log", func(t *testing.T) {
+		_, err := NewManager().History("test/log", 0, 10)
+		assert.ErrorIs(t, err, ErrNoLog)
+	})
+}
@@ -0,0 +1,654 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultIdleExpiry is how long a stream is kept, replay buffer and all, once
+// nothing is using it.
+const DefaultIdleExpiry = 10 * time.Minute
+
+type Manager struct {
+	streams   map[string]*Stream
+	policies  map[string]Policy
+	logConfig *LogConfig
+
+	// patterns holds the readers subscribed by pattern rather than name
+	patterns map[*Reader]string
+
+	// retained holds the names and patterns of streams that retain their
+	// last event
+	retained map[string]bool
+
+	// queued holds the acked readers, which are members of a queue
+	queued map[*Reader]*queue
+
+	// ttls holds the default time to live of streams and patterns
+	ttls map[string]time.Duration
+
+	// schemas holds the schemas of streams and patterns
+	schemas map[string]Registration
+
+	// metrics is set once the manager is instrumented
+	metrics *Metrics
+
+	// idleExpiry is how long a stream that has been written to is kept once
+	// nothing is using it
+	idleExpiry time.Duration
+
+	// closed refuses publishing once the manager is closing, and publishing
+	// counts the publishes under way
+	closed     bool
+	publishing sync.WaitGroup
+
+	mu sync.RWMutex
+}
+
+// SetPolicy sets the delivery policy for a stream, or every stream matching a
+// pattern, whether or not they exist yet. Readers already connected keep the
+// policy they started with.
+func (sm *Manager) SetPolicy(name string, p Policy) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.policies[name] = p
+	for streamName, s := range sm.streams {
+		if streamName == name || Match(name, streamName) {
+			s.SetPolicy(sm.policy(streamName))
+		}
+	}
+}
+
+// SetRetained sets whether a stream, or every stream matching a pattern,
+// retains its last event for readers that connect later.
+func (sm *Manager) SetRetained(name string, retain bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.retained[name] = retain
+	for streamName, s := range sm.streams {
+		if streamName == name || Match(name, streamName) {
+			s.SetRetain(sm.retains(streamName))
+		}
+	}
+}
+
+// retains requires the manager to be locked.
+func (sm *Manager) retains(name string) bool {
+	r, _ := lookup(sm.retained, name)
+	return r
+}
+
+// Latest returns the retained event of a stream, if it has one that hasn't
+// expired, with its remaining TTL.
+func (sm *Manager) Latest(name string) (Event, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	s, ok := sm.streams[name]
+	if !ok {
+		return Event{}, false
+	}
+	return s.Latest()
+}
+
+// policy finds the policy for a stream by name, or else the longest pattern
+// matching it. Requires the manager to be locked.
+func (sm *Manager) policy(name string) Policy {
+	if p, ok := lookup(sm.policies, name); ok {
+		return p
+	}
+	return DefaultPolicy
+}
+
+// OpenLog enables a durable log for every stream, recovering the streams
+// already stored under cfg.Dir. Like any other, they close once they've been
+// idle for a while, to be reopened from the log when next used.
+func (sm *Manager) OpenLog(cfg LogConfig) error {
+	err := os.MkdirAll(cfg.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	dirs, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.logConfig = &cfg
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		name, err := url.PathUnescape(d.Name())
+		if err != nil {
+			slog.Warn("ignoring unknown directory in stream log", "dir", d.Name())
+			continue
+		}
+
+		if _, ok := sm.streams[name]; ok {
+			continue
+		}
+
+		s := sm.newStream(name)
+		s.mu.Lock()
+		closed := s.maybeClose()
+		s.mu.Unlock()
+		if closed {
+			continue
+		}
+
+		sm.streams[name] = s
+		slog.Info("recovered stream from log", "stream", name)
+	}
+
+	return nil
+}
+
+// newStream creates a stream, with a log if they are enabled. Requires the
+// manager to be locked.
+func (sm *Manager) newStream(name string) *Stream {
+	policy := sm.policy(name)
+
+	var log *Log
+	if sm.logConfig != nil {
+		var err error
+		log, err = OpenLog(logDir(sm.logConfig.Dir, name), *sm.logConfig)
+		if err != nil {
+			slog.Error("error opening stream log", "stream", name, "error", err)
+		}
+	}
+
+	s := newStream(name, policy, sm.retains(name), log)
+	s.ttl = sm.ttl(name)
+	if sm.metrics != nil {
+		s.metrics = sm.metrics.forStream(name)
+	}
+
+	for r, pattern := range sm.patterns {
+		if Match(pattern, name) {
+			s.dataOut = append(s.dataOut, r)
+		}
+	}
+
+	return s
+}
+
+// ErrNoLog is returned when reading history from a stream without a log.
+var ErrNoLog = errors.New("stream has no log")
+
+// HistoryPage is a slice of a stream's durable log.
+type HistoryPage struct {
+	Stream      string  `json:"stream"`
+	FirstOffset uint64  `json:"first_offset"`
+	LastOffset  uint64  `json:"last_offset"`
+	Next        uint64  `json:"next"`
+	Events      []Event `json:"events"`
+}
+
+// History reads up to limit events from a stream's log starting at offset.
+func (sm *Manager) History(name string, offset uint64, limit int) (HistoryPage, error) {
+	page := HistoryPage{Stream: name, Next: offset, Events: make([]Event, 0)}
+
+	s, err := sm.historyStream(name)
+	if err != nil || s == nil {
+		return page, err
+	}
+	defer sm.releaseHistory(name, s)
+
+	if s.log == nil {
+		return page, ErrNoLog
+	}
+
+	page.FirstOffset = s.log.FirstOffset()
+	page.LastOffset = s.log.NextOffset() - 1
+	if page.Next < page.FirstOffset {
+		page.Next = page.FirstOffset
+	}
+
+	events, err := s.log.Read(offset, limit)
+	if err != nil {
+		return page, err
+	}
+
+	page.Events = events
+	if len(events) > 0 {
+		page.Next = events[len(events)-1].Offset + 1
+	}
+
+	return page, nil
+}
+
+// historyStream opens a stream for reading its log, to be returned with
+// releaseHistory. A closed stream is reopened if it has a log on disk, and
+// otherwise there's no history and it returns nil.
+func (sm *Manager) historyStream(name string) (*Stream, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s := sm.streams[name]
+	if s == nil {
+		if sm.logConfig == nil {
+			return nil, ErrNoLog
+		}
+
+		// Not to leave a directory behind for any name asked about
+		_, err := os.Stat(logDir(sm.logConfig.Dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		s = sm.newStream(name)
+		sm.streams[name] = s
+	}
+
+	s.mu.Lock()
+	s.reading++
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+// releaseHistory follows historyStream, closing the stream if nothing else is
+// using it.
+func (sm *Manager) releaseHistory(name string, s *Stream) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s.mu.Lock()
+	s.reading--
+	closed := s.maybeClose()
+	s.mu.Unlock()
+
+	if closed && sm.streams[name] == s {
+		delete(sm.streams, name)
+		slog.Debug("stream closed", "stream", name)
+	}
+}
+
+func (sm *Manager) GetWriter(name string) StreamChan {
+	return sm.writer(name).dataIn
+}
+
+// writer opens a stream for writing, to be returned with ReturnWriter.
+func (sm *Manager) writer(name string) *Stream {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s, ok := sm.streams[name]
+	if !ok {
+		s = sm.newStream(name)
+		sm.streams[name] = s
+	}
+
+	s.Writer()
+	return s
+}
+
+// PublishBatch publishes events, each to the stream it names, in order, all
+// or none of them. Every stream the batch names is held for it before anything
+// is published, so events from other publishers don't come in between, and if
+// ctx is done first nothing is published. If any event doesn't satisfy its
+// stream's schema none are published. Once the manager is closed it returns
+// ErrClosed.
+func (sm *Manager) PublishBatch(ctx context.Context, events []Event) error {
+	err := sm.begin()
+	if err != nil {
+		return err
+	}
+	defer sm.publishing.Done()
+
+	// Nothing is published unless everything is valid, and only once the
+	// batch is refused are its invalid events dead lettered
+	var invalid ValidationErrors
+	for i, e := range events {
+		err := sm.Validate(e.Stream, e)
+		if verr, ok := err.(*ValidationError); ok {
+			verr.Index = i
+			invalid = append(invalid, verr)
+		}
+	}
+	if len(invalid) > 0 {
+		for _, verr := range invalid {
+			sm.deadLetter(ctx, verr.Stream, events[verr.Index])
+		}
+		return invalid
+	}
+
+	// Held in name order, so batches waiting on each other's streams can't
+	// each hold one the other wants
+	var names []string
+	holds := make(map[string]*hold)
+	for _, e := range events {
+		if _, ok := holds[e.Stream]; !ok {
+			holds[e.Stream] = nil
+			names = append(names, e.Stream)
+		}
+	}
+	sort.Strings(names)
+
+	defer func() {
+		for name, h := range holds {
+			if h != nil {
+				close(h.runs)
+				sm.ReturnWriter(name)
+			}
+		}
+	}()
+
+	for _, name := range names {
+		s := sm.writer(name)
+		h := newHold()
+		select {
+		case s.holdIn <- h:
+			holds[name] = h
+		case <-ctx.Done():
+			sm.ReturnWriter(name)
+			return ctx.Err()
+		}
+	}
+
+	for len(events) > 0 {
+		name := events[0].Stream
+		n := 1
+		for n < len(events) && events[n].Stream == name {
+			n++
+		}
+
+		batch := make([]Event, n)
+		copy(batch, events[:n])
+		holds[name].publish(batch)
+
+		events = events[n:]
+	}
+
+	return nil
+}
+
+func (sm *Manager) ReturnWriter(name string) {
+	sm.mu.Lock()
+	s := sm.streams[name]
+	if s == nil {
+		sm.mu.Unlock()
+		slog.Warn("stream not found", "stream", name)
+		return
+	}
+	idle := s.CloseWriter()
+	sm.mu.Unlock()
+
+	if !idle {
+		return
+	}
+
+	// The stream may have taken an event it hasn't published yet, which
+	// would be lost from its replay buffer if it were closed first
+	s.flush()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if s.flushed() && sm.streams[name] == s {
+		delete(sm.streams, name)
+		slog.Debug("stream closed", "stream", name)
+	}
+}
+
+func (sm *Manager) ReturnReader(name string, r *Reader) {
+	sm.mu.Lock()
+
+	// Leaving a queue may publish to a dead letter stream, so let go first
+	if q, ok := sm.queued[r]; ok {
+		delete(sm.queued, r)
+		sm.mu.Unlock()
+		q.leave(r)
+		return
+	}
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.patterns[r]; ok {
+		sm.returnPatternReader(r)
+		return
+	}
+
+	if sm.streams[name] == nil {
+		slog.Warn("stream not found", "stream", name)
+		return
+	}
+
+	s := sm.streams[name]
+	if s.CloseReader(r) {
+		delete(sm.streams, name)
+		slog.Debug("stream closed", "stream", name)
+		return
+	}
+}
+
+// GetReader subscribes to a stream by name, or to every stream matching a
+// pattern. Pattern readers don't support replaying from an offset, or acked
+// delivery.
+func (sm *Manager) GetReader(name string, opts ReaderOptions) *Reader {
+	r := sm.getReader(name, opts)
+	r.expired = sm.countExpired
+	return r
+}
+
+func (sm *Manager) getReader(name string, opts ReaderOptions) *Reader {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if IsPattern(name) {
+		return sm.getPatternReader(name, opts)
+	}
+
+	if opts.Ack {
+		return sm.getQueueReader(name, opts)
+	}
+
+	var s *Stream
+	if sm.streams[name] != nil {
+		s = sm.streams[name]
+	} else {
+		s = sm.newStream(name)
+		sm.streams[name] = s
+	}
+
+	return s.NewReader(opts)
+}
+
+// getPatternReader requires the manager to be locked.
+func (sm *Manager) getPatternReader(pattern string, opts ReaderOptions) *Reader {
+	var matched []*Stream
+	for name, s := range sm.streams {
+		if Match(pattern, name) {
+			matched = append(matched, s)
+		}
+	}
+
+	// Hold every matching stream still while the replay is gathered and the
+	// reader attached, locking in a consistent order.
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Name < matched[j].Name
+	})
+	for _, s := range matched {
+		s.mu.Lock()
+	}
+
+	var replay []Event
+	if opts.replays() || opts.Retained {
+		for _, s := range matched {
+			replay = append(replay, s.replayFor(opts)...)
+		}
+		sort.SliceStable(replay, func(i, j int) bool {
+			return replay[i].ID.Compare(replay[j].ID) < 0
+		})
+		if opts.Last > 0 && len(replay) > opts.Last {
+			replay = replay[len(replay)-opts.Last:]
+		}
+	}
+
+	policy := sm.policy(pattern)
+	if opts.BufferSize > 0 {
+		policy.BufferSize = opts.BufferSize
+	}
+
+	r := newReader(policy.withDefaults(), len(replay))
+	for _, e := range replay {
+		r.ch <- e
+	}
+
+	for _, s := range matched {
+		s.dataOut = append(s.dataOut, r)
+		s.mu.Unlock()
+	}
+
+	sm.patterns[r] = pattern
+	return r
+}
+
+// returnPatternReader requires the manager to be locked.
+func (sm *Manager) returnPatternReader(r *Reader) {
+	pattern := sm.patterns[r]
+	delete(sm.patterns, r)
+	r.close()
+
+	for name, s := range sm.streams {
+		if !Match(pattern, name) {
+			continue
+		}
+		if s.detach(r) {
+			delete(sm.streams, name)
+			slog.Debug("stream closed", "stream", name)
+		}
+	}
+}
+
+// ErrClosed is returned when publishing to a manager that has been closed.
+var ErrClosed = errors.New("stream manager closed")
+
+// begin counts a publish as under way, unless the manager is closed.
+func (sm *Manager) begin() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.closed {
+		return ErrClosed
+	}
+	sm.publishing.Add(1)
+	return nil
+}
+
+// Close shuts the manager down. Publishing is refused from then on, and those
+// under way are waited for until ctx is done. Once the streams have published
+// what they were given every reader is closed, so subscribers see their stream
+// end, and the stream logs are synced and closed.
+func (sm *Manager) Close(ctx context.Context) error {
+	sm.mu.Lock()
+	sm.closed = true
+	sm.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		sm.publishing.Wait()
+		close(drained)
+	}()
+
+	var errs []error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("waiting for publishes: %w", ctx.Err()))
+	}
+
+	// Held throughout so streams can't close under us. Subscribers returning
+	// their readers wait until we're done.
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for name, s := range sm.streams {
+		err := s.shutdown(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", name, err))
+		}
+	}
+
+	for r := range sm.patterns {
+		r.close()
+	}
+	for r := range sm.queued {
+		r.close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// SetIdleExpiry sets how long a stream that has been written to is kept once
+// nothing is using it, so readers coming back can resume from its replay
+// buffer.
+func (sm *Manager) SetIdleExpiry(d time.Duration) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.idleExpiry = d
+}
+
+// expireIdle closes streams that have been idle for longer than the idle
+// expiry, until the manager is closed.
+func (sm *Manager) expireIdle() {
+	for {
+		sm.mu.RLock()
+		every := min(max(sm.idleExpiry/10, 10*time.Millisecond), time.Minute)
+		sm.mu.RUnlock()
+
+		time.Sleep(every)
+
+		sm.mu.Lock()
+		if sm.closed {
+			sm.mu.Unlock()
+			return
+		}
+
+		now := time.Now()
+		for name, s := range sm.streams {
+			s.mu.Lock()
+			if s.expire(now, sm.idleExpiry) {
+				delete(sm.streams, name)
+				slog.Debug("stream expired", "stream", name)
+			}
+			s.mu.Unlock()
+		}
+		sm.mu.Unlock()
+	}
+}
+
+func NewManager() *Manager {
+	sm := &Manager{
+		streams:    make(map[string]*Stream),
+		policies:   make(map[string]Policy),
+		patterns:   make(map[*Reader]string),
+		retained:   make(map[string]bool),
+		queued:     make(map[*Reader]*queue),
+		ttls:       make(map[string]time.Duration),
+		schemas:    make(map[string]Registration),
+		idleExpiry: DefaultIdleExpiry,
+	}
+
+	go sm.expireIdle()
+
+	return sm
+}
@@ -0,0 +1,237 @@
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMetricsStreams is how many streams get their own label values in
+// metrics by default.
+const DefaultMetricsStreams = 100
+
+// OtherStreams is the stream label of metrics for streams beyond the limit.
+const OtherStreams = "_other"
+
+// Metrics exports the activity of a manager's streams to Prometheus, labeled
+// by stream.
+//
+// Stream names come from clients, so only the first streams seen get a label
+// of their own, and the rest are counted together under OtherStreams. A label
+// once given is kept, so series don't move between labels as streams close
+// and open again.
+type Metrics struct {
+	sm         *Manager
+	maxStreams int
+
+	published *prometheus.CounterVec
+	bytes     *prometheus.CounterVec
+	delivered *prometheus.CounterVec
+	dropped   *prometheus.CounterVec
+	expired   *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+
+	readers *prometheus.Desc
+	writers *prometheus.Desc
+	depth   *prometheus.Desc
+
+	mu     sync.Mutex
+	labels map[string]bool
+}
+
+var _ prometheus.Collector = (*Metrics)(nil)
+
+// Instrument starts collecting metrics for every stream, giving at most
+// maxStreams of them their own label. The returned collector is to be
+// registered with Prometheus.
+func (sm *Manager) Instrument(maxStreams int) *Metrics {
+	labels := []string{"stream"}
+	m := &Metrics{
+		sm:         sm,
+		maxStreams: maxStreams,
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "yakapi_stream_published_total",
+			Help: "The total number of events published to a stream",
+		}, labels),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "yakapi_stream_published_bytes_total",
+			Help: "The total size of the events published to a stream",
+		}, labels),
+		delivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "yakapi_stream_delivered_total",
+			Help: "The total number of events handed to a stream's readers as they were published",
+		}, labels),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "yakapi_stream_dropped_total",
+			Help: "The total number of events dropped by a stream's slow readers",
+		}, labels),
+		expired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "yakapi_stream_expired_total",
+			Help: "The total number of events discarded after their time to live",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "yakapi_stream_delivery_seconds",
+			Help:    "The time from a stream taking an event to a reader taking it",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, labels),
+		readers: prometheus.NewDesc("yakapi_stream_readers",
+			"The number of readers subscribed to a stream", labels, nil),
+		writers: prometheus.NewDesc("yakapi_stream_writers",
+			"The number of writers publishing to a stream", labels, nil),
+		depth: prometheus.NewDesc("yakapi_stream_reader_queue_depth",
+			"The number of events waiting in a stream's reader buffers", labels, nil),
+		labels: make(map[string]bool),
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.metrics = m
+	for name, s := range sm.streams {
+		s.mu.Lock()
+		s.metrics = m.forStream(name)
+		s.mu.Unlock()
+	}
+
+	return m
+}
+
+// label is the stream label value for a stream.
+func (m *Metrics) label(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.labels[name] {
+		return name
+	}
+	if len(m.labels) < m.maxStreams {
+		m.labels[name] = true
+		return name
+	}
+	return OtherStreams
+}
+
+// forStream picks out the series a stream updates, so publishing doesn't look
+// them up each time.
+func (m *Metrics) forStream(name string) *streamMetrics {
+	label := m.label(name)
+	return &streamMetrics{
+		label:     label,
+		published: m.published.WithLabelValues(label),
+		bytes:     m.bytes.WithLabelValues(label),
+		delivered: m.delivered.WithLabelValues(label),
+		dropped:   m.dropped.WithLabelValues(label),
+		expired:   m.expired.WithLabelValues(label),
+		latency:   m.latency.WithLabelValues(label),
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.published.Describe(ch)
+	m.bytes.Describe(ch)
+	m.delivered.Describe(ch)
+	m.dropped.Describe(ch)
+	m.expired.Describe(ch)
+	m.latency.Describe(ch)
+	ch <- m.readers
+	ch <- m.writers
+	ch <- m.depth
+}
+
+// Collect reports the counters as they stand, along with the current readers,
+// writers and buffered events of each open stream.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.published.Collect(ch)
+	m.bytes.Collect(ch)
+	m.delivered.Collect(ch)
+	m.dropped.Collect(ch)
+	m.expired.Collect(ch)
+	m.latency.Collect(ch)
+
+	type gauges struct{ readers, writers, depth int }
+	byLabel := make(map[string]*gauges)
+
+	m.sm.mu.RLock()
+	for _, s := range m.sm.streams {
+		s.mu.RLock()
+		if s.metrics != nil {
+			g := byLabel[s.metrics.label]
+			if g == nil {
+				g = &gauges{}
+				byLabel[s.metrics.label] = g
+			}
+			g.readers += len(s.dataOut) + len(s.catchingUp) + s.groupMembers()
+			g.writers += s.writerCount
+			g.depth += s.buffered()
+		}
+		s.mu.RUnlock()
+	}
+	m.sm.mu.RUnlock()
+
+	for label, g := range byLabel {
+		ch <- prometheus.MustNewConstMetric(m.readers, prometheus.GaugeValue, float64(g.readers), label)
+		ch <- prometheus.MustNewConstMetric(m.writers, prometheus.GaugeValue, float64(g.writers), label)
+		ch <- prometheus.MustNewConstMetric(m.depth, prometheus.GaugeValue, float64(g.depth), label)
+	}
+}
+
+// buffered counts the events waiting in the stream's readers. Requires the
+// stream to be locked.
+func (s *Stream) buffered() int {
+	n := 0
+	for _, r := range s.dataOut {
+		n += len(r.ch)
+	}
+	for r := range s.catchingUp {
+		n += len(r.ch)
+	}
+	for _, g := range s.groups {
+		for _, r := range g.members {
+			n += len(r.ch)
+		}
+	}
+	return n
+}
+
+// streamMetrics are a stream's series. A nil *streamMetrics, for a manager
+// that isn't instrumented, records nothing.
+type streamMetrics struct {
+	label     string
+	published prometheus.Counter
+	bytes     prometheus.Counter
+	delivered prometheus.Counter
+	dropped   prometheus.Counter
+	expired   prometheus.Counter
+	latency   prometheus.Observer
+}
+
+func (m *streamMetrics) publish(e Event) {
+	if m == nil {
+		return
+	}
+	m.published.Inc()
+	m.bytes.Add(float64(len(e.Data)))
+}
+
+func (m *streamMetrics) deliver(latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.delivered.Inc()
+	m.latency.Observe(latency.Seconds())
+}
+
+func (m *streamMetrics) drop(n uint64) {
+	if m == nil {
+		return
+	}
+	m.dropped.Add(float64(n))
+}
+
+func (m *streamMetrics) expire(n uint64) {
+	if m == nil {
+		return
+	}
+	m.expired.Add(float64(n))
+}
@@ -0,0 +1,64 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	sm := NewManager()
+
+	// Streams open before instrumenting are counted too
+	early := sm.GetReader("telemetry", ReaderOptions{})
+	defer sm.ReturnReader("telemetry", early)
+
+	m := sm.Instrument(2)
+
+	publish(t, sm, "telemetry", "hello")
+	receive(t, early)
+
+	sm.SetPolicy("motor", Policy{Delivery: DropNewest, BufferSize: 1})
+	slow := sm.GetReader("motor", ReaderOptions{})
+	defer sm.ReturnReader("motor", slow)
+	publish(t, sm, "motor", "0.5")
+	publish(t, sm, "motor", "0.6")
+
+	// Over the limit, so counted together
+	publish(t, sm, "eyes:front", "a")
+	publish(t, sm, "eyes:back", "b")
+
+	require.Eventually(t, func() bool {
+		info, _ := sm.Stream("motor")
+		return info.Dropped == 1
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.published.WithLabelValues("telemetry")))
+	assert.Equal(t, 5.0, testutil.ToFloat64(m.bytes.WithLabelValues("telemetry")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.delivered.WithLabelValues("telemetry")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.delivered.WithLabelValues("motor")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.dropped.WithLabelValues("motor")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.published.WithLabelValues(OtherStreams)))
+
+	expected := `
+# HELP yakapi_stream_reader_queue_depth The number of events waiting in a stream's reader buffers
+# TYPE yakapi_stream_reader_queue_depth gauge
+yakapi_stream_reader_queue_depth{stream="_other"} 0
+yakapi_stream_reader_queue_depth{stream="motor"} 1
+yakapi_stream_reader_queue_depth{stream="telemetry"} 0
+# HELP yakapi_stream_readers The number of readers subscribed to a stream
+# TYPE yakapi_stream_readers gauge
+yakapi_stream_readers{stream="_other"} 0
+yakapi_stream_readers{stream="motor"} 1
+yakapi_stream_readers{stream="telemetry"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(m, strings.NewReader(expected),
+		"yakapi_stream_readers", "yakapi_stream_reader_queue_depth"))
+
+	// No more series than the limit allows, plus the one for the rest
+	assert.Equal(t, 3, testutil.CollectAndCount(m, "yakapi_stream_delivery_seconds"))
+}
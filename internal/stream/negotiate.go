@@ -0,0 +1,87 @@
+package stream
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// formatContentTypes are the formats a subscriber may ask for by Accept header.
+var formatContentTypes = map[string]Format{
+	"application/x-ndjson":          FormatJSON,
+	"text/event-stream":             FormatSSE,
+	"application/vnd.yakapi.frames": FormatFramed,
+}
+
+// NegotiateFormat picks the subscription format from the format query
+// parameter, falling back to the Accept header and then FormatRaw.
+func NegotiateFormat(r *http.Request) (Format, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		switch format := Format(f); format {
+		case FormatRaw, FormatJSON, FormatSSE, FormatFramed:
+			return format, nil
+		default:
+			return "", fmt.Errorf("unknown format: %q", f)
+		}
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if format, ok := formatContentTypes[mediaType]; ok {
+			return format, nil
+		}
+	}
+
+	return FormatRaw, nil
+}
+
+// ParseOutOptions reads subscription options from a request.
+func ParseOutOptions(r *http.Request) (OutOptions, error) {
+	var opts OutOptions
+
+	ro, err := ParseReaderOptions(r.URL.Query())
+	if err != nil {
+		return opts, err
+	}
+	opts.ReaderOptions = ro
+
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		return opts, err
+	}
+	opts.Filter = filter
+
+	sample, err := ParseSampleOptions(r.URL.Query())
+	if err != nil {
+		return opts, err
+	}
+	opts.Sample = sample
+
+	format, err := NegotiateFormat(r)
+	if err != nil {
+		return opts, err
+	}
+	opts.Format = format
+
+	if format == FormatSSE {
+		opts.Keepalive = DefaultKeepalive
+
+		// EventSource sends this when reconnecting, so resume from there
+		// unless told otherwise.
+		if last := r.Header.Get("Last-Event-ID"); last != "" && isZeroID(opts.Since) {
+			id, err := ulid.Parse(last)
+			if err != nil {
+				return opts, fmt.Errorf("invalid Last-Event-ID: %w", err)
+			}
+			opts.Since = id
+		}
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,61 @@
+package stream
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	testCases := []struct {
+		name     string
+		url      string
+		accept   string
+		expected Format
+	}{
+		{"default", "/v1/stream/test", "", FormatRaw},
+		{"query", "/v1/stream/test?format=json", "", FormatJSON},
+		{"accept", "/v1/stream/test", "application/x-ndjson", FormatJSON},
+		{"accept list", "/v1/stream/test", "text/html, application/x-ndjson;q=0.9", FormatJSON},
+		{"query wins", "/v1/stream/test?format=raw", "application/x-ndjson", FormatRaw},
+		{"sse query", "/v1/stream/test?format=sse", "", FormatSSE},
+		{"sse accept", "/v1/stream/test", "text/event-stream", FormatSSE},
+		{"frames accept", "/v1/stream/test", "application/vnd.yakapi.frames, application/x-ndjson;q=0.9", FormatFramed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.url, nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			format, err := NegotiateFormat(r)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, format)
+		})
+	}
+
+	_, err := NegotiateFormat(httptest.NewRequest("GET", "/v1/stream/test?format=xml", nil))
+	assert.Error(t, err)
+}
+
+func TestParseOutOptionsSSE(t *testing.T) {
+	id := ulid.Make()
+
+	r := httptest.NewRequest("GET", "/v1/stream/test", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	r.Header.Set("Last-Event-ID", id.String())
+
+	opts, err := ParseOutOptions(r)
+	require.NoError(t, err)
+	assert.Equal(t, FormatSSE, opts.Format)
+	assert.Equal(t, id, opts.Since)
+	assert.Equal(t, DefaultKeepalive, opts.Keepalive)
+
+	r.Header.Set("Last-Event-ID", "bogus")
+	_, err = ParseOutOptions(r)
+	assert.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package stream
+
+// Patterns select streams by name. Names are divided into levels by ':' or
+// '/', which are interchangeable, and a pattern matches level by level:
+//
+//	* or + matches any single level
+//	# matches any number of remaining levels, and must come last
+//
+// So "sfc-control:*" matches "sfc-control:A" and "eyes/#" matches both
+// "eyes" and "eyes/front/left".
+
+func levels(name string) []string {
+	var out []string
+	start := 0
+	for i := 0; i < len(name); i++ {
+		if name[i] == ':' || name[i] == '/' {
+			out = append(out, name[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, name[start:])
+}
+
+// IsPattern reports whether name contains any wildcard levels.
+func IsPattern(name string) bool {
+	for _, l := range levels(name) {
+		switch l {
+		case "*", "+", "#":
+			return true
+		}
+	}
+	return false
+}
+
+// ValidPattern reports whether a pattern is well formed.
+func ValidPattern(pattern string) bool {
+	lv := levels(pattern)
+	for i, l := range lv {
+		if l == "#" && i != len(lv)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether the stream name matches pattern.
+func Match(pattern, name string) bool {
+	p, n := levels(pattern), levels(name)
+
+	for i, l := range p {
+		switch l {
+		case "#":
+			return i == len(p)-1
+		case "*", "+":
+			if i >= len(n) {
+				return false
+			}
+		default:
+			if i >= len(n) || n[i] != l {
+				return false
+			}
+		}
+	}
+
+	return len(p) == len(n)
+}
+
+// lookup finds the entry for a stream by name, or else for the longest
+// pattern matching it.
+func lookup[T any](m map[string]T, name string) (T, bool) {
+	if v, ok := m[name]; ok {
+		return v, true
+	}
+
+	best := ""
+	for pattern := range m {
+		if !IsPattern(pattern) || !Match(pattern, name) {
+			continue
+		}
+		if len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best = pattern
+		}
+	}
+
+	if best == "" {
+		var zero T
+		return zero, false
+	}
+	return m[best], true
+}
@@ -0,0 +1,46 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"sfc-control:*", "sfc-control:A", true},
+		{"sfc-control:*", "sfc-control-set:A", false},
+		{"sfc-control:*", "sfc-control", false},
+		{"sfc-control:*", "sfc-control:A:B", false},
+		{"sfc-control:+", "sfc-control:A", true},
+		{"sfc-control/+", "sfc-control:A", true},
+		{"eyes/#", "eyes", true},
+		{"eyes/#", "eyes/front", true},
+		{"eyes/#", "eyes/front/left", true},
+		{"eyes/#", "ears/front", false},
+		{"#", "anything:at/all", true},
+		{"+/front", "eyes/front", true},
+		{"+/front", "eyes/back", false},
+		{"telemetry", "telemetry", true},
+		{"telemetry", "telemetry:raw", false},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.match, Match(tc.pattern, tc.name), "%s ~ %s", tc.pattern, tc.name)
+	}
+}
+
+func TestIsPattern(t *testing.T) {
+	assert.True(t, IsPattern("sfc-control:*"))
+	assert.True(t, IsPattern("eyes/#"))
+	assert.True(t, IsPattern("+/front"))
+	assert.False(t, IsPattern("telemetry"))
+	assert.False(t, IsPattern("a*b:c+"))
+
+	assert.True(t, ValidPattern("eyes/#"))
+	assert.False(t, ValidPattern("#/eyes"))
+}
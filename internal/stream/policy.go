@@ -0,0 +1,119 @@
+package stream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delivery is what a stream does when a reader's buffer is full.
+type Delivery string
+
+const (
+	// DropNewest discards the event being delivered.
+	DropNewest Delivery = "drop-newest"
+
+	// DropOldest discards the oldest buffered event to make room, so the
+	// reader always has the latest.
+	DropOldest Delivery = "drop-oldest"
+
+	// Block holds up the stream, and so its publishers, until the reader
+	// makes room or BlockTimeout passes, after which the event is dropped.
+	Block Delivery = "block"
+
+	// Disconnect closes the reader.
+	Disconnect Delivery = "disconnect"
+)
+
+const (
+	DefaultBufferSize   = 8
+	DefaultBlockTimeout = time.Second
+
+	// MaxBufferSize bounds the buffer a reader can ask for.
+	MaxBufferSize = 1024
+)
+
+// Policy controls how a stream delivers events to its readers.
+type Policy struct {
+	Delivery     Delivery
+	BufferSize   int
+	BlockTimeout time.Duration
+}
+
+// DefaultPolicy drops new events for readers that fall behind.
+var DefaultPolicy = Policy{
+	Delivery:     DropNewest,
+	BufferSize:   DefaultBufferSize,
+	BlockTimeout: DefaultBlockTimeout,
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.Delivery == "" {
+		p.Delivery = DefaultPolicy.Delivery
+	}
+	if p.BufferSize <= 0 {
+		p.BufferSize = DefaultPolicy.BufferSize
+	}
+	if p.BlockTimeout <= 0 {
+		p.BlockTimeout = DefaultPolicy.BlockTimeout
+	}
+	return p
+}
+
+func ParseDelivery(s string) (Delivery, error) {
+	switch d := Delivery(s); d {
+	case DropNewest, DropOldest, Block, Disconnect:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown delivery: %q", s)
+	}
+}
+
+// ParsePolicy reads a stream policy such as "block:32". The optional number
+// after the delivery is the reader buffer size.
+func ParsePolicy(s string) (Policy, error) {
+	delivery, size, hasSize := strings.Cut(s, ":")
+
+	var p Policy
+	var err error
+	p.Delivery, err = ParseDelivery(delivery)
+	if err != nil {
+		return p, err
+	}
+
+	if hasSize {
+		p.BufferSize, err = strconv.Atoi(size)
+		if err != nil || p.BufferSize <= 0 || p.BufferSize > MaxBufferSize {
+			return p, fmt.Errorf("invalid buffer size: %q", size)
+		}
+	}
+
+	return p.withDefaults(), nil
+}
+
+// ParsePolicies reads a comma separated list of stream policies such as
+// "ci=block:32,telemetry=drop-oldest".
+func ParsePolicies(s string) (map[string]Policy, error) {
+	policies := make(map[string]Policy)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid policy: %q", item)
+		}
+
+		p, err := ParsePolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		policies[name] = p
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,136 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies("ci=block:32, sfc-control:A=drop-oldest,,")
+	require.NoError(t, err)
+
+	assert.Equal(t, Policy{Delivery: Block, BufferSize: 32, BlockTimeout: DefaultBlockTimeout}, policies["ci"])
+	assert.Equal(t, Policy{Delivery: DropOldest, BufferSize: DefaultBufferSize, BlockTimeout: DefaultBlockTimeout}, policies["sfc-control:A"])
+
+	for _, bad := range []string{"ci", "ci=bogus", "ci=block:0", "ci=block:x", "=block"} {
+		_, err := ParsePolicies(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func fill(r *Reader, n int) {
+	for i := 0; i < n; i++ {
+		r.deliver(Event{Data: []byte{byte(i)}})
+	}
+}
+
+func TestReaderDelivery(t *testing.T) {
+	t.Run("drop newest", func(t *testing.T) {
+		r := newReader(Policy{Delivery: DropNewest, BufferSize: 2}, 0)
+		fill(r, 5)
+
+		assert.Equal(t, uint64(3), r.Dropped())
+		assert.Equal(t, []byte{0}, (<-r.C).Data)
+		assert.Equal(t, []byte{1}, (<-r.C).Data)
+
+		// The next delivery reports what was missed
+		r.deliver(Event{Data: []byte{9}})
+		e := <-r.C
+		assert.Equal(t, []byte{9}, e.Data)
+		assert.Equal(t, uint64(3), e.Dropped)
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		r := newReader(Policy{Delivery: DropOldest, BufferSize: 2}, 0)
+		fill(r, 5)
+
+		assert.Equal(t, uint64(3), r.Dropped())
+		first, second := <-r.C, <-r.C
+		assert.Equal(t, []byte{3}, first.Data)
+		assert.Equal(t, []byte{4}, second.Data)
+		assert.Equal(t, uint64(3), first.Dropped+second.Dropped)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		r := newReader(Policy{Delivery: Block, BufferSize: 1, BlockTimeout: time.Second}, 0)
+		fill(r, 1)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			<-r.C
+		}()
+
+		start := time.Now()
+		assert.True(t, r.deliver(Event{Data: []byte{1}}))
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Equal(t, uint64(0), r.Dropped())
+		assert.Equal(t, []byte{1}, (<-r.C).Data)
+	})
+
+	t.Run("block timeout", func(t *testing.T) {
+		r := newReader(Policy{Delivery: Block, BufferSize: 1, BlockTimeout: 10 * time.Millisecond}, 0)
+		fill(r, 2)
+
+		assert.Equal(t, uint64(1), r.Dropped())
+	})
+
+	t.Run("block interrupted by close", func(t *testing.T) {
+		r := newReader(Policy{Delivery: Block, BufferSize: 1, BlockTimeout: time.Minute}, 0)
+		fill(r, 1)
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			r.close()
+		}()
+
+		start := time.Now()
+		r.deliver(Event{})
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		r := newReader(Policy{Delivery: Disconnect, BufferSize: 1}, 0)
+		assert.True(t, r.deliver(Event{}))
+		assert.False(t, r.deliver(Event{}))
+	})
+}
+
+func TestManagerPolicy(t *testing.T) {
+	sm := NewManager()
+	sm.SetPolicy("slow", Policy{Delivery: Disconnect, BufferSize: 1})
+
+	r := sm.GetReader("slow", ReaderOptions{})
+	defer sm.ReturnReader("slow", r)
+
+	publish(t, sm, "slow", "one", "two", "three")
+
+	assert.Equal(t, "one", string(receive(t, r).Data))
+	select {
+	case _, ok := <-r.C:
+		assert.False(t, ok, "expected reader to be disconnected")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	r := NewReader(1)
+	assert.True(t, r.Send(Event{Data: []byte("one")}))
+	assert.Equal(t, "one", string(receive(t, r).Data))
+
+	r.Close()
+	assert.False(t, r.Send(Event{}))
+	_, ok := <-r.C
+	assert.False(t, ok)
+}
+
+func TestReaderBufferSize(t *testing.T) {
+	sm := NewManager()
+	r := sm.GetReader("test", ReaderOptions{BufferSize: 100})
+	defer sm.ReturnReader("test", r)
+
+	assert.Equal(t, 100, cap(r.C))
+}
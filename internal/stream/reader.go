@@ -0,0 +1,239 @@
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reader receives the events published to a stream.
+type Reader struct {
+	// C delivers events. It is closed when the stream disconnects the reader.
+	C <-chan Event
+
+	ch     chan Event
+	done   chan struct{}
+	policy Policy
+
+	dropped atomic.Uint64
+
+	// pending counts drops not yet reported on a delivered event.
+	pending uint64
+
+	// group is the consumer group the reader is a member of, if any.
+	// returned holds events handed back to be redelivered to the rest of
+	// the group when the reader leaves.
+	group    string
+	returned []Event
+
+	// expired counts the events found expired as they're read against their
+	// stream, if set.
+	expired func(name string, n uint64)
+
+	// mu serializes sends with closing the channel.
+	mu        sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+// NewReader returns a reader for a Broker other than Manager, or a fake, to
+// hand events to with Send. It holds up to bufferSize events. Close ends the
+// subscription.
+func NewReader(bufferSize int) *Reader {
+	return newReader(Policy{Delivery: Block, BufferSize: bufferSize}.withDefaults(), 0)
+}
+
+// Send blocks until the reader takes the event, returning false if it's closed
+// first.
+func (r *Reader) Send(e Event) bool {
+	return r.push(e)
+}
+
+// Close closes the reader, ending delivery.
+func (r *Reader) Close() {
+	r.close()
+}
+
+// Fresh prepares an event received from the reader for delivery, setting its
+// remaining TTL. If it has expired while waiting it returns false, and it's
+// counted against its stream.
+func (r *Reader) Fresh(e Event) (Event, bool) {
+	e, ok := e.Fresh(time.Now())
+	if !ok && r.expired != nil {
+		r.expired(e.Stream, 1)
+	}
+	return e, ok
+}
+
+func newReader(policy Policy, extra int) *Reader {
+	ch := make(chan Event, policy.BufferSize+extra)
+	return &Reader{
+		C:      ch,
+		ch:     ch,
+		done:   make(chan struct{}),
+		policy: policy,
+	}
+}
+
+// Dropped is the total number of events this reader has missed.
+func (r *Reader) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+func (r *Reader) drop() {
+	r.dropped.Add(1)
+	r.pending++
+}
+
+// trySend delivers without blocking. Requires r.mu.
+func (r *Reader) trySend(e Event) bool {
+	e.Dropped = r.pending
+	select {
+	case r.ch <- e:
+		r.pending = 0
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver hands an event to the reader according to its policy. It returns
+// false if the reader should be disconnected.
+func (r *Reader) deliver(e Event) bool {
+	_, ok, _ := r.deliverCounted(e)
+	return ok
+}
+
+// deliverCounted is deliver, also reporting whether the reader took the event,
+// which it won't have if it was dropped or the reader left in the meantime,
+// and how many events were dropped making room.
+func (r *Reader) deliverCounted(e Event) (delivered, ok bool, dropped uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	before := r.dropped.Load()
+	delivered, ok = r.offer(e)
+	return delivered, ok, r.dropped.Load() - before
+}
+
+// tryDeliver delivers only if there's room, and the reader is still open.
+func (r *Reader) tryDeliver(e Event) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return !r.closed && r.trySend(e)
+}
+
+// offer returns whether the event was delivered, and false for ok if the
+// reader should be disconnected. Requires r.mu.
+func (r *Reader) offer(e Event) (delivered, ok bool) {
+	if r.closed {
+		return false, true
+	}
+
+	if r.trySend(e) {
+		return true, true
+	}
+
+	switch r.policy.Delivery {
+	case DropOldest:
+		select {
+		case old := <-r.ch:
+			// Carry forward the drops the evicted event was reporting
+			r.pending += old.Dropped
+			r.drop()
+		default:
+		}
+		if r.trySend(e) {
+			return true, true
+		}
+		r.drop()
+	case Block:
+		e.Dropped = r.pending
+		t := time.NewTimer(r.policy.BlockTimeout)
+		defer t.Stop()
+
+		select {
+		case r.ch <- e:
+			r.pending = 0
+			return true, true
+		case <-t.C:
+			r.drop()
+		case <-r.done:
+		}
+	case Disconnect:
+		r.drop()
+		return false, false
+	default:
+		r.drop()
+	}
+
+	return false, true
+}
+
+// Redeliver hands back an event the subscriber received but couldn't finish
+// with. If the reader is a member of a consumer group, the event goes to
+// another member once this one leaves.
+func (r *Reader) Redeliver(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.group != "" {
+		r.returned = append(r.returned, e)
+	}
+}
+
+// unfinished collects the events handed back and those still buffered, once
+// the reader is closed.
+func (r *Reader) unfinished() []Event {
+	r.mu.Lock()
+	events := r.returned
+	r.returned = nil
+	r.mu.Unlock()
+
+	for e := range r.ch {
+		events = append(events, e)
+	}
+	return events
+}
+
+// isClosed reports whether the reader has been closed, though it may not yet
+// have been removed from its stream.
+func (r *Reader) isClosed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// push blocks until the reader accepts the event, returning false if the
+// reader is closed first.
+func (r *Reader) push(e Event) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+
+	select {
+	case r.ch <- e:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+func (r *Reader) close() {
+	r.closeOnce.Do(func() {
+		// Wake any blocked send before waiting for the lock
+		close(r.done)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.closed = true
+		close(r.ch)
+	})
+}
@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// replyBuffer is how many replies to other requests can arrive while a
+// request is waiting for its own before any are missed.
+const replyBuffer = 64
+
+// ErrReplyExpired is returned by Request when the reply expired before it was
+// read.
+var ErrReplyExpired = errors.New("reply expired")
+
+// ReplyStream is the stream a request to the named stream is replied on,
+// unless it says otherwise.
+func ReplyStream(name string) string {
+	return name + ":reply"
+}
+
+// Request publishes an event to a stream and waits for the reply carrying
+// its correlation ID, or for ctx to be done. A reply that has expired by then
+// returns ErrReplyExpired. The correlation ID defaults to
+// a new ID and the reply stream to ReplyStream.
+func Request(ctx context.Context, name string, e Event, sm Broker) (Event, error) {
+	if e.CorrelationID == "" {
+		e.CorrelationID = ulid.Make().String()
+	}
+	if e.ReplyTo == "" {
+		e.ReplyTo = ReplyStream(name)
+	}
+	if IsPattern(e.ReplyTo) {
+		return Event{}, fmt.Errorf("cannot reply to a stream pattern: %q", e.ReplyTo)
+	}
+
+	// Listen before asking so a quick reply isn't missed
+	r := sm.GetReader(e.ReplyTo, ReaderOptions{BufferSize: replyBuffer})
+	defer sm.ReturnReader(e.ReplyTo, r)
+
+	err := StreamIn(ctx, name, e, sm)
+	if err != nil {
+		return Event{}, err
+	}
+
+	for {
+		select {
+		case reply, ok := <-r.C:
+			if !ok {
+				return Event{}, fmt.Errorf("reply stream %q closed", e.ReplyTo)
+			}
+			if reply.CorrelationID != e.CorrelationID {
+				continue
+			}
+
+			// No better than none at all
+			reply, ok = r.Fresh(reply)
+			if !ok {
+				return Event{}, ErrReplyExpired
+			}
+			return reply, nil
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		}
+	}
+}
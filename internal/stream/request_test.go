@@ -0,0 +1,57 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequest(t *testing.T) {
+	sm := NewManager()
+
+	r := sm.GetReader("rpc", ReaderOptions{})
+	defer sm.ReturnReader("rpc", r)
+
+	go func() {
+		req := <-r.C
+		w := sm.GetWriter(req.ReplyTo)
+		defer sm.ReturnWriter(req.ReplyTo)
+
+		// Someone else's reply first
+		other := NewEvent("text/plain", []byte("not yours"))
+		other.CorrelationID = "other"
+		w <- other
+
+		reply := NewEvent("text/plain", append([]byte("re: "), req.Data...))
+		reply.CorrelationID = req.CorrelationID
+		w <- reply
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := Request(ctx, "rpc", NewEvent("text/plain", []byte("ping")), sm)
+	require.NoError(t, err)
+	assert.Equal(t, "re: ping", string(reply.Data))
+	assert.Equal(t, "rpc:reply", reply.Stream)
+	assert.NotEmpty(t, reply.CorrelationID)
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := Request(ctx, "rpc", NewEvent("text/plain", []byte("ping")), sm)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, "ping", string(receive(t, r).Data))
+	})
+
+	t.Run("pattern reply", func(t *testing.T) {
+		e := NewEvent("text/plain", nil)
+		e.ReplyTo = "rpc:*"
+		_, err := Request(ctx, "rpc", e, sm)
+		assert.Error(t, err)
+	})
+}
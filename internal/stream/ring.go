@@ -0,0 +1,85 @@
+package stream
+
+import "github.com/oklog/ulid/v2"
+
+// ring is a fixed size buffer of the most recent events published to a
+// stream.
+type ring struct {
+	buf   []Event
+	start int
+	n     int
+}
+
+func newRing(size int) *ring {
+	return &ring{buf: make([]Event, size)}
+}
+
+func (r *ring) len() int {
+	return r.n
+}
+
+func (r *ring) push(e Event) {
+	if len(r.buf) == 0 {
+		return
+	}
+
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = e
+		r.n++
+		return
+	}
+
+	r.buf[r.start] = e
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// events returns a copy of the buffered events, oldest first.
+func (r *ring) events() []Event {
+	out := make([]Event, r.n)
+	for i := 0; i < r.n; i++ {
+		out[i] = r.buf[(r.start+i)%len(r.buf)]
+	}
+	return out
+}
+
+// replay selects the events a new reader should receive before live data.
+func (r *ring) replay(opts ReaderOptions) []Event {
+	if !opts.replays() {
+		return nil
+	}
+
+	all := r.events()
+
+	if !isZeroID(opts.Since) {
+		all = eventsAfter(all, opts.Since)
+	}
+
+	if opts.Last > 0 && len(all) > opts.Last {
+		all = all[len(all)-opts.Last:]
+	}
+
+	return all
+}
+
+// eventsAfter returns the events published after the one identified by
+// since. If that event has already aged out of the buffer, everything newer
+// than since is returned instead.
+func eventsAfter(all []Event, since ulid.ULID) []Event {
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].ID == since {
+			return all[i+1:]
+		}
+	}
+
+	for i, e := range all {
+		if e.ID.Compare(since) > 0 {
+			return all[i:]
+		}
+	}
+
+	return nil
+}
+
+func isZeroID(id ulid.ULID) bool {
+	return id == ulid.ULID{}
+}
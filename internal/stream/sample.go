@@ -0,0 +1,152 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SampleOptions thin out a subscription for a subscriber that can't keep up
+// with the rate a stream is published at.
+type SampleOptions struct {
+	// MaxRate limits delivery to this many events per second. Events
+	// arriving faster are coalesced, delivering only the newest.
+	MaxRate float64
+
+	// Every delivers only every Nth event.
+	Every int
+}
+
+// ParseSampleOptions reads the max_rate and sample query parameters.
+func ParseSampleOptions(q url.Values) (SampleOptions, error) {
+	var opts SampleOptions
+
+	if rate := q.Get("max_rate"); rate != "" {
+		n, err := strconv.ParseFloat(rate, 64)
+		if err != nil || !(n > 0) {
+			return opts, fmt.Errorf("invalid max_rate: %q", rate)
+		}
+		opts.MaxRate = n
+	}
+
+	if sample := q.Get("sample"); sample != "" {
+		n, err := strconv.Atoi(sample)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid sample: %q", sample)
+		}
+		opts.Every = n
+	}
+
+	return opts, nil
+}
+
+// IsZero reports whether every event is delivered.
+func (o SampleOptions) IsZero() bool {
+	return o.MaxRate == 0 && o.Every <= 1
+}
+
+// Sample delivers the events from in that pass the filter, thinned out
+// according to opts. It keeps reading from in while the subscriber is busy,
+// so with a MaxRate a slow subscriber never fills its reader's buffer and
+// holds up the stream. The returned channel is closed when in is closed or
+// ctx is done.
+//
+// Drops reported on events that aren't delivered are carried on to the next
+// one that is.
+func Sample(ctx context.Context, in <-chan Event, opts SampleOptions, f Filter) <-chan Event {
+	out := make(chan Event)
+
+	var interval time.Duration
+	if opts.MaxRate > 0 {
+		interval = time.Duration(float64(time.Second) / opts.MaxRate)
+	}
+
+	go func() {
+		defer close(out)
+
+		var (
+			pending *Event
+			dropped uint64
+			seen    int
+			next    time.Time
+			timer   *time.Timer
+			timerC  <-chan time.Time
+			inC     = in
+		)
+		stopTimer := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+			timerC = nil
+		}
+		defer stopTimer()
+
+		for {
+			// Hold a pending event until it's due, then offer it. Without a
+			// rate there's nothing to coalesce, so stop reading until the
+			// subscriber takes it.
+			var outC chan<- Event
+			if pending != nil {
+				if wait := time.Until(next); interval > 0 && wait > 0 {
+					if timerC == nil {
+						timer = time.NewTimer(wait)
+						timerC = timer.C
+					}
+				} else {
+					outC = out
+				}
+				if interval == 0 {
+					inC = nil
+				}
+			}
+
+			var send Event
+			if pending != nil {
+				send = *pending
+				send.Dropped += dropped
+			}
+
+			select {
+			case e, ok := <-inC:
+				if !ok {
+					if pending != nil {
+						select {
+						case out <- send:
+						case <-ctx.Done():
+						}
+					}
+					return
+				}
+
+				e, ok = f.Apply(e)
+				if ok && opts.Every > 1 {
+					ok = seen%opts.Every == 0
+					seen++
+				}
+				if !ok {
+					dropped += e.Dropped
+					continue
+				}
+
+				if pending != nil {
+					dropped += pending.Dropped
+				}
+				pending = &e
+			case outC <- send:
+				pending = nil
+				dropped = 0
+				inC = in
+				next = time.Now().Add(interval)
+				stopTimer()
+			case <-timerC:
+				timerC = nil
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSampleOptions(t *testing.T) {
+	opts, err := ParseSampleOptions(url.Values{"max_rate": {"2.5"}, "sample": {"10"}})
+	require.NoError(t, err)
+	assert.Equal(t, SampleOptions{MaxRate: 2.5, Every: 10}, opts)
+
+	opts, err = ParseSampleOptions(url.Values{})
+	require.NoError(t, err)
+	assert.True(t, opts.IsZero())
+
+	for _, bad := range []url.Values{
+		{"max_rate": {"0"}},
+		{"max_rate": {"-1"}},
+		{"max_rate": {"NaN"}},
+		{"sample": {"0"}},
+		{"sample": {"x"}},
+	} {
+		_, err := ParseSampleOptions(bad)
+		assert.Error(t, err, bad.Encode())
+	}
+}
+
+func TestSampleEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan Event, 10)
+	for i := 0; i < 7; i++ {
+		e := NewEvent("text/plain", []byte{byte('0' + i)})
+		if i == 4 {
+			e.Dropped = 2
+		}
+		in <- e
+	}
+	close(in)
+
+	var got []string
+	var dropped uint64
+	for e := range Sample(ctx, in, SampleOptions{Every: 3}, Filter{}) {
+		got = append(got, string(e.Data))
+		dropped += e.Dropped
+	}
+
+	assert.Equal(t, []string{"0", "3", "6"}, got)
+	assert.Equal(t, uint64(2), dropped, "drops on skipped events are passed on")
+}
+
+func TestSampleMaxRate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan Event)
+	out := Sample(ctx, in, SampleOptions{MaxRate: 10}, Filter{})
+
+	in <- NewEvent("text/plain", []byte("first"))
+	e := <-out
+	assert.Equal(t, "first", string(e.Data))
+
+	// Arriving faster than the rate, all but the newest are coalesced away,
+	// and reading never stops while waiting.
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		in <- NewEvent("text/plain", []byte("stale"))
+	}
+	in <- NewEvent("text/plain", []byte("newest"))
+
+	e = <-out
+	assert.Equal(t, "newest", string(e.Data))
+	assert.Zero(t, e.Dropped, "coalescing isn't dropping")
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	close(in)
+	_, ok := <-out
+	assert.False(t, ok)
+}
+
+func TestSampleDoesNotBlockStream(t *testing.T) {
+	sm := NewManager()
+	sm.SetPolicy("ci", Policy{Delivery: Block, BufferSize: 1})
+
+	r := sm.GetReader("ci", ReaderOptions{})
+	defer sm.ReturnReader("ci", r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Nothing reads from the sampled channel, yet publishing carries on
+	out := Sample(ctx, r.C, SampleOptions{MaxRate: 1}, Filter{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, StreamIn(ctx, "ci", NewEvent("text/plain", []byte("x")), sm))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publisher was held up by a slow subscriber")
+	}
+
+	e := <-out
+	assert.Zero(t, e.Dropped)
+}
@@ -0,0 +1,616 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a JSON Schema that events published to a stream must satisfy.
+//
+// Only part of JSON Schema is supported: type, enum, const, properties,
+// required, additionalProperties, items, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum, minLength, maxLength, pattern, minItems and maxItems.
+// Annotations such as title and description are ignored, and schemas using
+// anything else, such as $ref or oneOf, are refused rather than only partly
+// enforced.
+type Schema struct {
+	raw  json.RawMessage
+	root *schemaNode
+}
+
+type schemaNode struct {
+	types []string
+	enum  []any
+
+	properties           map[string]*schemaNode
+	required             []string
+	additionalProperties *schemaNode
+	noAdditional         bool
+
+	items              *schemaNode
+	minItems, maxItems *int
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+}
+
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// ignoredKeywords are annotations, which don't affect validation.
+var ignoredKeywords = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true, "format": true,
+	"deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+// ParseSchema reads a JSON Schema.
+func ParseSchema(b []byte) (*Schema, error) {
+	var doc any
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	err := d.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+
+	root, err := parseSchemaNode(doc, "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = json.Compact(&buf, b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+
+	return &Schema{raw: buf.Bytes(), root: root}, nil
+}
+
+func parseSchemaNode(doc any, path string) (*schemaNode, error) {
+	if b, ok := doc.(bool); ok {
+		if b {
+			return &schemaNode{}, nil
+		}
+		// false allows nothing
+		return &schemaNode{types: []string{}}, nil
+	}
+
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object", path)
+	}
+
+	n := &schemaNode{}
+	for key, v := range obj {
+		var err error
+		switch key {
+		case "type":
+			n.types, err = parseTypes(v)
+		case "enum":
+			list, ok := v.([]any)
+			if !ok {
+				err = fmt.Errorf("enum must be an array")
+			}
+			n.enum = list
+		case "const":
+			n.enum = []any{v}
+		case "properties":
+			props, ok := v.(map[string]any)
+			if !ok {
+				err = fmt.Errorf("properties must be an object")
+				break
+			}
+			n.properties = make(map[string]*schemaNode, len(props))
+			for name, prop := range props {
+				n.properties[name], err = parseSchemaNode(prop, path+"."+name)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			list, ok := v.([]any)
+			for _, item := range list {
+				s, isString := item.(string)
+				ok = ok && isString
+				n.required = append(n.required, s)
+			}
+			if !ok {
+				err = fmt.Errorf("required must be an array of strings")
+			}
+		case "additionalProperties":
+			if b, ok := v.(bool); ok {
+				n.noAdditional = !b
+				break
+			}
+			n.additionalProperties, err = parseSchemaNode(v, path+".*")
+			if err != nil {
+				return nil, err
+			}
+		case "items":
+			n.items, err = parseSchemaNode(v, path+"[]")
+			if err != nil {
+				return nil, err
+			}
+		case "minItems":
+			n.minItems, err = parseCount(v)
+		case "maxItems":
+			n.maxItems, err = parseCount(v)
+		case "minLength":
+			n.minLength, err = parseCount(v)
+		case "maxLength":
+			n.maxLength, err = parseCount(v)
+		case "minimum":
+			n.minimum, err = parseBound(v)
+		case "maximum":
+			n.maximum, err = parseBound(v)
+		case "exclusiveMinimum":
+			n.exclusiveMinimum, err = parseBound(v)
+		case "exclusiveMaximum":
+			n.exclusiveMaximum, err = parseBound(v)
+		case "pattern":
+			s, ok := v.(string)
+			if !ok {
+				err = fmt.Errorf("pattern must be a string")
+				break
+			}
+			n.pattern, err = regexp.Compile(s)
+		default:
+			if !ignoredKeywords[key] {
+				err = fmt.Errorf("unsupported keyword")
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+
+	return n, nil
+}
+
+func parseTypes(v any) ([]string, error) {
+	var types []string
+	switch v := v.(type) {
+	case string:
+		types = []string{v}
+	case []any:
+		for _, t := range v {
+			s, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("must be a string or array of strings")
+			}
+			types = append(types, s)
+		}
+	default:
+		return nil, fmt.Errorf("must be a string or array of strings")
+	}
+
+	for _, t := range types {
+		if !schemaTypes[t] {
+			return nil, fmt.Errorf("unknown type %q", t)
+		}
+	}
+	return types, nil
+}
+
+func parseCount(v any) (*int, error) {
+	n, ok := v.(json.Number)
+	if ok {
+		i, err := strconv.Atoi(n.String())
+		if err == nil && i >= 0 {
+			return &i, nil
+		}
+	}
+	return nil, fmt.Errorf("must be a non-negative integer")
+}
+
+func parseBound(v any) (*float64, error) {
+	n, ok := v.(json.Number)
+	if ok {
+		f, err := n.Float64()
+		if err == nil {
+			return &f, nil
+		}
+	}
+	return nil, fmt.Errorf("must be a number")
+}
+
+// MarshalJSON returns the schema as it was registered.
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	return s.raw, nil
+}
+
+// UnmarshalJSON parses a schema, as ParseSchema does.
+func (s *Schema) UnmarshalJSON(b []byte) error {
+	parsed, err := ParseSchema(b)
+	if err != nil {
+		return err
+	}
+	*s = *parsed
+	return nil
+}
+
+// Validate checks a payload against the schema, describing the first problem
+// found.
+func (s *Schema) Validate(data []byte) error {
+	var v any
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&v)
+	if err == nil && d.More() {
+		err = fmt.Errorf("unexpected data after JSON value")
+	}
+	if err != nil {
+		return fmt.Errorf("not valid JSON: %w", err)
+	}
+
+	return s.root.validate(v, "$")
+}
+
+func (n *schemaNode) validate(v any, path string) error {
+	if n.types != nil && !n.hasType(v) {
+		if len(n.types) == 0 {
+			return fmt.Errorf("%s: not allowed", path)
+		}
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(n.types, " or "), typeOf(v))
+	}
+
+	if n.enum != nil && !n.inEnum(v) {
+		return fmt.Errorf("%s: %s is not one of the allowed values", path, describe(v))
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		return n.validateObject(v, path)
+	case []any:
+		return n.validateArray(v, path)
+	case string:
+		return n.validateString(v, path)
+	case json.Number:
+		return n.validateNumber(v, path)
+	}
+	return nil
+}
+
+func (n *schemaNode) hasType(v any) bool {
+	actual := typeOf(v)
+	for _, t := range n.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *schemaNode) inEnum(v any) bool {
+	for _, allowed := range n.enum {
+		if equalJSON(v, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *schemaNode) validateObject(obj map[string]any, path string) error {
+	for _, name := range n.required {
+		if _, ok := obj[name]; !ok {
+			return fmt.Errorf("%s: missing required property %q", path, name)
+		}
+	}
+
+	// Check properties in a stable order so the error reported is too
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prop, ok := n.properties[name]
+		switch {
+		case ok:
+		case n.noAdditional:
+			return fmt.Errorf("%s: unexpected property %q", path, name)
+		case n.additionalProperties != nil:
+			prop = n.additionalProperties
+		default:
+			continue
+		}
+
+		err := prop.validate(obj[name], path+"."+name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *schemaNode) validateArray(list []any, path string) error {
+	if n.minItems != nil && len(list) < *n.minItems {
+		return fmt.Errorf("%s: expected at least %d items, got %d", path, *n.minItems, len(list))
+	}
+	if n.maxItems != nil && len(list) > *n.maxItems {
+		return fmt.Errorf("%s: expected at most %d items, got %d", path, *n.maxItems, len(list))
+	}
+
+	if n.items != nil {
+		for i, item := range list {
+			err := n.items.validate(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (n *schemaNode) validateString(s string, path string) error {
+	length := utf8.RuneCountInString(s)
+	if n.minLength != nil && length < *n.minLength {
+		return fmt.Errorf("%s: expected at least %d characters, got %d", path, *n.minLength, length)
+	}
+	if n.maxLength != nil && length > *n.maxLength {
+		return fmt.Errorf("%s: expected at most %d characters, got %d", path, *n.maxLength, length)
+	}
+	if n.pattern != nil && !n.pattern.MatchString(s) {
+		return fmt.Errorf("%s: %q does not match %q", path, s, n.pattern)
+	}
+	return nil
+}
+
+func (n *schemaNode) validateNumber(num json.Number, path string) error {
+	f, err := num.Float64()
+	if err != nil {
+		return fmt.Errorf("%s: invalid number %s", path, num)
+	}
+
+	switch {
+	case n.minimum != nil && f < *n.minimum:
+		return fmt.Errorf("%s: %s is less than the minimum of %v", path, num, *n.minimum)
+	case n.maximum != nil && f > *n.maximum:
+		return fmt.Errorf("%s: %s is more than the maximum of %v", path, num, *n.maximum)
+	case n.exclusiveMinimum != nil && f <= *n.exclusiveMinimum:
+		return fmt.Errorf("%s: %s must be more than %v", path, num, *n.exclusiveMinimum)
+	case n.exclusiveMaximum != nil && f >= *n.exclusiveMaximum:
+		return fmt.Errorf("%s: %s must be less than %v", path, num, *n.exclusiveMaximum)
+	}
+	return nil
+}
+
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		f, err := v.Float64()
+		if err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return "null"
+	}
+}
+
+func describe(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return typeOf(v)
+	}
+	return string(b)
+}
+
+func equalJSON(a, b any) bool {
+	if an, ok := a.(json.Number); ok {
+		bn, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aerr := an.Float64()
+		bf, berr := bn.Float64()
+		return aerr == nil && berr == nil && af == bf
+	}
+
+	ab, aerr := json.Marshal(a)
+	bb, berr := json.Marshal(b)
+	return aerr == nil && berr == nil && bytes.Equal(ab, bb)
+}
+
+// ValidationError is an event refused for not matching its stream's schema.
+type ValidationError struct {
+	Stream string
+
+	// Index is the event's position in a batch.
+	Index int
+
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid event for %s: %v", e.Stream, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors are the events refused from a batch.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	return fmt.Sprintf("%d invalid events, the first: %v", len(errs), errs[0])
+}
+
+// Registration is a schema registered for a stream, or every stream matching
+// a pattern.
+type Registration struct {
+	Schema *Schema `json:"schema"`
+
+	// DeadLetter sends refused events to the stream's invalid stream.
+	DeadLetter bool `json:"dead_letter,omitempty"`
+}
+
+// InvalidStream is where events refused from a stream are sent, when its
+// schema asks for it.
+func InvalidStream(name string) string {
+	return name + ":invalid"
+}
+
+// SetSchema registers a schema for a stream, or every stream matching a
+// pattern. A registration without a schema removes it.
+func (sm *Manager) SetSchema(name string, reg Registration) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if reg.Schema == nil {
+		delete(sm.schemas, name)
+		return
+	}
+	sm.schemas[name] = reg
+}
+
+// Schemas returns the registered schemas, by stream name or pattern.
+func (sm *Manager) Schemas() map[string]Registration {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	schemas := make(map[string]Registration, len(sm.schemas))
+	for name, reg := range sm.schemas {
+		schemas[name] = reg
+	}
+	return schemas
+}
+
+// schema requires the manager to be locked.
+func (sm *Manager) schema(name string) (Registration, bool) {
+	return lookup(sm.schemas, name)
+}
+
+// Validate checks an event against the schema registered for its stream, if
+// any.
+func (sm *Manager) Validate(name string, e Event) error {
+	sm.mu.RLock()
+	reg, ok := sm.schema(name)
+	sm.mu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	err := reg.Schema.Validate(e.Data)
+	if err != nil {
+		return &ValidationError{Stream: name, Err: err}
+	}
+	return nil
+}
+
+// refuse validates an event, sending it to the invalid stream if it's refused
+// and its schema asks for that.
+func (sm *Manager) refuse(ctx context.Context, name string, e Event) error {
+	err := sm.Validate(name, e)
+	if err != nil {
+		sm.deadLetter(ctx, name, e)
+	}
+	return err
+}
+
+// deadLetter sends a refused event to the invalid stream if its schema asks
+// for that. It's only called while publishing, so the manager can't close
+// underneath it.
+func (sm *Manager) deadLetter(ctx context.Context, name string, e Event) {
+	sm.mu.RLock()
+	reg, _ := sm.schema(name)
+	sm.mu.RUnlock()
+
+	if !reg.DeadLetter {
+		return
+	}
+
+	// Queued, so refused events are kept until someone acks them, and
+	// straight to the stream, the invalid stream isn't validated
+	invalid := InvalidStream(name)
+	err := sm.DeclareQueue(invalid, DefaultGroup, AckOptions{})
+	if err != nil {
+		slog.Warn("failed to queue invalid stream", "stream", name, "invalid", invalid, "error", err)
+		return
+	}
+
+	w := sm.GetWriter(invalid)
+	select {
+	case w <- e:
+	case <-ctx.Done():
+	}
+	sm.ReturnWriter(invalid)
+}
+
+// LoadSchemas reads the schemas in a directory, one per file named for its
+// stream or pattern, escaped as in a URL path, with a .json extension.
+func LoadSchemas(dir string) (map[string]*Schema, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := make(map[string]*Schema)
+	for _, f := range files {
+		base, ok := strings.CutSuffix(f.Name(), ".json")
+		if f.IsDir() || !ok {
+			continue
+		}
+
+		name, err := url.PathUnescape(base)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid stream name", f.Name())
+		}
+		if IsPattern(name) && !ValidPattern(name) {
+			return nil, fmt.Errorf("%s: invalid stream pattern", f.Name())
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		schemas[name], err = ParseSchema(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+	}
+
+	return schemas, nil
+}
+
+// LookupSchema finds the schema that applies to a stream among registered
+// schemas, preferring one registered for its name over the most specific
+// pattern.
+func LookupSchema(schemas map[string]Registration, name string) (Registration, bool) {
+	return lookup(schemas, name)
+}
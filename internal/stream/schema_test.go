@@ -0,0 +1,183 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const motorSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"title": "Motor command",
+	"type": "object",
+	"required": ["left", "right"],
+	"properties": {
+		"left": {"type": "number", "minimum": -1, "maximum": 1},
+		"right": {"type": "number", "minimum": -1, "maximum": 1},
+		"mode": {"enum": ["drive", "coast"]},
+		"label": {"type": "string", "maxLength": 8, "pattern": "^[a-z]+$"},
+		"steps": {"type": "array", "items": {"type": "integer", "exclusiveMinimum": 0}, "maxItems": 2}
+	},
+	"additionalProperties": false
+}`
+
+func TestParseSchema(t *testing.T) {
+	s, err := ParseSchema([]byte(motorSchema))
+	require.NoError(t, err)
+
+	b, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "\n")
+	assert.Contains(t, string(b), `"required":["left","right"]`)
+
+	for _, bad := range []string{
+		`not json`,
+		`[]`,
+		`{"type": "float"}`,
+		`{"oneOf": [{"type": "string"}]}`,
+		`{"properties": {"x": {"$ref": "#/defs/x"}}}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"required": [1]}`,
+	} {
+		_, err := ParseSchema([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	s, err := ParseSchema([]byte(motorSchema))
+	require.NoError(t, err)
+
+	for data, want := range map[string]string{
+		`{"left": 0.5, "right": -0.5}`:             "",
+		`{"left": 1, "right": 0, "mode": "coast"}`: "",
+		`{"left": 0, "right": 0, "steps": [1, 2]}`: "",
+		`{"left": 0, "right": 0, "label": "fwd"}`:  "",
+		`{"left": 0}`:                                     `$: missing required property "right"`,
+		`{"left": "fast", "right": 0}`:                    "$.left: expected number, got string",
+		`{"left": 2, "right": 0}`:                         "$.left: 2 is more than the maximum of 1",
+		`{"left": 0, "right": 0, "mode": "reverse"}`:      `$.mode: "reverse" is not one of the allowed values`,
+		`{"left": 0, "right": 0, "label": "Forward"}`:     `$.label: "Forward" does not match "^[a-z]+$"`,
+		`{"left": 0, "right": 0, "label": "backwards"}`:   "$.label: expected at most 8 characters, got 9",
+		`{"left": 0, "right": 0, "steps": [1, 1.5]}`:      "$.steps[1]: expected integer, got number",
+		`{"left": 0, "right": 0, "steps": [0]}`:           "$.steps[0]: 0 must be more than 0",
+		`{"left": 0, "right": 0, "steps": [1, 2, 3]}`:     "$.steps: expected at most 2 items, got 3",
+		`{"left": 0, "right": 0, "speed": 1}`:             `$: unexpected property "speed"`,
+		`[0.5, 0.5]`:                                      "$: expected object, got array",
+		`{"left": 0, "right": 0} {"left": 0, "right": 0}`: "not valid JSON: unexpected data after JSON value",
+	} {
+		err := s.Validate([]byte(data))
+		if want == "" {
+			assert.NoError(t, err, data)
+		} else {
+			assert.EqualError(t, err, want, data)
+		}
+	}
+
+	s, err = ParseSchema([]byte(`{"additionalProperties": {"type": "boolean"}, "properties": {"id": {"const": 7}}}`))
+	require.NoError(t, err)
+	assert.NoError(t, s.Validate([]byte(`{"id": 7.0, "on": true}`)))
+	assert.EqualError(t, s.Validate([]byte(`{"id": 8}`)), "$.id: 8 is not one of the allowed values")
+	assert.EqualError(t, s.Validate([]byte(`{"on": "yes"}`)), "$.on: expected boolean, got string")
+}
+
+func TestManagerSchema(t *testing.T) {
+	ctx := context.Background()
+	sm := NewManager()
+
+	s, err := ParseSchema([]byte(`{"type": "object", "required": ["id"]}`))
+	require.NoError(t, err)
+	sm.SetSchema("motor:*", Registration{Schema: s})
+
+	r := sm.GetReader("motor:left", ReaderOptions{})
+	defer sm.ReturnReader("motor:left", r)
+
+	t.Run("publish", func(t *testing.T) {
+		err := sm.Publish(ctx, "motor:left", NewEvent("application/json", []byte(`{}`)))
+
+		var verr *ValidationError
+		require.True(t, errors.As(err, &verr))
+		assert.Equal(t, "motor:left", verr.Stream)
+		assert.EqualError(t, err, `invalid event for motor:left: $: missing required property "id"`)
+
+		require.NoError(t, sm.Publish(ctx, "motor:left", NewEvent("application/json", []byte(`{"id": 1}`))))
+		assert.Equal(t, `{"id": 1}`, string(receive(t, r).Data))
+
+		// Other streams are unaffected
+		require.NoError(t, sm.Publish(ctx, "telemetry", NewEvent("text/plain", []byte("ok"))))
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		err := sm.PublishBatch(ctx, []Event{
+			{Stream: "motor:left", ContentType: "application/json", Data: []byte(`{"id": 2}`)},
+			{Stream: "motor:left", ContentType: "application/json", Data: []byte(`null`)},
+		})
+
+		var verrs ValidationErrors
+		require.True(t, errors.As(err, &verrs))
+		require.Len(t, verrs, 1)
+		assert.Equal(t, 1, verrs[0].Index)
+		assert.Len(t, r.C, 0)
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		sm.SetSchema("motor:left", Registration{Schema: s, DeadLetter: true})
+
+		invalid := sm.GetReader(InvalidStream("motor:left"), ReaderOptions{})
+		defer sm.ReturnReader(InvalidStream("motor:left"), invalid)
+
+		err := sm.Publish(ctx, "motor:left", NewEvent("text/plain", []byte("oops")))
+		assert.Error(t, err)
+		assert.Equal(t, "oops", string(receive(t, invalid).Data))
+		assert.Len(t, r.C, 0)
+
+		// Only a refused batch's invalid events are kept, once it's refused
+		err = sm.PublishBatch(ctx, []Event{
+			{Stream: "motor:left", ContentType: "application/json", Data: []byte(`{"id": 3}`)},
+			{Stream: "motor:left", ContentType: "text/plain", Data: []byte("again")},
+		})
+		assert.Error(t, err)
+		assert.Equal(t, "again", string(receive(t, invalid).Data))
+		assert.Len(t, invalid.C, 0)
+		assert.Len(t, r.C, 0)
+
+		// Kept for whoever looks later
+		later := sm.GetReader(InvalidStream("motor:left"), ReaderOptions{Ack: true, BufferSize: 2})
+		defer sm.ReturnReader(InvalidStream("motor:left"), later)
+		assert.Equal(t, "oops", string(receive(t, later).Data))
+		assert.Equal(t, "again", string(receive(t, later).Data))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		sm.SetSchema("motor:left", Registration{})
+		sm.SetSchema("motor:*", Registration{})
+		assert.Empty(t, sm.Schemas())
+
+		require.NoError(t, sm.Publish(ctx, "motor:left", NewEvent("text/plain", []byte("anything"))))
+		assert.Equal(t, "anything", string(receive(t, r).Data))
+	})
+}
+
+func TestLoadSchemas(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "motor%3A%2A.json"), []byte(`{"type": "object"}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ci.json"), []byte(`{"type": "string"}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte(`ignored`), 0o644))
+
+	schemas, err := LoadSchemas(dir)
+	require.NoError(t, err)
+	assert.Len(t, schemas, 2)
+	assert.Contains(t, schemas, "motor:*")
+	assert.Contains(t, schemas, "ci")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"type": "float"}`), 0o644))
+	_, err = LoadSchemas(dir)
+	assert.ErrorContains(t, err, "bad.json")
+}
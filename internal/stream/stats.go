@@ -0,0 +1,154 @@
+package stream
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// rateWindow is the time constant of the moving averages behind the reported
+// rates. Rates settle to a steady publish rate after a few windows and decay
+// toward zero once publishing stops.
+const rateWindow = 10 * time.Second
+
+// ewma is an exponentially weighted moving average of a per second rate. It
+// decays lazily, so needs no ticker.
+type ewma struct {
+	value float64
+	last  time.Time
+}
+
+func (a *ewma) decay(now time.Time) {
+	if !a.last.IsZero() {
+		dt := now.Sub(a.last).Seconds()
+		a.value *= math.Exp(-dt / rateWindow.Seconds())
+	}
+	a.last = now
+}
+
+func (a *ewma) add(n float64, now time.Time) {
+	a.decay(now)
+	a.value += n / rateWindow.Seconds()
+}
+
+func (a *ewma) rate(now time.Time) float64 {
+	c := *a
+	c.decay(now)
+	return c.value
+}
+
+// stats are the running totals kept for each stream. Requires the stream to
+// be locked.
+type stats struct {
+	published       uint64
+	bytes           uint64
+	dropped         uint64
+	expired         uint64
+	lastPublished   time.Time
+	lastContentType string
+	messageRate     ewma
+	byteRate        ewma
+}
+
+func (st *stats) record(e Event) {
+	st.published++
+	st.bytes += uint64(len(e.Data))
+	st.lastPublished = e.Time
+	st.lastContentType = e.ContentType
+
+	now := time.Now()
+	st.messageRate.add(1, now)
+	st.byteRate.add(float64(len(e.Data)), now)
+}
+
+// StreamInfo describes a stream's current state.
+type StreamInfo struct {
+	Name            string      `json:"name"`
+	Writers         int         `json:"writers"`
+	Readers         int         `json:"readers"`
+	Delivery        Delivery    `json:"delivery"`
+	Retain          bool        `json:"retain"`
+	Published       uint64      `json:"published"`
+	Bytes           uint64      `json:"bytes"`
+	Dropped         uint64      `json:"dropped"`
+	Expired         uint64      `json:"expired"`
+	MessageRate     float64     `json:"message_rate"`
+	ByteRate        float64     `json:"byte_rate"`
+	LastPublished   *time.Time  `json:"last_published,omitempty"`
+	LastContentType string      `json:"last_content_type,omitempty"`
+	Groups          []GroupInfo `json:"groups,omitempty"`
+	Queues          []QueueInfo `json:"queues,omitempty"`
+
+	// Schema is the schema registered for the stream, if any.
+	Schema *Registration `json:"schema,omitempty"`
+}
+
+// Info reports the stream's state. Counts start from when the stream was
+// opened, though the last publish survives a restart when there is a log.
+func (s *Stream) Info() StreamInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	info := StreamInfo{
+		Name:            s.Name,
+		Writers:         s.writerCount,
+		Readers:         len(s.dataOut) + len(s.catchingUp) + s.groupMembers(),
+		Delivery:        s.policy.Delivery,
+		Retain:          s.retain,
+		Published:       s.stats.published,
+		Bytes:           s.stats.bytes,
+		Dropped:         s.stats.dropped,
+		Expired:         s.stats.expired,
+		MessageRate:     s.stats.messageRate.rate(now),
+		ByteRate:        s.stats.byteRate.rate(now),
+		LastContentType: s.stats.lastContentType,
+		Groups:          s.groupInfo(),
+		Queues:          s.queueInfo(),
+	}
+
+	if !s.stats.lastPublished.IsZero() {
+		t := s.stats.lastPublished
+		info.LastPublished = &t
+	}
+
+	return info
+}
+
+// Streams describes every open stream, sorted by name.
+func (sm *Manager) Streams() []StreamInfo {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	infos := make([]StreamInfo, 0, len(sm.streams))
+	for _, s := range sm.streams {
+		infos = append(infos, sm.info(s))
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+// Stream describes a single open stream.
+func (sm *Manager) Stream(name string) (StreamInfo, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	s, ok := sm.streams[name]
+	if !ok {
+		return StreamInfo{}, false
+	}
+	return sm.info(s), true
+}
+
+// info describes a stream, along with its schema. Requires sm.mu.
+func (sm *Manager) info(s *Stream) StreamInfo {
+	info := s.Info()
+	if reg, ok := sm.schema(info.Name); ok {
+		info.Schema = &reg
+	}
+	return info
+}
@@ -2,68 +2,590 @@ package stream
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
 )
 
-type StreamChan chan []byte
+// DefaultReplaySize is the number of recent events each stream keeps for
+// readers that connect late.
+const DefaultReplaySize = 64
+
+// catchUpBatch is how many events are read from the log at a time when a
+// reader replays from an offset.
+const catchUpBatch = 64
+
+type StreamChan chan Event
+
+// ReaderOptions control what a new reader receives before it switches to live
+// delivery. The zero value delivers live data only.
+type ReaderOptions struct {
+	// Since replays buffered events published after the event with this ID.
+	Since ulid.ULID
+
+	// Last replays at most this many of the most recent buffered events.
+	Last int
+
+	// Offset replays the stream's durable log starting at this offset.
+	// Offsets start at 1, so zero means no log replay.
+	Offset uint64
+
+	// BufferSize overrides the stream policy's buffer size for this reader.
+	BufferSize int
+
+	// Retained delivers the stream's retained event, if it has one, ahead
+	// of live events.
+	Retained bool
+
+	// Group joins the reader to the named consumer group, whose members
+	// share the stream's live events, each going to just one of them.
+	// Group readers don't replay.
+	Group string
+
+	// Ack subscribes to the stream's queue for the group, for at-least-once
+	// delivery. Each event carries a delivery tag, and is delivered again
+	// unless it's acked in time. BufferSize is how many unacked events the
+	// reader may hold, one by default.
+	Ack bool
+}
+
+func (o ReaderOptions) replays() bool {
+	return !isZeroID(o.Since) || o.Last > 0
+}
+
+// ParseReaderOptions reads the since, last, offset, buffer, retained, group
+// and ack query parameters.
+func ParseReaderOptions(q url.Values) (ReaderOptions, error) {
+	var opts ReaderOptions
+
+	if since := q.Get("since"); since != "" {
+		id, err := ulid.Parse(since)
+		if err != nil {
+			return opts, fmt.Errorf("invalid since: %w", err)
+		}
+		opts.Since = id
+	}
+
+	if last := q.Get("last"); last != "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid last: %q", last)
+		}
+		opts.Last = n
+	}
+
+	if offset := q.Get("offset"); offset != "" {
+		n, err := strconv.ParseUint(offset, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid offset: %q", offset)
+		}
+		opts.Offset = n
+	}
+
+	if buffer := q.Get("buffer"); buffer != "" {
+		n, err := strconv.Atoi(buffer)
+		if err != nil || n <= 0 || n > MaxBufferSize {
+			return opts, fmt.Errorf("invalid buffer: %q", buffer)
+		}
+		opts.BufferSize = n
+	}
+
+	if retained := q.Get("retained"); retained != "" {
+		b, err := strconv.ParseBool(retained)
+		if err != nil {
+			return opts, fmt.Errorf("invalid retained: %q", retained)
+		}
+		opts.Retained = b
+	}
+
+	opts.Group = q.Get("group")
+
+	if ack := q.Get("ack"); ack != "" {
+		b, err := strconv.ParseBool(ack)
+		if err != nil {
+			return opts, fmt.Errorf("invalid ack: %q", ack)
+		}
+		opts.Ack = b
+	}
+
+	return opts, nil
+}
 
 type Stream struct {
 	Name        string
 	dataIn      StreamChan
-	dataOut     []StreamChan
+	batchIn     chan []Event
+	holdIn      chan *hold
+	dataOut     []*Reader
 	writerCount int
+	replay      *ring
+	log         *Log
+	policy      Policy
+	stats       stats
+	metrics     *streamMetrics
+
+	// ttl is the time to live of events published without their own.
+	ttl time.Duration
+
+	// retain keeps the last event published, which is then the stream's
+	// current value rather than just something that happened.
+	retain   bool
+	retained *Event
+
+	// written is set once the stream has had a writer. Such streams are kept
+	// open once unused, so readers coming back can resume from the replay
+	// buffer, until they've been idle for the manager's idle expiry.
+	written bool
+
+	// idleSince is when the stream was last left unused.
+	idleSince time.Time
+
+	// reading counts history reads under way, so the stream and its log
+	// aren't closed in the meantime.
+	reading int
+
+	// flushing counts writers waiting for the stream to publish what they
+	// gave it, so it isn't closed in the meantime.
+	flushing int
+
+	// done is closed once the stream stops publishing.
+	done chan struct{}
+
+	// catchingUp holds readers still being fed from the log.
+	catchingUp map[*Reader]bool
+
+	// groups are the stream's consumer groups, by name.
+	groups map[string]*group
+
+	// queues hold events for acked readers, by group.
+	queues map[string]*queue
 
 	mu sync.RWMutex
 }
 
 func (s *Stream) stream() {
-	for data := range s.dataIn {
-		s.mu.RLock()
-		for _, out := range s.dataOut {
-			select {
-			case out <- data:
-			default:
-				slog.Warn("dropping data from stream", "stream", s.Name)
+	defer close(s.done)
+
+	for {
+		select {
+		case e, ok := <-s.dataIn:
+			if !ok {
+				return
+			}
+			s.publish(e)
+		case batch := <-s.batchIn:
+			// Nothing else is published in between
+			for _, e := range batch {
+				s.publish(e)
 			}
+		case h := <-s.holdIn:
+			// Nothing else is published until the holder lets go
+			for batch := range h.runs {
+				for _, e := range batch {
+					s.publish(e)
+				}
+				h.done <- struct{}{}
+			}
+		}
+	}
+}
+
+// hold gives a batch publisher the stream to itself. The stream publishes
+// each run of events sent on runs, in turn, until runs is closed.
+type hold struct {
+	runs chan []Event
+	done chan struct{}
+}
+
+func newHold() *hold {
+	return &hold{
+		runs: make(chan []Event),
+		done: make(chan struct{}),
+	}
+}
+
+// publish hands the held stream a run of events and waits until it has
+// published them.
+func (h *hold) publish(batch []Event) {
+	h.runs <- batch
+	<-h.done
+}
+
+func (s *Stream) publish(e Event) {
+	start := time.Now()
+	e.stamp()
+	e.Stream = s.Name
+
+	s.mu.Lock()
+	if e.Expires == nil && s.ttl > 0 {
+		e.SetTTL(s.ttl)
+	}
+	if e.Expired(time.Now()) {
+		// Stale before it got here, such as from a batch held up by a
+		// flaky link
+		s.stats.expired++
+		s.metrics.expire(1)
+		s.mu.Unlock()
+		return
+	}
+
+	if s.log != nil {
+		offset, err := s.log.Append(e)
+		if err != nil {
+			slog.Error("error appending to stream log", "stream", s.Name, "error", err)
+		} else {
+			e.Offset = offset
 		}
-		s.mu.RUnlock()
+	}
+
+	s.replay.push(e)
+	s.stats.record(e)
+	m := s.metrics
+	m.publish(e)
+	if s.retain {
+		s.retained = &e
+	}
+	readers := append([]*Reader(nil), s.dataOut...)
+	groups := make([]*group, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, g)
+	}
+	s.mu.Unlock()
+
+	// Deliver outside the lock so a blocking reader doesn't hold up
+	// readers joining or leaving. Anyone joining now has already seen
+	// this event in their replay, or asked not to.
+	var dropped uint64
+	for _, r := range readers {
+		delivered, ok, n := r.deliverCounted(e)
+		dropped += n
+		if delivered {
+			m.deliver(time.Since(start))
+		}
+		if !ok {
+			slog.Warn("disconnecting slow reader from stream", "stream", s.Name)
+			s.disconnect(r)
+		}
+	}
+	for _, g := range groups {
+		delivered, n := s.deliverGroup(g, e)
+		dropped += n
+		if delivered {
+			m.deliver(time.Since(start))
+		}
+	}
+
+	if dropped > 0 {
+		s.mu.Lock()
+		s.stats.dropped += dropped
+		s.metrics.drop(dropped)
+		s.mu.Unlock()
 	}
 }
 
-func (s *Stream) NewReader() StreamChan {
+// disconnect removes a reader on the stream's initiative, closing its channel.
+// A group member's events go to the rest of its group.
+func (s *Stream) disconnect(r *Reader) {
+	s.mu.Lock()
+	s.removeReader(r)
+	var g *group
+	if r.group != "" {
+		g = s.leaveGroup(r)
+	}
+	r.close()
+	s.mu.Unlock()
+
+	if r.group != "" {
+		s.redeliver(g, r)
+	}
+}
+
+// removeReader requires the stream to be locked.
+func (s *Stream) removeReader(r *Reader) {
+	for i, out := range s.dataOut {
+		if out == r {
+			s.dataOut = append(s.dataOut[:i], s.dataOut[i+1:]...)
+			break
+		}
+	}
+}
+
+// NewReader returns a reader of events published to the stream. Any buffered
+// events selected by opts are queued ahead of live events.
+func (s *Stream) NewReader(opts ReaderOptions) *Reader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policy := s.policy
+	if opts.BufferSize > 0 {
+		policy.BufferSize = opts.BufferSize
+	}
+
+	if opts.Group != "" {
+		r := newReader(policy, 0)
+		s.joinGroup(opts.Group, r)
+		return r
+	}
+
+	if opts.Offset > 0 && s.log != nil {
+		r := newReader(policy, 0)
+		s.catchingUp[r] = true
+		go s.catchUp(r, opts.Offset)
+		return r
+	}
+
+	replay := s.replayFor(opts)
+
+	r := newReader(policy, len(replay))
+	for _, e := range replay {
+		r.ch <- e
+	}
+
+	s.dataOut = append(s.dataOut, r)
+	return r
+}
+
+// newQueueReader returns a live reader feeding a queue. Whatever the stream's
+// policy, it blocks rather than dropping or disconnecting, as the queue must
+// see every event to deliver it at least once.
+func (s *Stream) newQueueReader() *Reader {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	ch := make(StreamChan, 8)
-	s.dataOut = append(s.dataOut, ch)
-	return ch
+	r := newReader(Policy{Delivery: Block, BufferSize: MaxBufferSize}.withDefaults(), 0)
+	s.dataOut = append(s.dataOut, r)
+	return r
+}
+
+// replayFor selects the buffered events, and the retained event if asked for,
+// that a new reader receives before live data. Requires the stream to be
+// locked.
+func (s *Stream) replayFor(opts ReaderOptions) []Event {
+	replay := s.unexpired(s.replay.replay(opts))
+
+	if !opts.Retained || s.retained == nil || s.retained.Expired(time.Now()) {
+		return replay
+	}
+
+	// Not if the reader has already seen it, in the replay or before
+	r := *s.retained
+	if !isZeroID(opts.Since) && r.ID.Compare(opts.Since) <= 0 {
+		return replay
+	}
+	if len(replay) > 0 && replay[len(replay)-1].ID == r.ID {
+		return replay
+	}
+
+	return append(replay, r)
 }
 
-// maybeClose checks if the stream can be closed and closes it if so
-// requires the stream to be locked
+// Latest returns the retained event, if any, with its remaining TTL.
+func (s *Stream) Latest() (Event, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.retained == nil {
+		return Event{}, false
+	}
+	return s.retained.Fresh(time.Now())
+}
+
+// SetRetain sets whether the stream retains its last event. Turning it off
+// discards the retained event.
+func (s *Stream) SetRetain(retain bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retain = retain
+	if !retain {
+		s.retained = nil
+	} else if s.retained == nil && s.replay.len() > 0 {
+		events := s.replay.events()
+		s.retained = &events[len(events)-1]
+	}
+}
+
+// catchUp feeds a reader from the log until it reaches the end, then hands
+// it over to live delivery. Both happen under the stream lock, so nothing is
+// missed or repeated in between.
+func (s *Stream) catchUp(r *Reader, offset uint64) {
+	for {
+		events, err := s.log.Read(offset, catchUpBatch)
+		if err != nil {
+			slog.Error("error reading stream log", "stream", s.Name, "error", err)
+		}
+
+		for _, e := range events {
+			offset = e.Offset + 1
+			if e.Expired(time.Now()) {
+				s.mu.Lock()
+				s.stats.expired++
+				s.metrics.expire(1)
+				s.mu.Unlock()
+				continue
+			}
+			if !r.push(e) {
+				return
+			}
+		}
+
+		if err == nil && len(events) == catchUpBatch {
+			continue
+		}
+
+		s.mu.Lock()
+		if !s.catchingUp[r] {
+			// Closed while we were reading
+			s.mu.Unlock()
+			return
+		}
+
+		if err != nil || offset >= s.log.NextOffset() {
+			delete(s.catchingUp, r)
+			s.dataOut = append(s.dataOut, r)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// SetPolicy changes the delivery policy for readers created from now on.
+func (s *Stream) SetPolicy(p Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policy = p.withDefaults()
+}
+
+// idle reports whether nothing is using the stream. Requires the stream to be
+// locked.
+func (s *Stream) idle() bool {
+	return s.writerCount == 0 && s.reading == 0 && len(s.dataOut) == 0 && len(s.catchingUp) == 0 && len(s.groups) == 0
+}
+
+// flush waits for the stream to publish the events it has already taken.
+func (s *Stream) flush() {
+	// Events are published in order, so once the stream takes this empty
+	// batch everything before it is done
+	select {
+	case s.batchIn <- nil:
+	case <-s.done:
+	}
+}
+
+// maybeClose checks if the stream can be closed and closes it if so. Streams
+// holding events readers may come back for are kept until they expire.
+// Requires the stream to be locked.
 func (s *Stream) maybeClose() bool {
-	if s.writerCount == 0 && len(s.dataOut) == 0 {
-		slog.Debug("closing stream", "stream", s.Name)
-		close(s.dataIn)
-		return true
+	if !s.idle() || s.flushing > 0 {
+		return false
+	}
+
+	if s.written || s.retained != nil {
+		s.idleSince = time.Now()
+		return false
+	}
+
+	s.close()
+	return true
+}
+
+// expire closes the stream if it has been unused for at least d. A retained
+// event without a log to recover it from is the stream's current value, so
+// such streams don't expire. Requires the stream to be locked.
+func (s *Stream) expire(now time.Time, d time.Duration) bool {
+	if !s.idle() || s.flushing > 0 || s.idleSince.IsZero() || now.Sub(s.idleSince) < d {
+		return false
+	}
+	if s.retained != nil && s.log == nil {
+		return false
+	}
+
+	s.close()
+	return true
+}
+
+// close stops the stream publishing and closes its log. Requires the stream to
+// be locked.
+func (s *Stream) close() {
+	slog.Debug("closing stream", "stream", s.Name)
+	close(s.dataIn)
+	if s.log != nil {
+		err := s.log.Close()
+		if err != nil {
+			slog.Error("error closing stream log", "stream", s.Name, "error", err)
+		}
 	}
-	return false
 }
 
-func (s *Stream) CloseReader(ch StreamChan) bool {
+// shutdown waits for the stream to publish the events it has already taken,
+// then closes its readers and log. The readers feeding its queues are left, as
+// their subscribers are closed with the queue's members.
+func (s *Stream) shutdown(ctx context.Context) error {
+	// Events are published in order, so once the stream takes this empty
+	// batch everything before it is done
+	select {
+	case s.batchIn <- nil:
+	case <-ctx.Done():
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for i, out := range s.dataOut {
-		if out == ch {
-			s.dataOut = append(s.dataOut[:i], s.dataOut[i+1:]...)
-			break
+
+	queues := make(map[*Reader]bool, len(s.queues))
+	for _, q := range s.queues {
+		queues[q.in] = true
+	}
+
+	for _, r := range s.dataOut {
+		if !queues[r] {
+			r.close()
+		}
+	}
+	for r := range s.catchingUp {
+		r.close()
+	}
+	for _, g := range s.groups {
+		for _, r := range g.members {
+			r.close()
 		}
+		// Nobody is left to take their events
+		g.members = nil
+		g.signal()
+	}
+
+	if s.log != nil {
+		return s.log.Close()
+	}
+	return nil
+}
+
+func (s *Stream) CloseReader(r *Reader) bool {
+	r.close()
+	return s.detach(r)
+}
+
+// detach removes a reader, possibly shared with other streams, without
+// closing it. A group member's unfinished events go to the rest of its group,
+// which happens in the background as it may wait on the other members.
+func (s *Stream) detach(r *Reader) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.catchingUp, r)
+	s.removeReader(r)
+	if r.group != "" {
+		g := s.leaveGroup(r)
+		go s.redeliver(g, r)
 	}
-	close(ch)
 	slog.Debug("closed reader for stream", "stream", s.Name, "count", len(s.dataOut))
 	return s.maybeClose()
 }
@@ -72,24 +594,59 @@ func (s *Stream) Writer() StreamChan {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.writerCount++
+	s.written = true
 	return s.dataIn
 }
 
+// CloseWriter lets go of a writer. If that leaves the stream idle it returns
+// true, and the stream isn't closed until flushed is called.
 func (s *Stream) CloseWriter() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.writerCount--
 	slog.Debug("closed writer for stream", "stream", s.Name, "count", s.writerCount)
+	if !s.idle() {
+		return false
+	}
+	s.flushing++
+	return true
+}
+
+// flushed follows CloseWriter once the stream has been flushed, closing the
+// stream if it's still idle.
+func (s *Stream) flushed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flushing--
 	return s.maybeClose()
 }
 
 func New(name string) *Stream {
+	return newStream(name, DefaultPolicy, false, nil)
+}
+
+func newStream(name string, policy Policy, retain bool, log *Log) *Stream {
 	s := Stream{
 		Name:        name,
 		dataIn:      make(StreamChan),
-		dataOut:     make([]StreamChan, 0),
+		batchIn:     make(chan []Event),
+		holdIn:      make(chan *hold),
+		dataOut:     make([]*Reader, 0),
 		writerCount: 0,
+		replay:      newRing(DefaultReplaySize),
+		log:         log,
+		policy:      policy.withDefaults(),
+		retain:      retain,
+		catchingUp:  make(map[*Reader]bool),
+		groups:      make(map[string]*group),
+		queues:      make(map[string]*queue),
+		done:        make(chan struct{}),
+	}
+
+	if log != nil {
+		s.recover()
 	}
 
 	go s.stream()
@@ -97,99 +654,94 @@ func New(name string) *Stream {
 	return &s
 }
 
-type Manager struct {
-	streams map[string]*Stream
-	mu      sync.RWMutex
-}
-
-func (sm *Manager) GetWriter(name string) StreamChan {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	if s, ok := sm.streams[name]; ok {
-		return s.Writer()
+// recover refills the replay buffer from the tail of the log.
+func (s *Stream) recover() {
+	offset := s.log.FirstOffset()
+	if next := s.log.NextOffset(); next > offset+DefaultReplaySize {
+		offset = next - DefaultReplaySize
 	}
 
-	sm.streams[name] = New(name)
-
-	return sm.streams[name].Writer()
-}
-
-func (sm *Manager) ReturnWriter(name string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	if sm.streams[name] == nil {
-		slog.Warn("stream not found", "stream", name)
+	events, err := s.log.Read(offset, DefaultReplaySize)
+	if err != nil {
+		slog.Error("error recovering stream from log", "stream", s.Name, "error", err)
 		return
 	}
 
-	s := sm.streams[name]
-	if s.CloseWriter() {
-		delete(sm.streams, name)
-		slog.Debug("stream closed", "stream", name)
-		return
+	for _, e := range events {
+		s.replay.push(e)
+	}
+	s.written = len(events) > 0
+	if len(events) > 0 {
+		last := events[len(events)-1]
+		s.stats.lastPublished = last.Time
+		s.stats.lastContentType = last.ContentType
+		if s.retain {
+			s.retained = &last
+		}
 	}
 }
 
-func (sm *Manager) ReturnReader(name string, ch StreamChan) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+// OutOptions control how StreamOut delivers a subscription.
+type OutOptions struct {
+	ReaderOptions
+	Format Format
+	Filter Filter
+	Sample SampleOptions
 
-	if sm.streams[name] == nil {
-		slog.Warn("stream not found", "stream", name)
-		return
-	}
-
-	s := sm.streams[name]
-	if s.CloseReader(ch) {
-		delete(sm.streams, name)
-		slog.Debug("stream closed", "stream", name)
-		return
-	}
+	// Keepalive is how often to write a comment while no events are being
+	// delivered. Only SSE has a way to do so.
+	Keepalive time.Duration
 }
 
-func (sm *Manager) GetReader(name string) StreamChan {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+func StreamOut(ctx context.Context, w io.Writer, streamName string, sm Broker, opts OutOptions) error {
+	s := sm.GetReader(streamName, opts.ReaderOptions)
+	defer sm.ReturnReader(streamName, s)
 
-	var s *Stream
-	if sm.streams[name] != nil {
-		s = sm.streams[name]
-	} else {
-		s = New(name)
-		sm.streams[name] = s
-	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	return s.NewReader()
-}
-
-// TODO: Manager.Close()
+	events := s.C
+	filter := opts.Filter
+	if !opts.Sample.IsZero() {
+		// Sample filters first so it only counts events that match
+		events = Sample(ctx, s.C, opts.Sample, filter)
+		filter = Filter{}
+	}
 
-func NewManager() *Manager {
-	return &Manager{
-		streams: make(map[string]*Stream),
+	var keepalive <-chan time.Time
+	if opts.Keepalive > 0 && opts.Format == FormatSSE {
+		t := time.NewTicker(opts.Keepalive)
+		defer t.Stop()
+		keepalive = t.C
 	}
-}
 
-func StreamOut(ctx context.Context, w io.Writer, streamName string, sm *Manager) error {
-	s := sm.GetReader(streamName)
-	defer sm.ReturnReader(streamName, s)
+	// Drops reported on filtered out events are passed on to the next one
+	// delivered.
+	var dropped uint64
+
 	for {
 		select {
-		case data, ok := <-s:
+		case e, ok := <-events:
 			if !ok {
 				slog.Debug("stream closed", "stream", streamName)
 				return nil
 			}
-			_, err := w.Write(data)
-			if err != nil {
-				return errors.New("error writing data")
+
+			e, ok = filter.Apply(e)
+			if ok {
+				e, ok = s.Fresh(e)
 			}
+			if !ok {
+				dropped += e.Dropped
+				continue
+			}
+			e.Dropped += dropped
+			dropped = 0
 
-			_, err = w.Write([]byte("\n"))
+			err := writeEvent(w, e, opts.Format)
 			if err != nil {
-				return errors.New("error writing newline")
+				s.Redeliver(e)
+				return err
 			}
 
 			if flusher, ok := w.(http.Flusher); ok {
@@ -197,16 +749,21 @@ func StreamOut(ctx context.Context, w io.Writer, streamName string, sm *Manager)
 			} else {
 				slog.Warn("unable to flush")
 			}
+		case <-keepalive:
+			err := writeKeepalive(w)
+			if err != nil {
+				return err
+			}
+
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
 		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
-func StreamIn(ctx context.Context, streamName string, b []byte, sm *Manager) error {
-	s := sm.GetWriter(streamName)
-	defer sm.ReturnWriter(streamName)
-
-	s <- b
-	return nil
+func StreamIn(ctx context.Context, streamName string, e Event, b Broker) error {
+	return b.Publish(ctx, streamName, e)
 }
@@ -0,0 +1,520 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receive(t *testing.T, r *Reader) Event {
+	t.Helper()
+	select {
+	case e, ok := <-r.C:
+		require.True(t, ok, "channel closed")
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return Event{}
+	}
+}
+
+func publish(t *testing.T, sm *Manager, name string, msgs ...string) {
+	t.Helper()
+	w := sm.GetWriter(name)
+	defer sm.ReturnWriter(name)
+	for _, m := range msgs {
+		w <- NewEvent("text/plain", []byte(m))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	sm := NewManager()
+
+	// Hold a live reader so we know when the stream has buffered everything.
+	live := sm.GetReader("test", ReaderOptions{})
+	publish(t, sm, "test", "one", "two", "three")
+	for range 3 {
+		receive(t, live)
+	}
+	sm.ReturnReader("test", live)
+
+	t.Run("last", func(t *testing.T) {
+		ch := sm.GetReader("test", ReaderOptions{Last: 2})
+		defer sm.ReturnReader("test", ch)
+
+		assert.Equal(t, "two", string(receive(t, ch).Data))
+		assert.Equal(t, "three", string(receive(t, ch).Data))
+	})
+
+	t.Run("live after replay", func(t *testing.T) {
+		ch := sm.GetReader("test", ReaderOptions{Last: 1})
+		defer sm.ReturnReader("test", ch)
+
+		publish(t, sm, "test", "four")
+
+		assert.Equal(t, "three", string(receive(t, ch).Data))
+		assert.Equal(t, "four", string(receive(t, ch).Data))
+	})
+
+	t.Run("no options", func(t *testing.T) {
+		ch := sm.GetReader("test", ReaderOptions{})
+		defer sm.ReturnReader("test", ch)
+
+		assert.Len(t, ch.C, 0)
+	})
+}
+
+func TestPublishBeforeClose(t *testing.T) {
+	sm := NewManager()
+	sm.SetRetained("state:*", true)
+
+	// With nobody else using them, each stream may close as soon as its
+	// writer returns, but not before publishing what it was given
+	for i := range 100 {
+		name := fmt.Sprintf("state:%d", i)
+		require.NoError(t, sm.Publish(context.Background(), name, NewEvent("text/plain", []byte("on"))))
+
+		e, ok := sm.Latest(name)
+		require.True(t, ok, name)
+		assert.Equal(t, "on", string(e.Data))
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	sm := NewManager()
+	ctx := context.Background()
+
+	all := sm.GetReader("gps:*", ReaderOptions{BufferSize: 10})
+	defer sm.ReturnReader("gps:*", all)
+
+	require.NoError(t, sm.PublishBatch(ctx, []Event{
+		{Stream: "gps:b", Data: []byte("1")},
+		{Stream: "gps:a", Data: []byte("2")},
+		{Stream: "gps:b", Data: []byte("3")},
+	}))
+	for _, want := range []string{"1", "2", "3"} {
+		assert.Equal(t, want, string(receive(t, all).Data))
+	}
+
+	t.Run("all or nothing", func(t *testing.T) {
+		// Hold up gps:b with a reader that isn't reading
+		sm.SetPolicy("gps:b", Policy{Delivery: Block, BufferSize: 1, BlockTimeout: time.Minute})
+		stuck := sm.GetReader("gps:b", ReaderOptions{})
+		defer sm.ReturnReader("gps:b", stuck)
+		require.NoError(t, sm.Publish(ctx, "gps:b", NewEvent("text/plain", []byte("4"))))
+		require.NoError(t, sm.Publish(ctx, "gps:b", NewEvent("text/plain", []byte("5"))))
+		require.Eventually(t, func() bool { return len(all.C) == 2 }, time.Second, time.Millisecond)
+		receive(t, all)
+		receive(t, all)
+
+		a := sm.GetReader("gps:a", ReaderOptions{})
+		defer sm.ReturnReader("gps:a", a)
+
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err := sm.PublishBatch(ctx, []Event{
+			{Stream: "gps:a", Data: []byte("6")},
+			{Stream: "gps:b", Data: []byte("7")},
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// gps:a was free, but isn't published to without gps:b
+		require.NoError(t, sm.Publish(context.Background(), "gps:a", NewEvent("text/plain", []byte("8"))))
+		assert.Equal(t, "8", string(receive(t, a).Data))
+	})
+}
+
+func TestReplayResume(t *testing.T) {
+	sm := NewManager()
+
+	// A subscriber going away, such as ci.py restarting, with nobody else
+	// subscribed in the meantime
+	r := sm.GetReader("ci", ReaderOptions{})
+	publish(t, sm, "ci", "one")
+	last := receive(t, r)
+	sm.ReturnReader("ci", r)
+
+	publish(t, sm, "ci", "two")
+
+	r = sm.GetReader("ci", ReaderOptions{Since: last.ID})
+	defer sm.ReturnReader("ci", r)
+	assert.Equal(t, "two", string(receive(t, r).Data))
+}
+
+func TestStreamReleased(t *testing.T) {
+	sm := NewManager()
+	sm.SetIdleExpiry(50 * time.Millisecond)
+
+	closed := func(name string) func() bool {
+		return func() bool {
+			_, ok := sm.Stream(name)
+			return !ok
+		}
+	}
+
+	// Never written to, there's nothing to keep once it's unused
+	r := sm.GetReader("inbox:1234", ReaderOptions{})
+	sm.ReturnReader("inbox:1234", r)
+	assert.True(t, closed("inbox:1234")())
+
+	// Written to, it's kept a while for readers coming back
+	publish(t, sm, "motor", "0.5")
+	assert.False(t, closed("motor")())
+	assert.Eventually(t, closed("motor"), time.Second, 10*time.Millisecond)
+
+	t.Run("in use", func(t *testing.T) {
+		r := sm.GetReader("eyes", ReaderOptions{})
+		defer sm.ReturnReader("eyes", r)
+
+		publish(t, sm, "eyes", "jpeg")
+		assert.Never(t, closed("eyes"), 200*time.Millisecond, 10*time.Millisecond)
+	})
+
+	t.Run("log", func(t *testing.T) {
+		sm := NewManager()
+		sm.SetIdleExpiry(50 * time.Millisecond)
+		require.NoError(t, sm.OpenLog(LogConfig{Dir: t.TempDir()}))
+
+		// Expired, the log holding on to what was published
+		publish(t, sm, "motor", "0.5")
+		assert.Eventually(t, func() bool {
+			_, ok := sm.Stream("motor")
+			return !ok
+		}, time.Second, 10*time.Millisecond)
+
+		page, err := sm.History("motor", 1, 10)
+		require.NoError(t, err)
+		require.Len(t, page.Events, 1)
+
+		// Reopened with its replay buffer and offsets recovered
+		r := sm.GetReader("motor", ReaderOptions{Last: 1})
+		defer sm.ReturnReader("motor", r)
+		assert.Equal(t, "0.5", string(receive(t, r).Data))
+
+		publish(t, sm, "motor", "0.6")
+		assert.Equal(t, uint64(2), receive(t, r).Offset)
+
+		page, err = sm.History("never", 1, 10)
+		require.NoError(t, err)
+		assert.Empty(t, page.Events)
+		assert.NoDirExists(t, logDir(sm.logConfig.Dir, "never"))
+	})
+
+	t.Run("retained", func(t *testing.T) {
+		sm.SetRetained("telemetry", true)
+
+		// Its current value, with no log to recover it from
+		publish(t, sm, "telemetry", "{}")
+		assert.Never(t, closed("telemetry"), 200*time.Millisecond, 10*time.Millisecond)
+		_, ok := sm.Latest("telemetry")
+		assert.True(t, ok)
+	})
+}
+
+func TestRingReplay(t *testing.T) {
+	r := newRing(3)
+	ids := make([]ulid.ULID, 5)
+	for i := range ids {
+		ids[i] = ulid.Make()
+		r.push(Event{ID: ids[i], Data: []byte{byte(i)}})
+	}
+
+	require.Equal(t, 3, r.len())
+
+	testCases := []struct {
+		name     string
+		opts     ReaderOptions
+		expected []byte
+	}{
+		{"none", ReaderOptions{}, nil},
+		{"last", ReaderOptions{Last: 2}, []byte{3, 4}},
+		{"last exceeds buffer", ReaderOptions{Last: 10}, []byte{2, 3, 4}},
+		{"since buffered", ReaderOptions{Since: ids[2]}, []byte{3, 4}},
+		{"since latest", ReaderOptions{Since: ids[4]}, []byte{}},
+		{"since aged out", ReaderOptions{Since: ids[0]}, []byte{2, 3, 4}},
+		{"since and last", ReaderOptions{Since: ids[2], Last: 1}, []byte{4}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []byte
+			for _, e := range r.replay(tc.opts) {
+				got = append(got, e.Data...)
+			}
+			if tc.expected == nil {
+				assert.Nil(t, got)
+				return
+			}
+			assert.Equal(t, len(tc.expected), len(got))
+			assert.Equal(t, string(tc.expected), string(got))
+		})
+	}
+}
+
+func TestEventStamp(t *testing.T) {
+	sm := NewManager()
+	ch := sm.GetReader("test", ReaderOptions{})
+	defer sm.ReturnReader("test", ch)
+
+	w := sm.GetWriter("test")
+	w <- Event{ContentType: "text/plain", Data: []byte("hi")}
+	sm.ReturnWriter("test")
+
+	e := receive(t, ch)
+	assert.False(t, isZeroID(e.ID))
+	assert.False(t, e.Time.IsZero())
+	assert.Equal(t, "text/plain", e.ContentType)
+}
+
+func TestParseReaderOptions(t *testing.T) {
+	id := ulid.Make()
+
+	opts, err := ParseReaderOptions(url.Values{"since": {id.String()}, "last": {"5"}})
+	require.NoError(t, err)
+	assert.Equal(t, id, opts.Since)
+	assert.Equal(t, 5, opts.Last)
+
+	_, err = ParseReaderOptions(url.Values{"since": {"bogus"}})
+	assert.Error(t, err)
+
+	_, err = ParseReaderOptions(url.Values{"last": {"-1"}})
+	assert.Error(t, err)
+
+	opts, err = ParseReaderOptions(url.Values{"retained": {"true"}})
+	require.NoError(t, err)
+	assert.True(t, opts.Retained)
+
+	_, err = ParseReaderOptions(url.Values{"retained": {"maybe"}})
+	assert.Error(t, err)
+
+	opts, err = ParseReaderOptions(url.Values{"group": {"workers"}})
+	require.NoError(t, err)
+	assert.Equal(t, "workers", opts.Group)
+}
+
+func TestPatternReader(t *testing.T) {
+	sm := NewManager()
+
+	// Hold readers so we know when each stream has buffered everything.
+	a := sm.GetReader("sensors:a", ReaderOptions{})
+	b := sm.GetReader("sensors:b", ReaderOptions{})
+	publish(t, sm, "sensors:a", "a1")
+	receive(t, a)
+	publish(t, sm, "sensors:b", "b1")
+	receive(t, b)
+	sm.ReturnReader("sensors:a", a)
+	sm.ReturnReader("sensors:b", b)
+
+	ch := sm.GetReader("sensors:*", ReaderOptions{Last: 10})
+	defer sm.ReturnReader("sensors:*", ch)
+
+	e := receive(t, ch)
+	assert.Equal(t, "a1", string(e.Data))
+	assert.Equal(t, "sensors:a", e.Stream)
+	assert.Equal(t, "b1", string(receive(t, ch).Data))
+
+	t.Run("live", func(t *testing.T) {
+		publish(t, sm, "sensors:b", "b2")
+		e := receive(t, ch)
+		assert.Equal(t, "b2", string(e.Data))
+		assert.Equal(t, "sensors:b", e.Stream)
+	})
+
+	t.Run("new stream", func(t *testing.T) {
+		publish(t, sm, "sensors:c", "c1")
+		publish(t, sm, "other", "nope")
+		publish(t, sm, "sensors:c:deep", "nope")
+		publish(t, sm, "sensors:a", "a2")
+
+		assert.Equal(t, "c1", string(receive(t, ch).Data))
+		assert.Equal(t, "a2", string(receive(t, ch).Data))
+	})
+
+	t.Run("returned", func(t *testing.T) {
+		r := sm.GetReader("sensors:*", ReaderOptions{})
+		sm.ReturnReader("sensors:*", r)
+
+		_, ok := <-r.C
+		assert.False(t, ok)
+
+		sm.mu.RLock()
+		defer sm.mu.RUnlock()
+		assert.NotContains(t, sm.patterns, r)
+		for _, s := range sm.streams {
+			assert.NotContains(t, s.dataOut, r)
+		}
+	})
+}
+
+func TestPatternPolicy(t *testing.T) {
+	sm := NewManager()
+	sm.SetPolicy("sfc:*", Policy{Delivery: DropOldest})
+	sm.SetPolicy("sfc:control:#", Policy{Delivery: Block})
+	sm.SetPolicy("sfc:control:a", Policy{Delivery: Disconnect})
+
+	testCases := []struct {
+		name     string
+		expected Delivery
+	}{
+		{"sfc:status", DropOldest},
+		{"sfc:control:b", Block},
+		{"sfc:control:a", Disconnect},
+		{"telemetry", DropNewest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, sm.policy(tc.name).Delivery)
+		})
+	}
+}
+
+func TestStreamInfo(t *testing.T) {
+	sm := NewManager()
+	sm.SetPolicy("test", Policy{Delivery: DropNewest, BufferSize: 1})
+
+	slow := sm.GetReader("test", ReaderOptions{})
+	defer sm.ReturnReader("test", slow)
+	live := sm.GetReader("test", ReaderOptions{BufferSize: 8})
+	defer sm.ReturnReader("test", live)
+
+	publish(t, sm, "test", "one", "two", "three")
+	for range 3 {
+		receive(t, live)
+	}
+
+	// Drops are tallied once every reader has been offered the event
+	assert.Eventually(t, func() bool {
+		info, _ := sm.Stream("test")
+		return info.Dropped == 2
+	}, time.Second, time.Millisecond)
+
+	info, ok := sm.Stream("test")
+	require.True(t, ok)
+	assert.Equal(t, 2, info.Readers)
+	assert.Equal(t, uint64(3), info.Published)
+	assert.Equal(t, uint64(11), info.Bytes)
+	assert.Equal(t, "text/plain", info.LastContentType)
+
+	_, ok = sm.Stream("missing")
+	assert.False(t, ok)
+	assert.Len(t, sm.Streams(), 1)
+}
+
+func TestRetained(t *testing.T) {
+	sm := NewManager()
+	sm.SetRetained("state:*", true)
+
+	live := sm.GetReader("state:motor", ReaderOptions{})
+	publish(t, sm, "state:motor", "slow", "fast")
+	publish(t, sm, "events", "nope")
+	receive(t, live)
+	receive(t, live)
+	sm.ReturnReader("state:motor", live)
+
+	e, ok := sm.Latest("state:motor")
+	require.True(t, ok)
+	assert.Equal(t, "fast", string(e.Data))
+	assert.Equal(t, "text/plain", e.ContentType)
+
+	_, ok = sm.Latest("events")
+	assert.False(t, ok)
+
+	t.Run("on connect", func(t *testing.T) {
+		ch := sm.GetReader("state:motor", ReaderOptions{Retained: true})
+		defer sm.ReturnReader("state:motor", ch)
+
+		assert.Equal(t, "fast", string(receive(t, ch).Data))
+		assert.Len(t, ch.C, 0)
+	})
+
+	t.Run("not repeated by replay", func(t *testing.T) {
+		ch := sm.GetReader("state:motor", ReaderOptions{Retained: true, Last: 2})
+		defer sm.ReturnReader("state:motor", ch)
+
+		assert.Equal(t, "slow", string(receive(t, ch).Data))
+		assert.Equal(t, "fast", string(receive(t, ch).Data))
+		assert.Len(t, ch.C, 0)
+	})
+
+	t.Run("already seen", func(t *testing.T) {
+		ch := sm.GetReader("state:motor", ReaderOptions{Retained: true, Since: e.ID})
+		defer sm.ReturnReader("state:motor", ch)
+
+		assert.Len(t, ch.C, 0)
+	})
+
+	t.Run("pattern", func(t *testing.T) {
+		ch := sm.GetReader("#", ReaderOptions{Retained: true})
+		defer sm.ReturnReader("#", ch)
+
+		assert.Equal(t, "fast", string(receive(t, ch).Data))
+		assert.Len(t, ch.C, 0)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		sm.SetRetained("state:motor", false)
+		_, ok := sm.Latest("state:motor")
+		assert.False(t, ok)
+	})
+}
+
+func TestManagerClose(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	sm := NewManager()
+	require.NoError(t, sm.OpenLog(LogConfig{Dir: dir, SegmentBytes: 1024}))
+
+	live := sm.GetReader("motor", ReaderOptions{})
+	pattern := sm.GetReader("eyes:*", ReaderOptions{})
+	member := sm.GetReader("motor", ReaderOptions{Group: "drivers"})
+	acked := sm.GetReader("ci", ReaderOptions{Ack: true})
+
+	// Published but not yet received, so still to be delivered once closed
+	for _, msg := range []string{"0.5", "0.6"} {
+		require.NoError(t, sm.Publish(ctx, "motor", NewEvent("text/plain", []byte(msg))))
+	}
+
+	require.NoError(t, sm.Close(ctx))
+
+	assert.Equal(t, "0.5", string(receive(t, live).Data))
+	assert.Equal(t, "0.6", string(receive(t, live).Data))
+	for _, r := range []*Reader{live, pattern, member, acked} {
+		timeout := time.After(time.Second)
+	drain:
+		for {
+			select {
+			case _, ok := <-r.C:
+				if !ok {
+					break drain
+				}
+			case <-timeout:
+				t.Fatal("reader still open")
+			}
+		}
+	}
+
+	assert.ErrorIs(t, sm.Publish(ctx, "motor", NewEvent("text/plain", []byte("0.7"))), ErrClosed)
+	err := sm.PublishBatch(ctx, []Event{{Stream: "motor"}})
+	assert.ErrorIs(t, err, ErrClosed)
+
+	// Subscribers return their readers as usual
+	sm.ReturnReader("motor", live)
+	sm.ReturnReader("eyes:*", pattern)
+	sm.ReturnReader("motor", member)
+	sm.ReturnReader("ci", acked)
+
+	// Everything published made it to the log
+	recovered := NewManager()
+	require.NoError(t, recovered.OpenLog(LogConfig{Dir: dir, SegmentBytes: 1024}))
+	page, err := recovered.History("motor", 1, 10)
+	require.NoError(t, err)
+	assert.Len(t, page.Events, 2)
+}
@@ -0,0 +1,140 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SetTTL gives the event a time to live, counted from its time, after which
+// it's discarded rather than delivered.
+func (e *Event) SetTTL(d time.Duration) {
+	e.stamp()
+	expires := e.Time.Add(d)
+	e.Expires = &expires
+}
+
+// Expired reports whether the event's time to live has run out.
+func (e Event) Expired(now time.Time) bool {
+	return e.Expires != nil && !now.Before(*e.Expires)
+}
+
+// ParseTTL reads a time to live such as "500ms" or "30s".
+func ParseTTL(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ttl: %q", s)
+	}
+	return d, nil
+}
+
+// FormatTTL writes a time to live, to the millisecond, as ParseTTL reads it.
+// What's left of one that's about to expire is rounded up rather than to zero.
+func FormatTTL(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	if d <= 0 {
+		d = time.Millisecond
+	}
+	return d.String()
+}
+
+// ParseTTLs reads a comma separated list of stream default TTLs such as
+// "motor:*=500ms,ci=30s".
+func ParseTTLs(s string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid ttl: %q", item)
+		}
+
+		d, err := ParseTTL(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		ttls[name] = d
+	}
+
+	return ttls, nil
+}
+
+// SetTTL sets the time to live given to events published to a stream, or
+// every stream matching a pattern, that don't have their own. Zero removes
+// it.
+func (sm *Manager) SetTTL(name string, d time.Duration) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.ttls[name] = d
+	for streamName, s := range sm.streams {
+		if streamName == name || Match(name, streamName) {
+			s.SetTTL(sm.ttl(streamName))
+		}
+	}
+}
+
+// ttl requires the manager to be locked.
+func (sm *Manager) ttl(name string) time.Duration {
+	d, _ := lookup(sm.ttls, name)
+	return d
+}
+
+// SetTTL sets the time to live for events published from now on without
+// their own.
+func (s *Stream) SetTTL(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ttl = d
+}
+
+// Fresh returns the event with its TTL set to the time it has left to live,
+// or false if it has expired by now.
+func (e Event) Fresh(now time.Time) (Event, bool) {
+	if e.Expires == nil {
+		return e, true
+	}
+	if e.Expired(now) {
+		return e, false
+	}
+
+	e.TTL = e.Expires.Sub(now).Seconds()
+	return e, true
+}
+
+func (sm *Manager) countExpired(name string, n uint64) {
+	sm.mu.RLock()
+	s, ok := sm.streams[name]
+	sm.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	s.stats.expired += n
+	s.metrics.expire(n)
+	s.mu.Unlock()
+}
+
+// unexpired drops the expired events, counting them. Requires the stream to
+// be locked.
+func (s *Stream) unexpired(events []Event) []Event {
+	now := time.Now()
+
+	out := events[:0]
+	for _, e := range events {
+		if e.Expired(now) {
+			s.stats.expired++
+			s.metrics.expire(1)
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
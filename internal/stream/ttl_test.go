@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func publishTTL(t *testing.T, sm *Manager, name, msg string, ttl time.Duration) {
+	t.Helper()
+	w := sm.GetWriter(name)
+	defer sm.ReturnWriter(name)
+
+	e := NewEvent("text/plain", []byte(msg))
+	e.SetTTL(ttl)
+	w <- e
+}
+
+func TestTTL(t *testing.T) {
+	sm := NewManager()
+	sm.SetRetained("motor", true)
+
+	live := sm.GetReader("motor", ReaderOptions{})
+	publishTTL(t, sm, "motor", "stale", 20*time.Millisecond)
+	publish(t, sm, "motor", "fresh")
+	publishTTL(t, sm, "motor", "0.8", time.Minute)
+	for range 3 {
+		receive(t, live)
+	}
+	sm.ReturnReader("motor", live)
+
+	t.Run("fresh", func(t *testing.T) {
+		e, ok := sm.Latest("motor")
+		require.True(t, ok)
+		assert.Equal(t, "0.8", string(e.Data))
+		assert.InDelta(t, 60, e.TTL, 1)
+	})
+
+	time.Sleep(30 * time.Millisecond)
+
+	t.Run("replay", func(t *testing.T) {
+		r := sm.GetReader("motor", ReaderOptions{Last: 10})
+		defer sm.ReturnReader("motor", r)
+
+		assert.Equal(t, "fresh", string(receive(t, r).Data))
+		assert.Equal(t, "0.8", string(receive(t, r).Data))
+		assert.Len(t, r.C, 0)
+	})
+
+	t.Run("already expired", func(t *testing.T) {
+		r := sm.GetReader("motor", ReaderOptions{})
+		defer sm.ReturnReader("motor", r)
+
+		e := NewEvent("text/plain", []byte("late"))
+		e.Time = time.Now().Add(-time.Second)
+		e.SetTTL(500 * time.Millisecond)
+		w := sm.GetWriter("motor")
+		w <- e
+		w <- NewEvent("text/plain", []byte("on time"))
+		sm.ReturnWriter("motor")
+
+		assert.Equal(t, "on time", string(receive(t, r).Data))
+	})
+
+	t.Run("retained", func(t *testing.T) {
+		publishTTL(t, sm, "motor", "0.5", 10*time.Millisecond)
+		require.Eventually(t, func() bool {
+			_, ok := sm.Latest("motor")
+			return !ok
+		}, time.Second, time.Millisecond)
+	})
+
+	info, _ := sm.Stream("motor")
+	assert.Equal(t, uint64(2), info.Expired, "one in replay, one on publish")
+}
+
+func TestStreamTTL(t *testing.T) {
+	sm := NewManager()
+	sm.SetTTL("motor:*", 20*time.Millisecond)
+
+	r := sm.GetReader("motor:a", ReaderOptions{})
+	defer sm.ReturnReader("motor:a", r)
+
+	publish(t, sm, "motor:a", "0.8")
+	e := receive(t, r)
+	require.NotNil(t, e.Expires)
+	assert.Equal(t, e.Time.Add(20*time.Millisecond), *e.Expires)
+
+	e, ok := r.Fresh(e)
+	assert.True(t, ok)
+
+	time.Sleep(20 * time.Millisecond)
+	_, ok = r.Fresh(e)
+	assert.False(t, ok, "expired waiting in the reader")
+
+	info, _ := sm.Stream("motor:a")
+	assert.Equal(t, uint64(1), info.Expired)
+
+	sm.SetTTL("motor:*", 0)
+	publish(t, sm, "motor:a", "0.5")
+	assert.Nil(t, receive(t, r).Expires)
+}
+
+func TestQueueTTL(t *testing.T) {
+	sm := NewManager()
+	require.NoError(t, sm.DeclareQueue("ci", DefaultGroup, AckOptions{}))
+
+	publishTTL(t, sm, "ci", "stale", 10*time.Millisecond)
+	publish(t, sm, "ci", "fresh")
+	time.Sleep(20 * time.Millisecond)
+
+	r := sm.GetReader("ci", ReaderOptions{Ack: true})
+	defer sm.ReturnReader("ci", r)
+
+	assert.Equal(t, "fresh", string(receive(t, r).Data))
+
+	info, _ := sm.Stream("ci")
+	assert.Equal(t, uint64(1), info.Queues[0].Expired)
+}
+
+func TestFormatTTL(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		1234567 * time.Microsecond: "1.235s",
+		90 * time.Second:           "1m30s",
+		100 * time.Microsecond:     "1ms",
+	} {
+		s := FormatTTL(d)
+		assert.Equal(t, want, s)
+
+		_, err := ParseTTL(s)
+		assert.NoError(t, err, "round trip")
+	}
+}
+
+func TestParseTTLs(t *testing.T) {
+	ttls, err := ParseTTLs("motor:*=500ms, ci=30s")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"motor:*": 500 * time.Millisecond, "ci": 30 * time.Second}, ttls)
+
+	for _, s := range []string{"motor", "motor=soon", "motor=-1s", "=1s"} {
+		_, err := ParseTTLs(s)
+		assert.Error(t, err, s)
+	}
+}
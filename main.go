@@ -13,8 +13,11 @@ import (
 	"gitlab.com/greyxor/slogor"
 
 	"github.com/rhettg/yakapi/internal/cmd/pub"
+	"github.com/rhettg/yakapi/internal/cmd/record"
+	"github.com/rhettg/yakapi/internal/cmd/replay"
 	"github.com/rhettg/yakapi/internal/cmd/server"
 	"github.com/rhettg/yakapi/internal/cmd/sub"
+	"github.com/rhettg/yakapi/internal/config"
 )
 
 func loadDotEnv() error {
@@ -60,7 +63,8 @@ func loadDotEnv() error {
 			value = re.ReplaceAllString(value, `$1`)
 		}
 
-		fmt.Printf("Setting environment variable: %s=%s\n", key, value)
+		// Values may be secrets, so only the key is shown
+		fmt.Fprintf(os.Stderr, "Setting environment variable: %s\n", key)
 
 		// Set environment variable
 		err := os.Setenv(key, value)
@@ -109,11 +113,49 @@ func main() {
 		return
 	}
 
+	var serverFlags *config.Flags
+
 	serverCmd := &cobra.Command{
 		Use:   "server",
 		Short: "Start the YakAPI server",
-		Run:   server.DoServer,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := serverFlags.Load()
+			if err != nil {
+				slog.Error("Error loading configuration", "error", err)
+				os.Exit(1)
+			}
+
+			server.DoServer(cfg)
+		},
+	}
+	serverFlags = config.AddFlags(serverCmd)
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the server configuration",
+	}
+
+	var showFlags *config.Flags
+
+	configShowCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Print the configuration the server would run with, secrets redacted",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := showFlags.Load()
+			if err != nil {
+				slog.Error("Error loading configuration", "error", err)
+				os.Exit(1)
+			}
+
+			err = config.Show(os.Stdout, cfg)
+			if err != nil {
+				slog.Error("Error showing configuration", "error", err)
+				return
+			}
+		},
 	}
+	showFlags = config.AddFlags(configShowCmd)
+	configCmd.AddCommand(configShowCmd)
 
 	helloCmd := &cobra.Command{
 		Use:   "hello",
@@ -157,10 +199,58 @@ func main() {
 		},
 	}
 
+	var output string
+	var duration time.Duration
+
+	recordCmd := &cobra.Command{
+		Use:   "record [streams...]",
+		Short: "Record events from specified streams to a bag file",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				fmt.Println("Please specify at least one stream name")
+				return
+			}
+
+			err := record.DoRecord(serverURL, output, args, duration)
+			if err != nil {
+				slog.Error("Error recording streams", "error", err)
+				return
+			}
+		},
+	}
+	recordCmd.Flags().StringVarP(&output, "output", "o", "yakapi.bag", "Bag file to record to")
+	recordCmd.Flags().DurationVar(&duration, "duration", 0, "Stop recording after this long")
+
+	var replayOpts replay.Options
+
+	replayCmd := &cobra.Command{
+		Use:   "replay <bag> [streams...]",
+		Short: "Publish events recorded in a bag file",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				fmt.Println("Please specify a bag file")
+				return
+			}
+
+			err := replay.DoReplay(serverURL, args[0], args[1:], replayOpts)
+			if err != nil {
+				slog.Error("Error replaying bag", "error", err)
+				return
+			}
+		},
+	}
+	replayCmd.Flags().StringVar(&replayOpts.Speed, "speed", "1", "Multiple of the recorded speed, or max")
+	replayCmd.Flags().StringVar(&replayOpts.From, "from", "", "Start at this offset into the recording, or time")
+	replayCmd.Flags().StringVar(&replayOpts.To, "to", "", "Stop at this offset into the recording, or time")
+	replayCmd.Flags().StringVar(&replayOpts.Rename, "rename", "", "Streams to publish under new names, as old=new,...")
+
 	rootCmd.AddCommand(serverCmd)
+	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(helloCmd)
 	rootCmd.AddCommand(subCmd)
 	rootCmd.AddCommand(pubCmd)
+	rootCmd.AddCommand(recordCmd)
+	rootCmd.AddCommand(replayCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		slog.Error("Error executing root command", "error", err)